@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Certificates and merchandise are posted to entrants so their addresses
+// are tidied and checked: UK postcodes are validated and spaced properly,
+// postcodes typed into the wrong field are moved, county abbreviations are
+// spelled out and, given a postcode regions file, missing counties are
+// filled in.
+
+// ukPostcode matches a complete UK postcode, in either case, anywhere in a
+// string
+var ukPostcode = regexp.MustCompile(`\b([A-Za-z]{1,2}[0-9][0-9A-Za-z]?) ?([0-9][A-Za-z]{2})\b`)
+
+// ukPostcodeOnly matches a string that is just a UK postcode, spaced or not
+var ukPostcodeOnly = regexp.MustCompile(`^([A-Z]{1,2}[0-9][0-9A-Z]?) ?([0-9][A-Z]{2})$`)
+
+// ukPostcodeAreas are the letters that begin every real UK postcode,
+// including the Channel Islands and Isle of Man
+var ukPostcodeAreas = strings.Fields(`AB AL B BA BB BD BH BL BN BR BS BT CA CB CF CH CM CO CR CT CV CW
+	DA DD DE DG DH DL DN DT DY E EC EH EN EX FK FY G GL GU GY HA HD HG HP HR HS HU HX IG IM IP IV
+	JE KA KT KW KY L LA LD LE LL LN LS LU M ME MK ML N NE NG NN NP NR NW OL OX PA PE PH PL PO PR
+	RG RH RM S SA SE SG SK SL SM SN SO SP SR SS ST SW SY TA TD TF TN TQ TR TS TW UB W WA WC WD WF
+	WN WR WS WV YO ZE`)
+
+// countyNames spells out the usual abbreviations, keyed in lower case
+// without full stops
+var countyNames = map[string]string{
+	"beds": "Bedfordshire", "berks": "Berkshire", "bucks": "Buckinghamshire", "cambs": "Cambridgeshire",
+	"co durham": "County Durham", "derbys": "Derbyshire", "glos": "Gloucestershire", "gloucs": "Gloucestershire",
+	"gtr manchester": "Greater Manchester", "gt manchester": "Greater Manchester", "hants": "Hampshire",
+	"herts": "Hertfordshire", "lancs": "Lancashire", "leics": "Leicestershire", "lincs": "Lincolnshire",
+	"middx": "Middlesex", "northants": "Northamptonshire", "northumb": "Northumberland", "notts": "Nottinghamshire",
+	"oxon": "Oxfordshire", "salop": "Shropshire", "shrops": "Shropshire", "staffs": "Staffordshire",
+	"warks": "Warwickshire", "wilts": "Wiltshire", "worcs": "Worcestershire", "yorks": "Yorkshire",
+	"n yorks": "North Yorkshire", "north yorks": "North Yorkshire", "s yorks": "South Yorkshire",
+	"south yorks": "South Yorkshire", "w yorks": "West Yorkshire", "west yorks": "West Yorkshire",
+	"e yorks": "East Riding of Yorkshire", "east yorks": "East Riding of Yorkshire", "w mids": "West Midlands",
+	"w midlands": "West Midlands", "e sussex": "East Sussex", "w sussex": "West Sussex", "glam": "Glamorgan",
+	"co antrim": "County Antrim", "co down": "County Down", "co armagh": "County Armagh",
+	"co tyrone": "County Tyrone", "co fermanagh": "County Fermanagh", "co londonderry": "County Londonderry",
+}
+
+// postcodeRegions maps postcode areas, districts or sectors to counties,
+// loaded from the file named by postcoderegions in reglist.yml
+var postcodeRegions map[string]string
+
+// loadPostcodeRegions reads a CSV of postcode prefix, county. A header line,
+// if there is one, is ignored.
+func loadPostcodeRegions(path string) (map[string]string, error) {
+
+	res := make(map[string]string)
+	if path == "" {
+		return res, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if len(rec) < 2 {
+			continue
+		}
+		prefix := strings.ToUpper(strings.ReplaceAll(rec[0], " ", ""))
+		if prefix != "" && prefix[0] >= 'A' && prefix[0] <= 'Z' && !strings.EqualFold(prefix, "postcode") {
+			res[prefix] = strings.TrimSpace(rec[1])
+		}
+	}
+	return res, nil
+}
+
+// regionOf finds the county of the longest matching prefix of a postcode
+func regionOf(postcode string) string {
+
+	pc := strings.ReplaceAll(postcode, " ", "")
+	for n := len(pc); n > 0; n-- {
+		if r, ok := postcodeRegions[pc[:n]]; ok {
+			return r
+		}
+	}
+	return ""
+}
+
+// normalisePostcode returns a UK postcode properly spaced, or "" if it isn't one
+func normalisePostcode(pc string) string {
+
+	m := ukPostcodeOnly.FindStringSubmatch(strings.ToUpper(strings.Join(strings.Fields(pc), "")))
+	if m == nil {
+		return ""
+	}
+	return m[1] + " " + m[2]
+}
+
+// normaliseCounty spells out abbreviated county names
+func normaliseCounty(county string) string {
+
+	county = strings.Join(strings.Fields(county), " ")
+	key := strings.ToLower(strings.ReplaceAll(county, ".", ""))
+	if c, ok := countyNames[key]; ok {
+		return c
+	}
+	return properName(county)
+}
+
+// isUKAddress says whether an entrant's country means a UK postcode
+func isUKAddress(country string) bool {
+	return countryCodes[strings.ToLower(strings.TrimSpace(country))] == "44"
+}
+
+// checkAddress tidies an entrant's address and reports anything likely to
+// stop post reaching them
+func checkAddress(e *Entrant) {
+
+	name := e.RiderFirst + " " + e.RiderLast
+	defer func() { e.County = normaliseCounty(e.County) }()
+	if strings.TrimSpace(e.Address1) == "" || strings.TrimSpace(e.Town) == "" {
+		warnEntrant("address-incomplete", e.Entrantid, "Address1", "%v's address has no street or no town", name)
+	}
+	if !isUKAddress(e.Country) {
+		e.Postcode = strings.ToUpper(strings.TrimSpace(e.Postcode))
+		return
+	}
+
+	if pc := normalisePostcode(e.Postcode); pc != "" {
+		e.Postcode = pc
+	} else if pc, field := findPostcode(e); pc != "" {
+		if strings.TrimSpace(e.Postcode) != "" && field != "Postcode" {
+			warnEntrant("postcode-moved", e.Entrantid, field, "%v's postcode %v was in %v, replacing %q", name, pc, field, e.Postcode)
+		} else if field != "Postcode" {
+			warnEntrant("postcode-moved", e.Entrantid, field, "%v's postcode %v was in %v", name, pc, field)
+		}
+		e.Postcode = pc
+	} else if strings.TrimSpace(e.Postcode) == "" {
+		warnEntrant("postcode-missing", e.Entrantid, "Postcode", "%v has no postcode", name)
+		return
+	} else {
+		e.Postcode = strings.ToUpper(strings.TrimSpace(e.Postcode))
+		warnEntrant("postcode-invalid", e.Entrantid, "Postcode", "%v's postcode %v isn't a UK postcode", name, e.Postcode)
+		return
+	}
+
+	area := strings.TrimRight(e.Postcode[:2], "0123456789")
+	if !containsFold(ukPostcodeAreas, area) {
+		warnEntrant("postcode-invalid", e.Entrantid, "Postcode", "%v's postcode %v isn't in a real postcode area", name, e.Postcode)
+	}
+	if e.County == "" {
+		e.County = regionOf(e.Postcode)
+	}
+}
+
+// findPostcode looks for a UK postcode in the wrong field, or with other
+// text in the postcode field, and removes it from there
+func findPostcode(e *Entrant) (string, string) {
+
+	fields := []struct {
+		name string
+		val  *string
+	}{{"Postcode", &e.Postcode}, {"Town", &e.Town}, {"County", &e.County}, {"Address2", &e.Address2}, {"Address1", &e.Address1}}
+
+	for _, f := range fields {
+		loc := ukPostcode.FindStringSubmatchIndex(*f.val)
+		if loc == nil {
+			continue
+		}
+		pc := strings.ToUpper((*f.val)[loc[2]:loc[3]] + " " + (*f.val)[loc[4]:loc[5]])
+		if f.name != "Postcode" {
+			rest := (*f.val)[:loc[0]] + (*f.val)[loc[1]:]
+			*f.val = strings.Trim(strings.Join(strings.Fields(rest), " "), " ,")
+		}
+		return pc, f.name
+	}
+	return "", ""
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Bikes are matched against a catalogue of makes and models, each with the
+// other ways people write them, so that "BMW R1250GSA" and "bmw r 1250 gs
+// adventure" are both the BMW R 1250 GS Adventure. How sure the match is
+// goes with it. Bikes the catalogue doesn't know are split into make and
+// model as they always were, using bikewords, and reported so that they
+// can be added.
+
+// CatalogueModel is one model with its usual spelling and any others
+type CatalogueModel struct {
+	Model   string   `yaml:"model"`
+	Aliases []string `yaml:"aliases"`
+}
+
+// CatalogueMake is a manufacturer and the models it makes
+type CatalogueMake struct {
+	Make    string           `yaml:"make"`
+	Aliases []string         `yaml:"aliases"`
+	Models  []CatalogueModel `yaml:"models"`
+}
+
+// BikeCatalogue is the contents of the file named by bikecatalogue in reglist.yml
+type BikeCatalogue struct {
+	Makes []CatalogueMake `yaml:"makes"`
+}
+
+// BikeMatch is what a bike description was taken to be
+type BikeMatch struct {
+	Make       string
+	Model      string
+	Confidence float64 // 1 for an exact match, 0 if the make isn't known
+}
+
+// Degrees of confidence in a match
+const (
+	matchExact   = 1.0
+	matchPrefix  = 0.9 // Model followed by something extra, eg Rallye
+	matchNoMake  = 0.8 // Model known, make left out
+	matchClose   = 0.7 // Model misspelt
+	matchNoModel = 0.5 // Make known, model not
+)
+
+// NewBikeCatalogue loads the catalogue, which is empty if path is
+func NewBikeCatalogue(path string) (*BikeCatalogue, error) {
+
+	bc := &BikeCatalogue{}
+	if path == "" {
+		return bc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, bc); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// squashBike reduces a description to lower case letters and digits
+func squashBike(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+var bikeYear = regexp.MustCompile(`^'?(\d\d|\d{4})\s+`)
+
+// bikeNumbers are the runs of digits in a model, usually its capacity, which
+// a misspelling never changes: an R1100GS is not a misspelt R 1200 GS
+var bikeNumbers = regexp.MustCompile(`\d+`)
+
+// Resolve finds the make and model of a bike description
+func (bc *BikeCatalogue) Resolve(bike string) BikeMatch {
+
+	tokens := strings.FieldsFunc(bikeYear.ReplaceAllString(strings.TrimSpace(bike), ""), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '_' || r == '/'
+	})
+
+	var mk *CatalogueMake
+	rest := tokens
+	for i := range bc.Makes {
+		for _, name := range append([]string{bc.Makes[i].Make}, bc.Makes[i].Aliases...) {
+			sq := squashBike(name)
+			for k := 1; k <= 3 && k <= len(tokens); k++ {
+				if squashBike(strings.Join(tokens[:k], "")) == sq && (mk == nil || len(tokens)-k < len(rest)) {
+					mk, rest = &bc.Makes[i], tokens[k:]
+				}
+			}
+		}
+	}
+
+	if mk == nil {
+		for i := range bc.Makes {
+			if model, conf := bc.Makes[i].findModel(squashBike(bike)); conf == matchExact || conf == matchPrefix {
+				return BikeMatch{bc.Makes[i].Make, model, matchNoMake}
+			}
+		}
+		return BikeMatch{}
+	}
+	if len(rest) == 0 {
+		return BikeMatch{mk.Make, "", matchExact}
+	}
+	if model, conf := mk.findModel(squashBike(strings.Join(rest, ""))); conf > 0 {
+		return BikeMatch{mk.Make, model, conf}
+	}
+	return BikeMatch{mk.Make, properBike(strings.Join(rest, " ")), matchNoModel}
+}
+
+// findModel finds the model best matching a squashed description
+func (mk *CatalogueMake) findModel(rest string) (string, float64) {
+
+	var best string
+	var conf float64
+	var bestlen int
+	for _, m := range mk.Models {
+		for _, name := range append([]string{m.Model}, m.Aliases...) {
+			sq := squashBike(name)
+			c := 0.0
+			switch {
+			case sq == "":
+			case rest == sq:
+				c = matchExact
+			case strings.HasPrefix(rest, sq):
+				c = matchPrefix
+			case len(sq) >= 5 && editDistance(rest, sq) <= max(1, len(sq)/6) &&
+				slices.Equal(bikeNumbers.FindAllString(rest, -1), bikeNumbers.FindAllString(sq, -1)):
+				c = matchClose
+			}
+			if c > conf || (c == conf && c > 0 && len(sq) > bestlen) {
+				best, conf, bestlen = m.Model, c, len(sq)
+			}
+		}
+	}
+	return best, conf
+}
+
+// bikeCatalogue is loaded by loadConfig
+var bikeCatalogue = &BikeCatalogue{}
+
+// resolveBike splits an entrant's bike into make and model, reporting any
+// the catalogue doesn't know or had to guess
+func resolveBike(entrant, bike string) (string, string) {
+
+	if textNormaliser().IsDefault(bike) {
+		return words.DefaultBike, ""
+	}
+	m := bikeCatalogue.Resolve(bike)
+	switch {
+	case m.Confidence == 0:
+		if len(bikeCatalogue.Makes) > 0 && strings.TrimSpace(bike) != "" {
+			warnEntrant("bike-unknown", entrant, "Bike", "%v isn't in the bike catalogue", bike)
+		}
+		return extractMakeModel(properBike(properMake2(bike)))
+	case m.Confidence == matchNoModel:
+		warnEntrant("bike-unknown", entrant, "Bike", "%v model %v isn't in the bike catalogue", m.Make, m.Model)
+	case m.Confidence < matchPrefix:
+		warnEntrant("bike-guessed", entrant, "Bike", "%v taken to be %v %v (%.0f%% sure)", bike, m.Make, m.Model, m.Confidence*100)
+	}
+	return m.Make, m.Model
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// CertDetails holds everything that can be printed on a finisher certificate
+type CertDetails struct {
+	EntrantID  int
+	Rally      string
+	Year       string
+	Rider      string
+	Pillion    string
+	Bike       string
+	Route      string
+	RouteName  string
+	Distance   int
+	Units      string
+	Miles      int
+	StartTime  string
+	FinishTime string
+	FinishDate string
+	Duration   string
+}
+
+var defaultCertLines = []string{
+	"This is to certify that",
+	"{{.Rider}}{{if .Pillion}} and {{.Pillion}}{{end}}",
+	"successfully completed the {{.RouteName}} route",
+	"riding {{.Miles}} miles in {{.Duration}} on a {{.Bike}}",
+	"{{.FinishDate}}",
+}
+
+// certTimeLayouts lists the formats the check-in/check-out times may be held in
+var certTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", time.RFC3339}
+
+func parseCertTime(x string) (time.Time, bool) {
+
+	for _, l := range certTimeLayouts {
+		t, err := time.Parse(l, strings.TrimSpace(x))
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// loadFinishers reads the finishers, with their odometer readings and times, from
+// the RBLR database
+func loadFinishers(rdb *sql.DB, statuses []int) ([]CertDetails, error) {
+
+	var sts []string
+	for _, s := range statuses {
+		sts = append(sts, strconv.Itoa(s))
+	}
+	sqlx := `SELECT EntrantID,ifnull(RiderFirst,''),ifnull(RiderLast,''),ifnull(PillionFirst,''),ifnull(PillionLast,''),
+	ifnull(Bike,''),ifnull(Route,''),ifnull(OdoCounts,'M'),ifnull(OdoStart,''),ifnull(OdoFinish,''),
+	ifnull(StartTime,''),ifnull(FinishTime,'')
+	FROM entrants WHERE EntrantStatus IN (` + strings.Join(sts, ",") + `) ORDER BY EntrantID`
+
+	rows, err := rdb.Query(sqlx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []CertDetails
+	for rows.Next() {
+		var c CertDetails
+		var rf, rl, pf, pl, odocounts, odostart, odofinish string
+		err = rows.Scan(&c.EntrantID, &rf, &rl, &pf, &pl, &c.Bike, &c.Route, &odocounts, &odostart, &odofinish, &c.StartTime, &c.FinishTime)
+		if err != nil {
+			return nil, err
+		}
+		c.Rally = cfg.Rally
+		c.Year = cfg.Year
+		c.Rider = strings.TrimSpace(properName(rf) + " " + properName(rl))
+		if strings.TrimSpace(pf+pl) != "" {
+			c.Pillion = strings.TrimSpace(properName(pf) + " " + properName(pl))
+		}
+		c.Bike = properBike(properMake2(c.Bike))
+		c.Bike = strings.ReplaceAll(c.Bike, "_", " ")
+		if c.Route != "" {
+			c.RouteName = rblrRouteNames[c.Route[0]]
+		}
+		if c.RouteName == "" {
+			c.RouteName = c.Route
+		}
+		c.Distance = intval(odofinish) - intval(odostart)
+		c.Units = "miles"
+		c.Miles = c.Distance
+		if strings.HasPrefix(strings.ToUpper(odocounts), "K") {
+			c.Units = "km"
+			c.Miles = int(float64(c.Distance)/1.609344 + 0.5)
+		}
+		st, ok1 := parseCertTime(c.StartTime)
+		ft, ok2 := parseCertTime(c.FinishTime)
+		if ok2 {
+			c.FinishDate = ft.Format("2 January 2006")
+		}
+		if ok1 && ok2 && ft.After(st) {
+			d := ft.Sub(st).Round(time.Minute)
+			c.Duration = fmt.Sprintf("%d hours %02d minutes", int(d.Hours()), int(d.Minutes())%60)
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// writeCertificates produces a PDF holding a certificate for each finisher
+// recorded in the RBLR database then flags each as available
+func writeCertificates(pdfname string) error {
+
+	if rblrdb == nil {
+		return fmt.Errorf("no RBLR database (rblrdb) is configured")
+	}
+	var layout CertLayout
+	if cfg.Certificate != nil {
+		layout = *cfg.Certificate
+	}
+	if len(layout.Finishers) == 0 {
+		layout.Finishers = []int{rblrStatus.Finisher}
+	}
+	if len(layout.Lines) == 0 {
+		layout.Lines = defaultCertLines
+	}
+	if layout.Title == "" {
+		layout.Title = "Certificate of completion"
+	}
+	var tmpls []*template.Template
+	for i, ln := range layout.Lines {
+		t, err := template.New("line" + strconv.Itoa(i)).Parse(ln)
+		if err != nil {
+			return fmt.Errorf("certificate line %v: %v", i+1, err)
+		}
+		tmpls = append(tmpls, t)
+	}
+	if layout.Background != "" {
+		if _, err := os.Stat(layout.Background); err != nil {
+			return err
+		}
+	}
+
+	finishers, err := loadFinishers(rblrdb, layout.Finishers)
+	if err != nil {
+		return err
+	}
+
+	orientation := "P"
+	if layout.Landscape {
+		orientation = "L"
+	}
+	pdf, tr := newPDF(orientation, layout.Paper)
+	pw, ph := pdf.GetPageSize()
+
+	for _, c := range finishers {
+		pdf.AddPage()
+		if layout.Background != "" {
+			pdf.Image(layout.Background, 0, 0, pw, ph, false, "", 0, "")
+		}
+		pdf.SetXY(0, ph*0.2)
+		pdf.SetFont("Times", "B", 32)
+		pdf.CellFormat(pw, 20, tr(layout.Title), "", 1, "C", false, 0, "")
+		pdf.Ln(10)
+		for i, t := range tmpls {
+			var b bytes.Buffer
+			if err := t.Execute(&b, c); err != nil {
+				return fmt.Errorf("certificate line %v: %v", i+1, err)
+			}
+			if strings.TrimSpace(b.String()) == "" {
+				continue
+			}
+			size := 16.0
+			if strings.Contains(layout.Lines[i], ".Rider") {
+				size = 26
+			}
+			pdf.SetFont("Times", "", size)
+			pdf.CellFormat(pw, size*0.6, tr(b.String()), "", 1, "C", false, 0, "")
+			pdf.Ln(4)
+		}
+		if layout.Signatory != "" {
+			pdf.SetXY(pw*0.55, ph*0.85)
+			pdf.SetFont("Times", "I", 12)
+			pdf.CellFormat(pw*0.35, 8, tr(layout.Signatory), "T", 1, "C", false, 0, "")
+		}
+	}
+	if len(finishers) == 0 {
+		pdf.AddPage()
+	}
+	if err = pdf.OutputFileAndClose(pdfname); err != nil {
+		return err
+	}
+
+	var ids []int
+	for _, c := range finishers {
+		ids = append(ids, c.EntrantID)
+	}
+	return markCertificatesAvailable(rblrdb, ids)
+}
+
+// markCertificatesAvailable flags the certificates just produced
+func markCertificatesAvailable(rdb *sql.DB, ids []int) error {
+
+	tx, err := rdb.Begin()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err = tx.Exec("UPDATE entrants SET CertificateAvailable='Y' WHERE EntrantID=?", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
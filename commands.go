@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Reglist is driven by a command, the first word on the commandline, each
+// with its own flags. The flags themselves are those declared in main.go;
+// a command simply chooses which of them it accepts. With no command at
+// all, "all" is assumed so existing scripts carry on working.
+
+// Command describes one of reglist's commands
+type Command struct {
+	Name  string
+	Desc  string
+	Flags []string          // Names of flags from the full set, "new=old" offers old under a new name
+	Help  map[string]string // Replacement help for flags that mean something different here
+}
+
+var commands = []Command{
+	{Name: "all", Desc: "Import the CSV, build the spreadsheet and write the exports, as reglist always has",
+		Flags: nil}, // Everything
+	{Name: "import", Desc: "Load the CSV, from -csv or the configured csvurl, into the SQLite database",
+		Flags: []string{"csv", "source"}},
+	{Name: "build", Desc: "Build the spreadsheet from the SQLite database",
+		Flags: []string{"xls", "format", "tabs", "qr", "rd", "nolookup", "paypal"}},
+	{Name: "export", Desc: "Write only the requested exports from the SQLite database",
+		Flags: []string{"exp", "email", "gmail", "outlook", "vcard", "nok", "forms", "labels", "rd", "nolookup"},
+		Help:  map[string]string{"exp": "Path to output standard format CSV"}},
+	{Name: "lookup", Desc: "Look up IBA members by number or by \"first last\" name given as arguments",
+		Flags: []string{"rd"}},
+	{Name: "check", Desc: "Report problems with the entries in the SQLite database without writing anything",
+		Flags: []string{"rd", "nolookup", "paypal"}},
+	{Name: "diff", Desc: "Show how the CSV, from -csv or the configured csvurl, differs from the SQLite database",
+		Flags: []string{"csv", "source"}},
+	{Name: "serve", Desc: "Run the check-in/check-out web server backed by the RBLR database",
+		Flags: []string{"addr"}},
+	{Name: "dashboard", Desc: "Run a read-only web server showing the registration stats",
+		Flags: []string{"addr", "refresh"}},
+	{Name: "certs", Desc: "Produce finisher certificates from the RBLR database",
+		Flags: []string{"pdf=certs"},
+		Help:  map[string]string{"pdf": "Path to PDF output of finisher certificates"}},
+	{Name: "watch", Desc: "Keep polling the configured csvurl, rebuilding whenever it changes",
+		Flags: []string{"every=watch", "xls", "format", "tabs", "qr", "exp", "email", "gmail", "outlook", "vcard", "nok", "forms", "labels", "rd", "nolookup", "paypal"},
+		Help:  map[string]string{"every": "How often to poll csvurl, eg 10m"}},
+}
+
+// commonFlags are accepted by every command
+var commonFlags = []string{"cfg", "sql", "v", "log", "logjson", "report", "?"}
+
+// command is the one we're running
+var command *Command
+
+// findCommand returns the named command or nil
+func findCommand(name string) *Command {
+
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func commandUsage() {
+
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "%v\n", progdesc)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10v %v\n", c.Name, c.Desc)
+	}
+	fmt.Fprintln(w, "\nUse reglist command -? for the options of each command. The options of \"all\" are:")
+	flag.PrintDefaults()
+}
+
+// choiceFlag is a flag taking one of a few values, each setting the older
+// flags that made the same choice
+type choiceFlag struct {
+	value   string
+	choices map[string]func()
+}
+
+// newChoiceFlag defines a choiceFlag whose default is what the older flags
+// default to
+func newChoiceFlag(name, usage, value string, choices map[string]func()) *choiceFlag {
+
+	c := &choiceFlag{value, choices}
+	flag.Var(c, name, usage)
+	return c
+}
+
+func (c *choiceFlag) String() string {
+	return c.value
+}
+
+func (c *choiceFlag) Set(x string) error {
+
+	x = strings.ToLower(strings.TrimSpace(x))
+	set, ok := c.choices[x]
+	if !ok {
+		var names []string
+		for name := range c.choices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("should be %v", strings.Join(names, " or "))
+	}
+	c.value = x
+	set()
+	return nil
+}
+
+// newCommandFlags builds the flagset for a command from the full set
+func newCommandFlags(c *Command) (*flag.FlagSet, error) {
+
+	names := c.Flags
+	if names == nil { // all keeps the original pairs of flags rather than choices
+		flag.VisitAll(func(f *flag.Flag) {
+			if _, ok := f.Value.(*choiceFlag); !ok {
+				names = append(names, f.Name)
+			}
+		})
+	} else {
+		names = append(append([]string{}, commonFlags...), names...)
+	}
+	fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	for _, name := range names {
+		alias, orig, ok := strings.Cut(name, "=")
+		if !ok {
+			orig = alias
+		}
+		f := flag.Lookup(orig)
+		if f == nil {
+			return nil, fmt.Errorf("command %v refers to unknown flag %v", c.Name, orig)
+		}
+		usage := f.Usage
+		if h, ok := c.Help[alias]; ok {
+			usage = h
+		}
+		fs.Var(f.Value, alias, usage)
+	}
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "%v\n", apptitle)
+		if c.Name == "all" {
+			commandUsage()
+			return
+		}
+		fmt.Fprintf(w, "Usage: reglist %v -cfg rally [options]\n\n%v\n\n", c.Name, c.Desc)
+		fs.PrintDefaults()
+	}
+	return fs, nil
+}
+
+// commandArgs holds whatever follows the command's flags
+var commandArgs []string
+
+// parseCommandLine works out which command is wanted and parses its flags
+func parseCommandLine(args []string) error {
+
+	commandArgs = nil
+	name := "all"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	if name == "help" {
+		commandUsage()
+		return flag.ErrHelp
+	}
+	command = findCommand(name)
+	if command == nil {
+		commandUsage()
+		return failWith(ExitUsage, fmt.Errorf("unknown command %q", name))
+	}
+	fs, err := newCommandFlags(command)
+	if err != nil {
+		return failWith(ExitFailure, err)
+	}
+	if err := fs.Parse(args); err != nil {
+		return failWith(ExitUsage, err)
+	}
+	if *showusage {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	commandArgs = fs.Args()
+	return nil
+}
+
+// running reports whether the named command was given
+func running(name string) bool {
+	return command != nil && command.Name == name
+}
+
+var errNoInput = errors.New("no CSV input available, use -csv or set csvurl")
+
+// importInput loads the CSV from a file or the configured csvurl
+func importInput() error {
+
+	defer runReport.Time("import")()
+	var err error
+	if *csvName != "" {
+		err = loadCSVFile()
+	} else if cfg.CsvUrl != "" {
+		err = downloadCSVFile()
+	} else {
+		err = failWith(ExitInput, errNoInput)
+	}
+	if err != nil {
+		return err
+	}
+	return fixRiderNumbers()
+}
+
+// exportOutputs writes only the exports, the spreadsheet is built in a
+// scratch workbook that is never saved
+func exportOutputs() error {
+
+	defer runReport.Time("export")()
+	resetTotals()
+	xl = excelize.NewFile()
+	if err := openExports(); err != nil {
+		return err
+	}
+	err := mainloop(nil)
+	closeExports()
+	if err != nil {
+		return err
+	}
+	writePrintedOutputs()
+	slog.Info("Entrants exported", "count", tot.NumRiders)
+	return nil
+}
+
+// checkEntries runs the normal processing, reporting problems but writing
+// nothing. Any issue of error severity makes for a failure.
+func checkEntries() error {
+
+	defer runReport.Time("check")()
+	resetTotals()
+	xl = excelize.NewFile()
+	if err := mainloop(nil); err != nil {
+		return err
+	}
+	if tot.NumWithdrawn > 0 {
+		slog.Info("Entries withdrawn", "count", tot.NumWithdrawn)
+	}
+	slog.Info("Entrants checked", "count", tot.NumRiders)
+	if err := reportOutstanding(); err != nil {
+		return err
+	}
+	if _, err := reportDuplicates(); err != nil {
+		return err
+	}
+	reportDuplicatePlates()
+	if _, err := reportReconciliation(); err != nil {
+		return err
+	}
+	summariseIssues()
+	if n := countIssues(SeverityError); n > 0 {
+		return failWith(ExitIssues, fmt.Errorf("%v data issue(s) of error severity", n))
+	}
+	return nil
+}
+
+// diffInput compares the CSV with what's already in the database, leaving
+// the database untouched
+func diffInput() error {
+
+	was := snapshotEntries()
+	mem, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return failWith(ExitDatabase, err)
+	}
+	mem.SetMaxOpenConns(1) // Each connection would otherwise have its own database
+	defer mem.Close()
+
+	saved := db
+	db = mem
+	err = importInput()
+	now := snapshotEntries()
+	db = saved
+	if err != nil {
+		return err
+	}
+	changes := summariseChanges(was, now)
+	fmt.Printf("%v change(s)\n", len(changes))
+	for _, c := range changes {
+		fmt.Printf("    %v\n", c)
+	}
+	return nil
+}
+
+// lookupMembers reports the IBA membership details for each argument,
+// either a number or a "first last" name
+func lookupMembers(args []string) error {
+
+	if *noLookup {
+		return failWith(ExitDatabase, errors.New("no IBA member lookup is available"))
+	}
+	for _, a := range args {
+		a = strings.TrimSpace(a)
+		if intval(a) > 0 && strings.Trim(a, "0123456789") == "" {
+			var sname, email string
+			if lookupOnline {
+				sname, email = lookupIBAMemberWeb(a)
+			} else {
+				sname, email = lookupIBAMember(a)
+			}
+			if sname == "" {
+				fmt.Printf("IBA %v not found\n", a)
+			} else {
+				fmt.Printf("IBA %v is %v %v\n", a, sname, email)
+			}
+			continue
+		}
+		first, last, _ := strings.Cut(a, " ")
+		var iba, email string
+		if lookupOnline {
+			iba, email = lookupIBAWeb(first, last)
+		} else {
+			iba, email = lookupIBA(first, last)
+		}
+		if iba == "" || iba == "0" {
+			fmt.Printf("%v not found\n", a)
+		} else {
+			fmt.Printf("%v is IBA %v %v\n", a, iba, email)
+		}
+	}
+	return nil
+}
@@ -15,6 +15,8 @@ type Words struct {
 	DefaultRE    string   `yaml:"defaultre"`
 	LiveDBURL    string   `yaml:"livedburl"`
 	MaxPhone     int      `yaml:"maxphonechars"`
+	PostcodeCSV  string   `yaml:"postcoderegions"`
+	BikeFile     string   `yaml:"bikecatalogue"`
 }
 
 // NewWords returns the word lists
@@ -47,29 +49,75 @@ func NewWords() (*Words, error) {
 
 // Config holds the contents of the configuration file
 type Config struct {
-	Rally         string   `yaml:"name"`
-	Year          string   `yaml:"year"`
-	Afields       []string `yaml:"afields"`
-	Rfields       []string `yaml:"rfields"`
-	Tshirts       []string `yaml:"tshirtsizes"`
-	Tshirtcost    int      `yaml:"tshirtcost"`
-	Riderfee      int      `yaml:"riderfee"`
-	Pillionfee    int      `yaml:"pillionfee"`
-	Patchavail    bool     `yaml:"patchavail"`
-	Patchcost     int      `yaml:"patchcost"`
-	Sponsorship   bool     `yaml:"sponsorship"`
-	Fundsonday    string   `yaml:"fundsonday"`
-	Novice        string   `yaml:"novice"`
-	Add2entrantid int      `yaml:"add2entrantid"`
-	EntrantOrder  string   `yaml:"entrantorder"`
-	ReportWeekly  bool     `yaml:"weekly"`
-	RenumberCSV   bool     `yaml:"renumber"`
-	CsvUrl        string   `yaml:"csvurl"`
-	LegionMember  string   `yaml:"legionmember"`
-	LegionRider   string   `yaml:"legionrider"`
-	FreeCamping   string   `yaml:"freecamping"`
-	RBLRDB        string   `yaml:"rblrdb"`
-	PaymentStatus []string `yaml:"paymentstatus"`
+	Rally         string             `yaml:"name"`
+	Year          string             `yaml:"year"`
+	Afields       []string           `yaml:"afields"`
+	Rfields       []string           `yaml:"rfields"`
+	Tshirts       []string           `yaml:"tshirtsizes"`
+	Tshirtcost    Money              `yaml:"tshirtcost"`
+	Riderfee      Money              `yaml:"riderfee"`
+	Pillionfee    Money              `yaml:"pillionfee"`
+	Patchavail    bool               `yaml:"patchavail"`
+	Patchcost     Money              `yaml:"patchcost"`
+	Sponsorship   bool               `yaml:"sponsorship"`
+	Fundsonday    string             `yaml:"fundsonday"`
+	Novice        string             `yaml:"novice"`
+	Add2entrantid int                `yaml:"add2entrantid"`
+	EntrantOrder  string             `yaml:"entrantorder"`
+	ReportWeekly  bool               `yaml:"weekly"`
+	RenumberCSV   bool               `yaml:"renumber"`
+	CsvUrl        string             `yaml:"csvurl"`
+	LegionMember  string             `yaml:"legionmember"`
+	LegionRider   string             `yaml:"legionrider"`
+	FreeCamping   string             `yaml:"freecamping"`
+	RBLRDB        string             `yaml:"rblrdb"`
+	PaymentStatus []string           `yaml:"paymentstatus"`
+	Forms         FormLayout         `yaml:"forms"`
+	Certificate   *CertLayout        `yaml:"certificate"` // Nil if absent or empty
+	RBLRStatus    RBLRStatuses       `yaml:"rblrstatus"`
+	Labels        LabelSheet         `yaml:"labels"`
+	Rules         []Rule             `yaml:"rules"`
+	NotDuplicates [][]int            `yaml:"notduplicates"` // Pairs of entrants known to be different people
+	Currency      string             `yaml:"currency"`
+	Rates         map[string]float64 `yaml:"rates"`    // Value of one unit of each currency in Currency
+	Merchant      string             `yaml:"merchant"` // Who the transactions given by -paypal come from
+	Pricing       []PriceRule        `yaml:"pricing"`
+	Cancellation  Policy             `yaml:"cancellation"`
+}
+
+// LabelSheet describes a sheet of sticky labels, all measurements in mm
+type LabelSheet struct {
+	Paper   string  `yaml:"paper"`
+	Columns int     `yaml:"columns"`
+	Rows    int     `yaml:"rows"`
+	Width   float64 `yaml:"width"`
+	Height  float64 `yaml:"height"`
+	Left    float64 `yaml:"left"`
+	Top     float64 `yaml:"top"`
+	HPitch  float64 `yaml:"hpitch"`
+	VPitch  float64 `yaml:"vpitch"`
+}
+
+// CertLayout describes the finisher certificate. Each line is a Go template
+// with access to the fields of CertDetails.
+type CertLayout struct {
+	Title      string   `yaml:"title"`
+	Paper      string   `yaml:"paper"`
+	Landscape  bool     `yaml:"landscape"`
+	Lines      []string `yaml:"lines"`
+	Signatory  string   `yaml:"signatory"`
+	Background string   `yaml:"background"`
+	Finishers  []int    `yaml:"finisherstatus"`
+}
+
+// FormLayout describes the registration/disclaimer form printed for each entrant
+type FormLayout struct {
+	Title      string   `yaml:"title"`
+	Paper      string   `yaml:"paper"`
+	FontSize   float64  `yaml:"fontsize"`
+	Fields     []string `yaml:"fields"`
+	Disclaimer []string `yaml:"disclaimer"`
+	Signatures []string `yaml:"signatures"`
 }
 
 // NewConfig returns a new decoded Config struct
@@ -79,6 +127,9 @@ func NewConfig(configPath string) (*Config, error) {
 	config.Rally = "test"
 	config.Novice = "novice"
 	config.EntrantOrder = "upper(trim(RiderLast)),upper(trim(RiderName))"
+	config.Currency = "GBP"
+	config.Merchant = "PayPal"
+	config.RBLRStatus = defaultRBLRStatuses
 
 	// Open config file
 	file, err := os.Open(configPath)
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ContactExporter writes entrant contact details in a form suitable
+// for importing into an address book. Each entrant becomes one contact,
+// labelled with the rally+year group so they can be found again later.
+type ContactExporter interface {
+	Name() string
+	WriteHeader() error
+	WriteContact(e Entrant) error
+	Flush() error
+}
+
+// contactGroup is the label applied to every contact exported
+func contactGroup() string {
+	return cfg.Rally + cfg.Year
+}
+
+// nokSummary describes the emergency contact in a single line, used where
+// the target format has no proper place for a related contact
+func nokSummary(e Entrant) string {
+
+	if e.NokName == "" && e.NokPhone == "" {
+		return ""
+	}
+	res := "Emergency contact: " + e.NokName
+	if e.NokRelation != "" {
+		res += " (" + e.NokRelation + ")"
+	}
+	if e.NokPhone != "" {
+		res += " " + e.NokPhone
+	}
+	return strings.TrimSpace(res)
+}
+
+// contactAddress returns the entrant's postal address as a single string
+func contactAddress(e Entrant) string {
+
+	var res []string
+	for _, x := range []string{e.Address1, e.Address2, e.Town, e.County, e.Postcode, e.Country} {
+		if strings.TrimSpace(x) != "" {
+			res = append(res, strings.TrimSpace(x))
+		}
+	}
+	return strings.Join(res, ", ")
+}
+
+// csvContacts holds the machinery shared by the CSV based exporters. Each
+// column is named and filled by name so that the many columns we don't use
+// don't need to be counted out.
+type csvContacts struct {
+	w    *csv.Writer
+	hdrs []string
+}
+
+func (c *csvContacts) WriteHeader() error {
+	return c.w.Write(c.hdrs)
+}
+
+func (c *csvContacts) writeRow(vals map[string]string) error {
+
+	res := make([]string, len(c.hdrs))
+	for i, h := range c.hdrs {
+		res[i] = vals[h]
+	}
+	return c.w.Write(res)
+}
+
+func (c *csvContacts) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// GmailContacts produces a CSV in the layout accepted by Google Contacts
+type GmailContacts struct {
+	csvContacts
+	IncludeNok bool
+}
+
+func NewGmailContacts(w io.Writer, includeNok bool) *GmailContacts {
+
+	hdrs := []string{"Name", "Given Name", "Additional Name", "Family Name",
+		"Name Prefix", "Name Suffix", "Nickname", "Notes", "Group Membership",
+		"E-mail 1 - Type", "E-mail 1 - Value",
+		"Phone 1 - Type", "Phone 1 - Value",
+		"Phone 2 - Type", "Phone 2 - Value",
+		"Address 1 - Type", "Address 1 - Formatted", "Address 1 - Street", "Address 1 - Extended Address",
+		"Address 1 - City", "Address 1 - Region", "Address 1 - Postal Code", "Address 1 - Country",
+		"Relation 1 - Type", "Relation 1 - Value"}
+
+	return &GmailContacts{csvContacts{csv.NewWriter(w), hdrs}, includeNok}
+}
+
+func (g *GmailContacts) Name() string { return "Gmail" }
+
+func (g *GmailContacts) WriteContact(e Entrant) error {
+
+	vals := map[string]string{
+		"Name":                         e.RiderFirst + " " + e.RiderLast,
+		"Given Name":                   e.RiderFirst,
+		"Family Name":                  e.RiderLast,
+		"Group Membership":             contactGroup() + " ::: * myContacts",
+		"E-mail 1 - Type":              "* Home",
+		"E-mail 1 - Value":             e.Email,
+		"Phone 1 - Type":               "Mobile",
+		"Phone 1 - Value":              e.phoneNumber.Value(),
+		"Address 1 - Type":             "Home",
+		"Address 1 - Formatted":        contactAddress(e),
+		"Address 1 - Street":           e.Address1,
+		"Address 1 - Extended Address": e.Address2,
+		"Address 1 - City":             e.Town,
+		"Address 1 - Region":           e.County,
+		"Address 1 - Postal Code":      e.Postcode,
+		"Address 1 - Country":          e.Country,
+	}
+	if g.IncludeNok && (e.NokName != "" || e.NokPhone != "") {
+		vals["Relation 1 - Type"] = e.NokRelation
+		vals["Relation 1 - Value"] = e.NokName
+		if e.NokPhone != "" {
+			vals["Phone 2 - Type"] = "Emergency"
+			vals["Phone 2 - Value"] = e.nokPhoneNumber.Value()
+		}
+		vals["Notes"] = nokSummary(e)
+	}
+	return g.writeRow(vals)
+}
+
+// OutlookContacts produces a CSV in the layout accepted by Microsoft Outlook
+type OutlookContacts struct {
+	csvContacts
+	IncludeNok bool
+}
+
+func NewOutlookContacts(w io.Writer, includeNok bool) *OutlookContacts {
+
+	hdrs := []string{"First Name", "Middle Name", "Last Name", "Title", "Suffix",
+		"E-mail Address", "E-mail Display Name", "Mobile Phone", "Other Phone",
+		"Home Street", "Home Street 2", "Home City", "Home State", "Home Postal Code", "Home Country/Region",
+		"Categories", "Notes"}
+
+	return &OutlookContacts{csvContacts{csv.NewWriter(w), hdrs}, includeNok}
+}
+
+func (o *OutlookContacts) Name() string { return "Outlook" }
+
+func (o *OutlookContacts) WriteContact(e Entrant) error {
+
+	vals := map[string]string{
+		"First Name":          e.RiderFirst,
+		"Last Name":           e.RiderLast,
+		"E-mail Address":      e.Email,
+		"E-mail Display Name": e.RiderFirst + " " + e.RiderLast + " (" + e.Email + ")",
+		"Mobile Phone":        e.phoneNumber.Value(),
+		"Home Street":         e.Address1,
+		"Home Street 2":       e.Address2,
+		"Home City":           e.Town,
+		"Home State":          e.County,
+		"Home Postal Code":    e.Postcode,
+		"Home Country/Region": e.Country,
+		"Categories":          contactGroup(),
+	}
+	if e.Email == "" {
+		vals["E-mail Display Name"] = ""
+	}
+	if o.IncludeNok {
+		vals["Other Phone"] = e.nokPhoneNumber.Value()
+		vals["Notes"] = nokSummary(e)
+	}
+	return o.writeRow(vals)
+}
+
+// VCardContacts produces a stream of vCard 4.0 (RFC 6350) records
+type VCardContacts struct {
+	w          *bufio.Writer
+	IncludeNok bool
+}
+
+func NewVCardContacts(w io.Writer, includeNok bool) *VCardContacts {
+	return &VCardContacts{bufio.NewWriter(w), includeNok}
+}
+
+func (v *VCardContacts) Name() string { return "vCard" }
+
+// WriteHeader does nothing, vCards don't have headers
+func (v *VCardContacts) WriteHeader() error {
+	return nil
+}
+
+func (v *VCardContacts) WriteContact(e Entrant) error {
+
+	lines := []string{"BEGIN:VCARD", "VERSION:4.0"}
+	lines = append(lines, "FN:"+vcardEscape(e.RiderFirst+" "+e.RiderLast))
+	lines = append(lines, "N:"+vcardEscape(e.RiderLast)+";"+vcardEscape(e.RiderFirst)+";;;")
+	if e.Email != "" {
+		lines = append(lines, "EMAIL;TYPE=home:"+vcardEscape(e.Email))
+	}
+	if e.Phone != "" {
+		lines = append(lines, "TEL;VALUE=uri;TYPE=\"cell,voice\":tel:"+strings.ReplaceAll(e.phoneNumber.Value(), " ", ""))
+	}
+	if contactAddress(e) != "" {
+		adr := []string{"", vcardEscape(e.Address2), vcardEscape(e.Address1), vcardEscape(e.Town),
+			vcardEscape(e.County), vcardEscape(e.Postcode), vcardEscape(e.Country)}
+		lines = append(lines, "ADR;TYPE=home:"+strings.Join(adr, ";"))
+	}
+	lines = append(lines, "CATEGORIES:"+vcardEscape(contactGroup()))
+	if v.IncludeNok && nokSummary(e) != "" {
+		lines = append(lines, "RELATED;TYPE=contact;VALUE=text:"+vcardEscape(nokSummary(e)))
+	}
+	lines = append(lines, "END:VCARD")
+
+	for _, ln := range lines {
+		if _, err := v.w.WriteString(vcardFold(ln) + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *VCardContacts) Flush() error {
+	return v.w.Flush()
+}
+
+// vcardEscape escapes the characters given special meaning in vCard values
+func vcardEscape(x string) string {
+
+	r := strings.NewReplacer(`\`, `\\`, `,`, `\,`, `;`, `\;`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(strings.TrimSpace(x))
+}
+
+// vcardFold splits long lines as required by RFC 6350, taking care
+// not to split a multibyte character
+func vcardFold(x string) string {
+
+	const maxline = 75
+	if len(x) <= maxline {
+		return x
+	}
+	var res strings.Builder
+	n := 0
+	for _, r := range x {
+		rl := len(string(r))
+		if n+rl > maxline {
+			res.WriteString("\r\n ")
+			n = 1
+		}
+		res.WriteRune(r)
+		n += rl
+	}
+	return res.String()
+}
+
+// newContactExporter returns an exporter of the requested kind writing to w
+func newContactExporter(kind string, w io.Writer, includeNok bool) (ContactExporter, error) {
+
+	switch strings.ToLower(kind) {
+	case "gmail":
+		return NewGmailContacts(w, includeNok), nil
+	case "outlook":
+		return NewOutlookContacts(w, includeNok), nil
+	case "vcard":
+		return NewVCardContacts(w, includeNok), nil
+	}
+	return nil, fmt.Errorf("unknown contacts format %v", kind)
+}
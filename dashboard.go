@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The dashboard serves the figures shown on the Stats tab, read only, so
+// that organisers can see them without passing spreadsheets around.
+
+// NamedCount is a single labelled figure
+type NamedCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// DashboardStats holds the same figures as calculated for the Stats tab
+type DashboardStats struct {
+	Rally         string       `json:"rally"`
+	Year          string       `json:"year"`
+	Generated     time.Time    `json:"generated"`
+	Riders        int          `json:"riders"`
+	Pillions      int          `json:"pillions"`
+	Novices       int          `json:"novices"`
+	NoviceLabel   string       `json:"novicelabel"`
+	IBAMembers    int          `json:"ibamembers"`
+	LegionMembers int          `json:"legionmembers,omitempty"`
+	LegionRiders  int          `json:"legionriders,omitempty"`
+	Camping       int          `json:"camping,omitempty"`
+	Withdrawn     int          `json:"withdrawn"`
+	Patches       int          `json:"patches,omitempty"`
+	Routes        []NamedCount `json:"routes,omitempty"`
+	Tshirts       []NamedCount `json:"tshirts,omitempty"`
+	Bikes         []NamedCount `json:"bikes"`
+	Signups       []NamedCount `json:"signups"`
+	SignupPeriod  string       `json:"signupperiod"`
+}
+
+// resetTotals clears all the running totals ready for a fresh pass of mainloop
+func resetTotals() {
+
+	// 6 is the number of RBLR routes - should be more generalised class taken from config, slapped wrist
+	tot = NewTotals(6, max_tshirt_sizes, 0)
+	totTShirts = [max_tshirt_sizes]int{0}
+	for i := range rblr_routes_ridden {
+		rblr_routes_ridden[i] = 0
+	}
+	entrantList = nil
+	runReport.StartPass()
+}
+
+var statsMutex sync.Mutex
+
+// collectStats runs the normal processing against the database, without
+// producing any output files, and returns the resulting figures
+func collectStats() (DashboardStats, error) {
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	// The entrants' warnings are for whoever builds the spreadsheet, not
+	// worth repeating on every refresh or adding to this run's report
+	saved := runReport
+	runReport = NewRunReport()
+	runReport.silent = true
+	defer func() { runReport = saved }()
+
+	resetTotals()
+	xl = excelize.NewFile() // Scratch book, never saved
+	if err := mainloop(nil); err != nil {
+		return DashboardStats{}, err
+	}
+	reportEntriesByPeriod()
+
+	s := DashboardStats{Rally: cfg.Rally, Year: cfg.Year, Generated: time.Now()}
+	s.Riders = tot.NumRiders
+	s.Pillions = tot.NumPillions
+	s.Novices = tot.NumNovices
+	s.NoviceLabel = cfg.Novice
+	s.IBAMembers = tot.NumIBAMembers
+	s.Withdrawn = tot.NumWithdrawn
+	s.Patches = tot.NumPatches
+	if cfg.Rally == "rblr" {
+		s.LegionMembers = tot.NumRBLBranch + tot.NumRBLRiders
+		s.LegionRiders = tot.NumRBLRiders
+		s.Camping = tot.NumCamping
+		for i, n := range rblr_routes_ridden {
+			s.Routes = append(s.Routes, NamedCount{strings.TrimSpace(rblr_routes[i]), n})
+		}
+	}
+	for i := 0; i < num_tshirt_sizes; i++ {
+		s.Tshirts = append(s.Tshirts, NamedCount{cfg.Tshirts[i], totTShirts[i]})
+	}
+	for _, b := range tot.Bikes {
+		if b.Num > 0 {
+			s.Bikes = append(s.Bikes, NamedCount{b.Make, b.Num})
+		}
+	}
+	s.SignupPeriod = "month"
+	if cfg.ReportWeekly {
+		s.SignupPeriod = "week"
+	}
+	for _, p := range tot.EntriesByPeriod { // Already sorted, latest first
+		s.Signups = append(s.Signups, NamedCount{strings.TrimSpace(periodLabel(p.Month)), p.Total})
+	}
+	return s, nil
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>{{.Rally}} {{.Year}} stats</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; } td, th { padding: .2em .8em; border-bottom: 1px solid #ccc; }
+td.n { text-align: right; }
+</style></head><body>
+<h1>{{.Rally}} {{.Year}}</h1>
+<p>As at {{.Generated.Format "Mon 2 Jan 2006 15:04"}} &middot; <a href="/stats.json">JSON</a></p>
+<table>
+<tr><td>Number of riders</td><td class="n">{{.Riders}}</td></tr>
+<tr><td>Number of pillions</td><td class="n">{{.Pillions}}</td></tr>
+<tr><td>Number of {{.NoviceLabel}}s</td><td class="n">{{.Novices}}</td></tr>
+<tr><td>Number of IBA members</td><td class="n">{{.IBAMembers}}</td></tr>
+{{if .Routes}}<tr><td>Number of Legion members</td><td class="n">{{.LegionMembers}}</td></tr>
+<tr><td>of which, RBL Riders</td><td class="n">{{.LegionRiders}}</td></tr>
+<tr><td>Camping at Squires</td><td class="n">{{.Camping}}</td></tr>{{end}}
+{{if .Patches}}<tr><td>Patches</td><td class="n">{{.Patches}}</td></tr>{{end}}
+<tr><td>Withdrawn</td><td class="n">{{.Withdrawn}}</td></tr>
+</table>
+{{if .Routes}}<h2>Routes</h2><table>{{range .Routes}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>{{end}}
+{{if .Tshirts}}<h2>T-shirts</h2><table>{{range .Tshirts}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>{{end}}
+<h2>Signups by {{.SignupPeriod}}</h2><table>{{range .Signups}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+<h2>Bikes</h2><table>{{range .Bikes}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td></tr>{{end}}</table>
+</body></html>
+`))
+
+// dashboard serves the stats, recalculated either on every request or
+// when the last calculation is older than refresh
+type dashboard struct {
+	refresh time.Duration
+	mu      sync.Mutex
+	stats   DashboardStats
+}
+
+// dashboardView is what the page shows
+type dashboardView struct {
+	DashboardStats
+	Refresh int // Seconds before the page reloads itself
+}
+
+// pageRefresh is how often the page reloads: as often as the figures are
+// recalculated, or every minute if that's on every request
+func (d *dashboard) pageRefresh() int {
+
+	if d.refresh <= 0 {
+		return 60
+	}
+	return max(1, int(math.Ceil(d.refresh.Seconds())))
+}
+
+func (d *dashboard) current() (DashboardStats, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refresh <= 0 || time.Since(d.stats.Generated) > d.refresh {
+		s, err := collectStats()
+		if err != nil {
+			return d.stats, err
+		}
+		d.stats = s
+	}
+	return d.stats, nil
+}
+
+func (d *dashboard) handleHTML(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	stats, err := d.current()
+	if err != nil {
+		slog.Error("Dashboard stats", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, dashboardView{stats, d.pageRefresh()}); err != nil {
+		slog.Error("Dashboard page", "err", err)
+	}
+}
+
+func (d *dashboard) handleJSON(w http.ResponseWriter, r *http.Request) {
+
+	stats, err := d.current()
+	if err != nil {
+		slog.Error("Dashboard stats", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		slog.Error("Dashboard JSON", "err", err)
+	}
+}
+
+// runDashboard starts the read-only stats server and only returns on failure
+func runDashboard(addr string, refresh time.Duration) error {
+
+	d := &dashboard{refresh: refresh}
+
+	slog.Info("Stats dashboard listening", "addr", addr)
+	return http.ListenAndServe(addr, d.routes())
+}
+
+// routes maps the dashboard's pages to their handlers
+func (d *dashboard) routes() *http.ServeMux {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.handleHTML)
+	mux.HandleFunc("/stats.json", d.handleJSON)
+	return mux
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// People enter twice, often months apart, and not always in the same way.
+// Every pair of entrants who haven't withdrawn is compared by name, email,
+// mobile and bike registration, and riders are looked for amongst the
+// pillions. Pairs known to be genuinely different people, such as a couple
+// sharing an email address, are listed as notduplicates in the
+// configuration and left alone.
+
+// DuplicatePair is two entrants who may be the same person
+type DuplicatePair struct {
+	A, B    Entrant
+	Reasons []string
+	Exact   bool // Same rider name, reglist's original test
+}
+
+// nicknames gives the formal first names that people shorten differently,
+// each group keyed by the formal name
+var nicknames = map[string][]string{
+	"robert": {"bob", "rob", "bobby", "robbie"}, "william": {"bill", "will", "billy", "willy"},
+	"richard": {"dick", "rick", "rich", "richie"}, "james": {"jim", "jimmy", "jamie"},
+	"michael": {"mike", "mick", "mickey"}, "david": {"dave", "davy"}, "stephen": {"steve", "stevie"},
+	"steven": {"steve", "stevie"}, "anthony": {"tony"}, "edward": {"ed", "eddie", "ted", "ned"},
+	"thomas": {"tom", "tommy"}, "john": {"jack", "johnny", "jon"}, "jonathan": {"jon", "jonny"},
+	"elizabeth": {"liz", "beth", "betty", "lizzie"}, "margaret": {"maggie", "peggy", "meg"},
+	"katherine": {"kate", "kath", "kathy", "katie"}, "catherine": {"kate", "cath", "cathy", "katie"},
+	"charles": {"charlie", "chas", "chuck"}, "henry": {"harry", "hal"}, "geoffrey": {"geoff", "jeff"},
+	"susan": {"sue", "suzy"}, "alexander": {"alex", "sandy"}, "peter": {"pete"},
+	"christopher": {"chris", "kit"}, "andrew": {"andy", "drew"}, "nicholas": {"nick", "nicky"},
+	"samuel": {"sam", "sammy"}, "benjamin": {"ben", "benny"}, "daniel": {"dan", "danny"},
+	"matthew": {"matt"}, "philip": {"phil"}, "kenneth": {"ken", "kenny"}, "ronald": {"ron", "ronnie"},
+	"donald": {"don", "donnie"}, "jennifer": {"jen", "jenny"}, "patricia": {"pat", "patsy", "trish"},
+}
+
+// sameFirstName says whether two squashed first names could be the same
+// person's: the same allowing a typo, one the start of the other or both
+// forms of the same name
+func sameFirstName(a, b string) bool {
+
+	short, long := a, b
+	if len(short) > len(long) {
+		short, long = long, short
+	}
+	if (len(short) >= 3 && strings.HasPrefix(long, short)) || editDistance(a, b) <= 1 {
+		return true
+	}
+	for formal, nicks := range nicknames {
+		if (a == formal || slices.Contains(nicks, a)) && (b == formal || slices.Contains(nicks, b)) {
+			return true
+		}
+	}
+	return false
+}
+
+// squashName reduces a name to lower case letters only
+func squashName(first, last string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, first+last)
+}
+
+// editDistance is the number of single character changes turning a into b
+func editDistance(a, b string) int {
+
+	x, y := []rune(a), []rune(b)
+	prev := make([]int, len(y)+1)
+	cur := make([]int, len(y)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		cur[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(y)]
+}
+
+// similarNames says whether two people's names are the same allowing for
+// typing, spacing and punctuation, and shortened first names: Bob Smith is
+// Robert Smith, Bob Smyth is Bob Smith.
+func similarNames(first1, last1, first2, last2 string) bool {
+
+	f1, l1 := squashName(first1, ""), squashName(last1, "")
+	f2, l2 := squashName(first2, ""), squashName(last2, "")
+	if f1 == "" || l1 == "" || f2 == "" || l2 == "" {
+		return false
+	}
+	if f1+l1 == f2+l2 {
+		return true
+	}
+	if l1 == l2 {
+		return sameFirstName(f1, f2)
+	}
+	return f1 == f2 && editDistance(l1, l2) <= 1
+}
+
+// findDuplicates compares every pair of entrants, ignoring accepted pairs
+func findDuplicates(entrants []Entrant, accepted [][]int) []DuplicatePair {
+
+	ok := make(map[[2]int]bool)
+	for _, p := range accepted {
+		ok[[2]int{p[0], p[1]}] = true
+		ok[[2]int{p[1], p[0]}] = true
+	}
+
+	keys := make([]string, len(entrants)) // Registrations not known yet, TBC and the like, match nothing
+	for i, e := range entrants {
+		if plate := ParsePlate(e.BikeReg, e.Country); !plate.Pending {
+			keys[i] = plate.Key()
+		}
+	}
+
+	var res []DuplicatePair
+	for i := range entrants {
+		for j := i + 1; j < len(entrants); j++ {
+			a, b := entrants[i], entrants[j]
+			if ok[[2]int{intval(a.Entrantid), intval(b.Entrantid)}] {
+				continue
+			}
+			p := DuplicatePair{A: a, B: b}
+			if squashName(a.RiderFirst, a.RiderLast) == squashName(b.RiderFirst, b.RiderLast) {
+				p.Exact = true
+				p.Reasons = append(p.Reasons, "same name")
+			} else if similarNames(a.RiderFirst, a.RiderLast, b.RiderFirst, b.RiderLast) {
+				p.Reasons = append(p.Reasons, "similar names")
+			}
+			if a.Email != "" && strings.EqualFold(strings.TrimSpace(a.Email), strings.TrimSpace(b.Email)) {
+				p.Reasons = append(p.Reasons, "same email")
+			}
+			if a.Phone != "" && a.Phone == b.Phone {
+				p.Reasons = append(p.Reasons, "same mobile")
+			}
+			if keys[i] != "" && keys[i] == keys[j] {
+				p.Reasons = append(p.Reasons, "same registration")
+			}
+			if similarNames(a.RiderFirst, a.RiderLast, b.PillionFirst, b.PillionLast) {
+				p.Reasons = append(p.Reasons, a.RiderFirst+" "+a.RiderLast+" is also pillion to "+b.Entrantid)
+			}
+			if similarNames(b.RiderFirst, b.RiderLast, a.PillionFirst, a.PillionLast) {
+				p.Reasons = append(p.Reasons, b.RiderFirst+" "+b.RiderLast+" is also pillion to "+a.Entrantid)
+			}
+			if len(p.Reasons) > 0 {
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+// duplicateCandidates loads everyone who hasn't withdrawn, whether or not
+// they're included in the spreadsheet, as an unpaid second entry is the
+// usual kind of duplicate
+func duplicateCandidates() ([]Entrant, error) {
+
+	rows, err := db.Query(`SELECT FinalRiderNumber,ifnull(RiderName,''),ifnull(RiderLast,''),ifnull(PillionName,''),ifnull(PillionLast,''),
+ifnull(Email,''),ifnull(Mobilephone,''),ifnull(Registration,''),ifnull(Country,'') FROM entrants WHERE Withdrawn IS NULL ORDER BY FinalRiderNumber`)
+	if err != nil {
+		return nil, failWith(ExitDatabase, err)
+	}
+	defer rows.Close()
+	var res []Entrant
+	for rows.Next() {
+		var e Entrant
+		var mobile string
+		if err := rows.Scan(&e.Entrantid, &e.RiderFirst, &e.RiderLast, &e.PillionFirst, &e.PillionLast, &e.Email, &mobile, &e.BikeReg, &e.Country); err != nil {
+			return nil, failWith(ExitDatabase, err)
+		}
+		e.RiderFirst, e.RiderLast = properName(e.RiderFirst), properName(e.RiderLast)
+		if e.PillionFirst != "" && e.PillionLast == "" {
+			e.PillionLast = e.RiderLast
+		}
+		e.Phone = ParsePhone(mobile, e.Country).Value()
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// reportDuplicates warns of riders who may have entered more than once
+func reportDuplicates() ([]DuplicatePair, error) {
+
+	entrants, err := duplicateCandidates()
+	if err != nil {
+		return nil, err
+	}
+	pairs := findDuplicates(entrants, cfg.NotDuplicates)
+	for _, p := range pairs {
+		code := "possible-duplicate"
+		if p.Exact {
+			code = "duplicate-rider"
+		}
+		warnEntrant(code, p.B.Entrantid, "RiderName", "%v %v (%v) may also be %v %v (%v): %v",
+			p.B.RiderFirst, p.B.RiderLast, p.B.Entrantid, p.A.RiderFirst, p.A.RiderLast, p.A.Entrantid, strings.Join(p.Reasons, ", "))
+	}
+	return pairs, nil
+}
+
+// writeDuplicatesSheet lists the possible duplicates, with the reasons, on
+// their own tab
+func writeDuplicatesSheet(pairs []DuplicatePair) {
+
+	if len(pairs) == 0 {
+		return
+	}
+	xl.NewSheet(dupesheet)
+	formatSheet(dupesheet, false)
+	xl.SetCellStyle(dupesheet, "A1", "E1", styleH2)
+	xl.SetRowHeight(dupesheet, 1, 30)
+	xl.SetCellValue(dupesheet, "A1", "Entrant")
+	xl.SetCellValue(dupesheet, "B1", "Rider")
+	xl.SetCellValue(dupesheet, "C1", "Entrant")
+	xl.SetCellValue(dupesheet, "D1", "Rider")
+	xl.SetCellValue(dupesheet, "E1", "Why")
+	xl.SetColWidth(dupesheet, "A", "A", 10)
+	xl.SetColWidth(dupesheet, "B", "B", 24)
+	xl.SetColWidth(dupesheet, "C", "C", 10)
+	xl.SetColWidth(dupesheet, "D", "D", 24)
+	xl.SetColWidth(dupesheet, "E", "E", 60)
+
+	for i, p := range pairs {
+		row := strconv.Itoa(i + 2)
+		xl.SetCellInt(dupesheet, "A"+row, intval(p.A.Entrantid))
+		xl.SetCellValue(dupesheet, "B"+row, p.A.RiderFirst+" "+p.A.RiderLast)
+		xl.SetCellInt(dupesheet, "C"+row, intval(p.B.Entrantid))
+		xl.SetCellValue(dupesheet, "D"+row, p.B.RiderFirst+" "+p.B.RiderLast)
+		xl.SetCellValue(dupesheet, "E"+row, strings.Join(p.Reasons, ", "))
+		xl.SetCellStyle(dupesheet, "A"+row, "E"+row, styleV2L)
+	}
+	setPagePane(dupesheet)
+}
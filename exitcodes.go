@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+)
+
+// Exit codes, so that reglist can be scripted
+const (
+	ExitOK       = 0
+	ExitFailure  = 1 // Anything not covered below
+	ExitUsage    = 2 // Bad commandline
+	ExitConfig   = 3 // Configuration files missing or invalid
+	ExitDatabase = 4 // SQLite, RBLR or rides database problem
+	ExitInput    = 5 // CSV missing, unreadable or can't be downloaded
+	ExitOutput   = 6 // Spreadsheet, export or PDF can't be written
+	ExitServer   = 7 // Web server stopped
+	ExitIssues   = 8 // check found data issues of error severity
+)
+
+// ExitError is a failure carrying the exit code it should produce
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// failWith gives err, if any, the exit code unless it already has one
+func failWith(code int, err error) error {
+
+	if err == nil {
+		return nil
+	}
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return err
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+// exitCode reports err, if any, and returns the exit code it calls for
+func exitCode(err error) int {
+
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	code := ExitFailure
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		code = ee.Code
+	}
+	slog.Error(err.Error(), "exitcode", code)
+	return code
+}
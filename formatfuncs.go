@@ -22,13 +22,14 @@ func bNoviceYN(x string, iba string) string {
 	return res
 }
 
+var makeModelRE = regexp.MustCompile(`'*\d*\s*([A-Za-z\-\_]*)\s*(.*)`)
+
 func extractMakeModel(bike string) (string, string) {
 
 	if strings.TrimSpace(bike) == "" {
 		return "", ""
 	}
-	re := regexp.MustCompile(`'*\d*\s*([A-Za-z\-\_]*)\s*(.*)`)
-	sm := re.FindSubmatch([]byte(bike))
+	sm := makeModelRE.FindSubmatch([]byte(bike))
 	if len(sm) < 3 {
 		return strings.ReplaceAll(string(sm[1]), "_", " "), ""
 	}
@@ -84,74 +85,18 @@ func fmtRBL(x string) string {
 // properBike attempts to properly capitalise the various parts of a
 // bike description. Mostly but not always that means uppercasing it.
 func properBike(x string) string {
-
-	var specials = words.Bikewords
-	for _, e := range specials {
-		re := regexp.MustCompile(`(?i)(.*)\b(` + e + `)\b(.*)`) // a word on its own
-		if re.MatchString(x) {
-			res := re.FindStringSubmatch(x)
-			x = res[1] + e + res[3]
-		} else {
-			re := regexp.MustCompile(`(?i)(.*)(0` + e + `)\b(.*)`) // or right after an engine size
-			if re.MatchString(x) {
-				res := re.FindStringSubmatch(x)
-				x = res[1] + "0" + e + res[3]
-			}
-		}
-	}
-	return x
+	return textNormaliser().ProperBike(x)
 }
 
 // properMake2 fixes two word Makes such as 'Royal Enfield' and 'Moto Guzzi'
 // by replacing the intervening space with an underscore, replaced later in
 // processing
 func properMake2(x string) string {
-
-	var specials = words.Bikewords
-	var xwords = strings.Fields(x)
-
-	if len(xwords) < 2 {
-		return x
-	}
-	var make2 = strings.Join(xwords[0:2], " ")
-	var model2 = strings.Join(xwords[2:], " ")
-
-	for _, e := range specials {
-		if strings.EqualFold(strings.Replace(e, "-", " ", 1), make2) {
-			var res strings.Builder
-			res.WriteString(strings.Replace(e, " ", "_", 1))
-			res.WriteString(" ")
-			res.WriteString(model2)
-			return res.String()
-		}
-	}
-	return x
+	return textNormaliser().ProperMake2(x)
 }
 
 func properName(x string) string {
-
-	var specials = words.Specialnames
-	var xx = strings.TrimSpace(x)
-	if strings.ToUpper(xx) == xx || strings.ToLower(xx) == xx {
-		// Now need to special names like McCrea, McCreanor, etc
-		// This might be one word or more than one so
-		w := strings.Split(xx, " ")
-		for i := 0; i < len(w); i++ {
-			var wx = w[i]
-			if words.Propernames {
-				wx = strings.ToLower(w[i])
-				w[i] = stringsTitle(wx)
-			}
-			for _, wy := range specials {
-				if strings.EqualFold(wx, wy) {
-					w[i] = wy
-				}
-			}
-		}
-		return strings.Join(w, " ")
-	}
-	return xx
-
+	return textNormaliser().ProperName(x)
 }
 
 func ShortMaker(x string) string {
@@ -169,20 +114,3 @@ func stringsTitle(x string) string {
 	return caser.String(x)
 
 }
-
-func trimPhone(tel string) string {
-
-	var res string
-
-	telx := strings.ReplaceAll(tel, " ", "")
-	if telx[0:2] == "00" {
-		telx = strings.Replace(telx, "00", "+", 1)
-	}
-
-	if len(telx) > words.MaxPhone && words.MaxPhone > 0 {
-		res = telx[:words.MaxPhone]
-	} else {
-		res = telx
-	}
-	return res
-}
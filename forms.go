@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// formField is one labelled item of entrant data that may appear on a
+// registration/disclaimer form. Layouts refer to these by name.
+type formField struct {
+	Label string
+	Value func(e Entrant) string
+}
+
+var formFields = map[string]formField{
+	"entrant":     {"Entrant number", func(e Entrant) string { return e.Entrantid }},
+	"rider":       {"Rider", func(e Entrant) string { return strings.TrimSpace(e.RiderFirst + " " + e.RiderLast) }},
+	"rideriba":    {"Rider IBA #", func(e Entrant) string { return e.RiderIBA }},
+	"ridernovice": {"Novice", func(e Entrant) string { return fmtNoviceYb(e.RiderNovice) }},
+	"pillion":     {"Pillion", func(e Entrant) string { return strings.TrimSpace(e.PillionFirst + " " + e.PillionLast) }},
+	"pillioniba":  {"Pillion IBA #", func(e Entrant) string { return e.PillionIBA }},
+	"email":       {"Email", func(e Entrant) string { return e.Email }},
+	"phone":       {"Mobile", func(e Entrant) string { return e.Phone }},
+	"address":     {"Address", contactAddress},
+	"bike":        {"Bike", func(e Entrant) string { return strings.TrimSpace(e.Bike) }},
+	"bikereg":     {"Registration", func(e Entrant) string { return e.BikeReg }},
+	"odo":         {"Odometer counts", fmtOdoWords},
+	"nokname":     {"Emergency contact", func(e Entrant) string { return e.NokName }},
+	"nokrelation": {"Relationship", func(e Entrant) string { return e.NokRelation }},
+	"nokphone":    {"Contact number", func(e Entrant) string { return e.NokPhone }},
+	"route":       {"Route/class", func(e Entrant) string { return e.RouteClass }},
+	"tshirts":     {"T-shirts", fmtTshirts},
+	"patches":     {"Patches", func(e Entrant) string { return e.Patches }},
+}
+
+var defaultFormFields = []string{"entrant", "rider", "rideriba", "pillion", "pillioniba", "phone", "email", "address",
+	"bike", "bikereg", "odo", "nokname", "nokrelation", "nokphone", "route", "tshirts", "patches"}
+
+var defaultDisclaimer = []string{
+	"I confirm that the details above are correct and that my motorcycle is roadworthy, taxed, insured and has a current MOT where required.",
+	"I take part in this event entirely at my own risk. I understand that this is not a race and that I must obey all traffic laws at all times.",
+	"I agree that the organisers shall not be liable for any loss, damage or injury howsoever caused.",
+}
+
+var defaultSignatures = []string{"Rider signature", "Pillion signature"}
+
+// fmtOdoWords describes the odometer units recorded for the bike
+func fmtOdoWords(e Entrant) string {
+
+	if e.OdoKms == "K" {
+		return "Kilometres"
+	}
+	return "Miles"
+}
+
+// fmtTshirts lists the T-shirt sizes ordered, if any
+func fmtTshirts(e Entrant) string {
+
+	var res []string
+	for _, t := range []string{e.Tshirt1, e.Tshirt2} {
+		if t != "" && slices.Contains(cfg.Tshirts, t) {
+			res = append(res, t)
+		}
+	}
+	return strings.Join(res, " + ")
+}
+
+// formRows returns the label and value of each field shown on the entrant's
+// form. Pillion fields are left off solo entrants' forms.
+func formRows(fields []string, e Entrant) [][2]string {
+
+	var res [][2]string
+	for _, f := range fields {
+		f = strings.ToLower(f)
+		ff := formFields[f]
+		if (f == "pillion" || f == "pillioniba") && e.PillionFirst == "" && e.PillionLast == "" {
+			continue
+		}
+		if f == "ridernovice" {
+			ff.Label = stringsTitle(cfg.Novice)
+		}
+		res = append(res, [2]string{ff.Label, ff.Value(e)})
+	}
+	return res
+}
+
+// newPDF returns a fresh document using the given paper size. Text is
+// translated to the standard PDF encoding so that £ and accented names
+// are rendered properly.
+func newPDF(orientation, paper string) (*gofpdf.Fpdf, func(string) string) {
+
+	if paper == "" {
+		paper = "A4"
+	}
+	pdf := gofpdf.New(orientation, "mm", paper, "")
+	pdf.SetCreator(strings.Split(apptitle, "\n")[0], true)
+	pdf.SetAutoPageBreak(false, 0)
+	return pdf, pdf.UnicodeTranslatorFromDescriptor("")
+}
+
+// drawEntrantQR prints the entrant's QR code as a square of the given size
+func drawEntrantQR(pdf *gofpdf.Fpdf, entrantid string, x, y, size float64) {
+
+	png, err := entrantQRPNG(entrantid, 256)
+	if err != nil {
+		return // No number, no code
+	}
+	name := "qr" + entrantid
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	if pdf.GetImageInfo(name) == nil {
+		pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(png))
+	}
+	pdf.ImageOptions(name, x, y, size, size, false, opts, 0, "")
+}
+
+// writeForms produces a PDF holding one fully populated registration/disclaimer
+// form per entrant, in entrant order
+func writeForms(pdfname string, entrants []Entrant) error {
+
+	pdf, err := formsPDF(entrants)
+	if err != nil {
+		return err
+	}
+	return pdf.OutputFileAndClose(pdfname)
+}
+
+// formsPDF lays out the forms. Each starts on a new page and one too long
+// for a page carries on over the next.
+func formsPDF(entrants []Entrant) (*gofpdf.Fpdf, error) {
+
+	layout := cfg.Forms
+	if layout.Title == "" {
+		layout.Title = strings.ToUpper(cfg.Rally) + " " + cfg.Year + " Registration"
+	}
+	if layout.FontSize == 0 {
+		layout.FontSize = 11
+	}
+	if len(layout.Fields) == 0 {
+		layout.Fields = defaultFormFields
+	}
+	if len(layout.Disclaimer) == 0 {
+		layout.Disclaimer = defaultDisclaimer
+	}
+	if len(layout.Signatures) == 0 {
+		layout.Signatures = defaultSignatures
+	}
+	for _, f := range layout.Fields {
+		if _, ok := formFields[strings.ToLower(f)]; !ok {
+			return nil, fmt.Errorf("form field %v is not recognised", f)
+		}
+	}
+
+	pdf, tr := newPDF("P", layout.Paper)
+	pw, _ := pdf.GetPageSize()
+	const margin = 15.0
+	pdf.SetAutoPageBreak(true, margin)
+	width := pw - 2*margin
+	lh := layout.FontSize * 0.6
+
+	for _, e := range entrants {
+		pdf.AddPage()
+		drawEntrantQR(pdf, e.Entrantid, pw-margin-25, margin-5, 25)
+		pdf.SetXY(margin, margin)
+
+		pdf.SetFont("Helvetica", "B", layout.FontSize*1.6)
+		pdf.CellFormat(width, lh*2, tr(layout.Title), "", 1, "C", false, 0, "")
+		pdf.Ln(lh)
+
+		for _, row := range formRows(layout.Fields, e) {
+			pdf.SetX(margin)
+			pdf.SetFont("Helvetica", "", layout.FontSize*0.8)
+			pdf.CellFormat(width*0.3, lh*1.6, tr(row[0]), "B", 0, "L", false, 0, "")
+			pdf.SetFont("Helvetica", "B", layout.FontSize)
+			pdf.CellFormat(width*0.7, lh*1.6, tr(row[1]), "B", 1, "L", false, 0, "")
+		}
+
+		pdf.Ln(lh * 2)
+		pdf.SetFont("Helvetica", "", layout.FontSize*0.9)
+		for _, p := range layout.Disclaimer {
+			pdf.SetX(margin)
+			pdf.MultiCell(width, lh, tr(p), "", "J", false)
+			pdf.Ln(lh / 2)
+		}
+
+		pdf.Ln(lh * 2)
+		for _, s := range layout.Signatures {
+			if strings.Contains(strings.ToLower(s), "pillion") && e.PillionFirst == "" && e.PillionLast == "" {
+				continue
+			}
+			pdf.SetX(margin)
+			pdf.SetFont("Helvetica", "", layout.FontSize*0.8)
+			pdf.CellFormat(width*0.3, lh*3, tr(s), "", 0, "L", false, 0, "")
+			x, y := pdf.GetXY()
+			pdf.Rect(x, y, width*0.45, lh*3, "D")
+			pdf.SetX(x + width*0.5)
+			pdf.CellFormat(width*0.2, lh*3, tr("Date"), "B", 1, "L", false, 0, "")
+			pdf.Ln(lh)
+		}
+	}
+
+	if len(entrants) == 0 {
+		pdf.AddPage()
+	}
+	return pdf, pdf.Error()
+}
@@ -5,7 +5,9 @@ go 1.23.0
 toolchain go1.23.2
 
 require (
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/xuri/excelize/v2 v2.9.0
 	golang.org/x/text v0.22.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The golden tests run the whole pipeline, CSV to saved workbook, for each
+// shipped configuration using the fixtures in testdata and compare a text
+// dump of every sheet with testdata/golden. After a deliberate change to
+// the output, regenerate them with: go test -run Golden -update
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata/golden")
+
+var goldenConfigs = []string{"rblr", "bbr", "bbl", "jorvik", "invictus", "jamboree", "bbr-fees"}
+
+// goldenVariants are configurations kept in testdata to exercise features
+// the shipped ones don't use, run against the fixtures of the rally each is
+// based on
+var goldenVariants = map[string]string{"bbr-fees": "bbr"}
+
+// stubMembers stands in for the online IBA members database
+func stubMembers(w http.ResponseWriter, r *http.Request) {
+
+	members := []struct{ Iba, First, Last, Email string }{
+		{"1234", "Bob", "Stammers", "bob@example.com"},
+		{"56789", "Pierre", "de la Cruz", "pierre@example.fr"},
+	}
+	q := r.URL.Query()
+	for _, m := range members {
+		if q.Get("i") == m.Iba || (strings.EqualFold(q.Get("f"), m.First) && strings.EqualFold(q.Get("l"), m.Last)) {
+			json.NewEncoder(w).Encode(map[string]string{"Iba": m.Iba, "Sname": m.Last, "Email": m.Email})
+			return
+		}
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func TestGoldenWorkbooks(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(stubMembers))
+	defer srv.Close()
+
+	for _, name := range goldenConfigs {
+		for _, mode := range []string{"safe", "live"} {
+			t.Run(name+"-"+mode, func(t *testing.T) {
+				got := runGolden(t, name, mode == "live", srv.URL)
+				compareGolden(t, filepath.Join("testdata", "golden", name+"-"+mode+".txt"), got)
+			})
+		}
+	}
+}
+
+// TestDashboard serves the stats for one of the fixtures. The entrants'
+// warnings are left to the build, not repeated on every refresh.
+func TestDashboard(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(stubMembers))
+	defer srv.Close()
+	loadGolden(t, "bbr", "dashboard", t.TempDir(), srv.URL, "-refresh", "90s")
+	defer closeDatabases()
+
+	savedLog, savedReport := slog.Default(), runReport
+	defer func() { slog.SetDefault(savedLog); runReport = savedReport }()
+	var logged strings.Builder
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+	runReport = NewRunReport()
+
+	d := &dashboard{refresh: *refreshStats}
+	ds := httptest.NewServer(d.routes())
+	defer ds.Close()
+	get := func(path string) (int, string) {
+		res, err := http.Get(ds.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	code, page := get("/")
+	if code != http.StatusOK || !strings.Contains(page, `<meta http-equiv="refresh" content="90">`) || !strings.Contains(page, "Number of riders") {
+		t.Errorf("/ gives %v %.300q", code, page)
+	}
+	code, js := get("/stats.json")
+	var stats DashboardStats
+	if err := json.Unmarshal([]byte(js), &stats); code != http.StatusOK || err != nil {
+		t.Fatalf("/stats.json gives %v %v %.300q", code, err, js)
+	}
+	if stats.Rally != "bbr" || stats.Riders == 0 || stats.Riders != tot.NumRiders || len(stats.Bikes) == 0 {
+		t.Errorf("/stats.json gives %+v", stats)
+	}
+	if code, _ := get("/nowhere"); code != http.StatusNotFound {
+		t.Errorf("/nowhere gives %v", code)
+	}
+	if len(runReport.Warnings) != 0 || strings.Contains(logged.String(), "code=") {
+		t.Errorf("stats pass reported %v warnings and logged %q", len(runReport.Warnings), logged.String())
+	}
+
+	for _, table := range []struct {
+		refresh time.Duration
+		secs    int
+	}{
+		{0, 60},
+		{90 * time.Second, 90},
+		{500 * time.Millisecond, 1},
+		{time.Minute + time.Millisecond, 61},
+	} {
+		if secs := (&dashboard{refresh: table.refresh}).pageRefresh(); secs != table.secs {
+			t.Errorf("refresh %v reloads the page every %v seconds", table.refresh, secs)
+		}
+	}
+}
+
+// runGolden builds the full workbook for one configuration and returns its dump
+func runGolden(t *testing.T, name string, live bool, lookupURL string) string {
+
+	dir := t.TempDir()
+	xlsx := filepath.Join(dir, name+".xlsx")
+	args := []string{"-xls", xlsx, "-tabs", "full"}
+	if live {
+		args = append(args, "-format", "live")
+	}
+	loadGolden(t, name, "build", dir, lookupURL, args...)
+	defer closeDatabases()
+
+	if err := buildOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	return dumpWorkbook(t, xlsx)
+}
+
+// loadGolden runs command, with args, as far as importing the fixtures for
+// one configuration into a database in dir
+func loadGolden(t *testing.T, name, command, dir, lookupURL string, args ...string) {
+
+	flag.VisitAll(func(f *flag.Flag) { // Start from the defaults every time
+		if !strings.HasPrefix(f.Name, "test.") && f.Name != "update" {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	config, fixture := name, name
+	if base, ok := goldenVariants[name]; ok {
+		config, fixture = filepath.Join("testdata", name), base
+	}
+	args = append([]string{command, "-cfg", config, "-sql", filepath.Join(dir, "entrants.db")}, args...)
+	if paypal := filepath.Join("testdata", fixture+"-paypal.csv"); command == "build" && fileExists(paypal) {
+		args = append(args, "-paypal", paypal) // Transactions to reconcile, if the configuration has any
+	}
+	if err := parseCommandLine(args); err != nil {
+		t.Fatal(err)
+	}
+	*csvName = filepath.Join("testdata", fixture+".csv")
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	words.LiveDBURL = lookupURL
+	cfg.RBLRDB = "" // The results database isn't part of the workbook
+	if err := openDatabases(); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupLookup(); err != nil {
+		closeDatabases()
+		t.Fatal(err)
+	}
+	if err := importInput(); err != nil {
+		closeDatabases()
+		t.Fatal(err)
+	}
+}
+
+// fileExists says whether there's a fixture at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// dumpWorkbook describes every sheet of a saved workbook, cell by cell, as
+// stable text. Styles are listed once and referred to by number.
+func dumpWorkbook(t *testing.T, xlsx string) string {
+
+	f, err := excelize.OpenFile(xlsx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	styles := map[string]int{}
+	var stylelist []string
+	styleRef := func(id int) string {
+		if id == 0 {
+			return ""
+		}
+		st, err := f.GetStyle(id)
+		if err != nil {
+			return "?"
+		}
+		x := describeStyle(st)
+		n, ok := styles[x]
+		if !ok {
+			stylelist = append(stylelist, x)
+			n = len(stylelist)
+			styles[x] = n
+		}
+		return fmt.Sprintf("S%v", n)
+	}
+
+	extents := sheetExtents(t, xlsx)
+	for _, sheet := range f.GetSheetList() {
+		fmt.Fprintf(&b, "== %v\n", sheet)
+		maxcol, maxrow := extents[sheet][0], extents[sheet][1]
+		var cols []string
+		for c := 1; c <= maxcol; c++ {
+			cn, _ := excelize.ColumnNumberToName(c)
+			w, _ := f.GetColWidth(sheet, cn)
+			vis, _ := f.GetColVisible(sheet, cn)
+			x := fmt.Sprintf("%v=%g", cn, w)
+			if !vis {
+				x += "(hidden)"
+			}
+			cols = append(cols, x)
+		}
+		fmt.Fprintf(&b, "cols %v\n", strings.Join(cols, " "))
+		merges, _ := f.GetMergeCells(sheet)
+		for _, m := range merges {
+			fmt.Fprintf(&b, "merge %v:%v %q\n", m.GetStartAxis(), m.GetEndAxis(), m.GetCellValue())
+		}
+		for r := 1; r <= maxrow; r++ {
+			for c := 1; c <= maxcol; c++ {
+				cell, _ := excelize.CoordinatesToCellName(c, r)
+				v, _ := f.GetCellValue(sheet, cell, excelize.Options{RawCellValue: true})
+				fx, _ := f.GetCellFormula(sheet, cell)
+				id, _ := f.GetCellStyle(sheet, cell)
+				st := styleRef(id)
+				if v == "" && fx == "" && st == "" {
+					continue
+				}
+				fmt.Fprintf(&b, "%v %q", cell, v)
+				if fx != "" {
+					fmt.Fprintf(&b, " =%v", fx)
+				}
+				if st != "" {
+					fmt.Fprintf(&b, " %v", st)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+	b.WriteString("== Styles\n")
+	for i, x := range stylelist {
+		fmt.Fprintf(&b, "S%v %v\n", i+1, x)
+	}
+	return b.String()
+}
+
+var cellRef = regexp.MustCompile(`<c r="([A-Z]+[0-9]+)"`)
+
+// sheetExtents finds the last column and row of every cell written to each
+// sheet, styled or not. The dimension excelize records isn't kept up to
+// date and its row readers skip cells that are only styled, so this reads
+// the sheets' XML directly.
+func sheetExtents(t *testing.T, xlsx string) map[string][2]int {
+
+	zr, err := zip.OpenReader(xlsx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	part := func(name string) []byte {
+		for _, f := range zr.File {
+			if f.Name == strings.TrimPrefix(name, "/") {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rc.Close()
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return data
+			}
+		}
+		t.Fatalf("%v has no %v", xlsx, name)
+		return nil
+	}
+
+	var book struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := xml.Unmarshal(part("xl/workbook.xml"), &book); err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(part("xl/_rels/workbook.xml.rels"), &rels); err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string][2]int)
+	for _, s := range book.Sheets {
+		for _, r := range rels.Rels {
+			if r.ID != s.ID {
+				continue
+			}
+			target := r.Target
+			if !strings.HasPrefix(target, "/") {
+				target = "xl/" + target
+			}
+			var ext [2]int
+			for _, m := range cellRef.FindAllSubmatch(part(target), -1) {
+				c, r, _ := excelize.CellNameToCoordinates(string(m[1]))
+				ext[0] = max(ext[0], c)
+				ext[1] = max(ext[1], r)
+			}
+			res[s.Name] = ext
+		}
+	}
+	return res
+}
+
+// describeStyle gives the parts of a style that reglist sets
+func describeStyle(st *excelize.Style) string {
+
+	var res []string
+	if ft := st.Font; ft != nil {
+		res = append(res, fmt.Sprintf("font=%v/%g/%v/b:%v/i:%v", ft.Family, ft.Size, ft.Color, ft.Bold, ft.Italic))
+	}
+	if st.Fill.Type != "" {
+		res = append(res, fmt.Sprintf("fill=%v/%v/%v", st.Fill.Type, st.Fill.Pattern, strings.Join(st.Fill.Color, ",")))
+	}
+	if al := st.Alignment; al != nil {
+		res = append(res, fmt.Sprintf("align=%v/%v/rot:%v/wrap:%v/shrink:%v", al.Horizontal, al.Vertical, al.TextRotation, al.WrapText, al.ShrinkToFit))
+	}
+	var borders []string
+	for _, bd := range st.Border {
+		borders = append(borders, fmt.Sprintf("%v:%v:%v", bd.Type, bd.Style, bd.Color))
+	}
+	sort.Strings(borders)
+	if len(borders) > 0 {
+		res = append(res, "border="+strings.Join(borders, ","))
+	}
+	if st.NumFmt != 0 {
+		res = append(res, fmt.Sprintf("numfmt=%v", st.NumFmt))
+	}
+	if st.CustomNumFmt != nil {
+		res = append(res, fmt.Sprintf("numfmt=%q", *st.CustomNumFmt))
+	}
+	if len(res) == 0 {
+		return "plain"
+	}
+	return strings.Join(res, " ")
+}
+
+// compareGolden checks got against the golden file, or rewrites it with -update
+func compareGolden(t *testing.T, path string, got string) {
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, regenerate with go test -run Golden -update", err)
+	}
+	if string(want) == got {
+		return
+	}
+	wl := strings.Split(string(want), "\n")
+	gl := strings.Split(got, "\n")
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		var w, g string
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if w != g {
+			t.Errorf("%v differs from line %v\nwant %q\ngot  %q", path, i+1, w, g)
+			return
+		}
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"database/sql"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,45 +12,83 @@ import (
 	"github.com/xuri/excelize/v2"
 )
 
-func init() {
+// setup prepares everything the chosen command needs. Nothing is done
+// until it's called so the package can be tested without a configuration.
+func setup() error {
 
-	flag.Usage = func() {
-		w := flag.CommandLine.Output()
-		fmt.Fprintf(w, "%v\n", apptitle)
-		fmt.Fprintf(w, "%v\n", progdesc)
-		flag.PrintDefaults()
+	if err := loadConfig(); err != nil {
+		return err
 	}
-	flag.Parse()
-	if *showusage {
-		flag.Usage()
-		os.Exit(1)
+	if err := openDatabases(); err != nil {
+		return err
 	}
+	return setupLookup()
+}
 
-	fmt.Print(apptitle)
+// loadConfig reads reglist.yml and the rally configuration and works out
+// everything that follows from them and the flags
+func loadConfig() error {
 
 	var cfgerr error
 
 	words, cfgerr = NewWords()
 	if cfgerr != nil {
-		log.Fatal(cfgerr)
+		return failWith(ExitConfig, cfgerr)
+	}
+	if _, cfgerr = NewNormaliser(words); cfgerr != nil {
+		return failWith(ExitConfig, fmt.Errorf("reglist.yml defaultre: %w", cfgerr))
 	}
 
 	if *rally == "" {
-		log.Fatal("You must specify the configuration file to use: -cfg rblr")
+		return failWith(ExitUsage, errors.New("You must specify the configuration file to use: -cfg rblr"))
 	}
 	cfg, cfgerr = NewConfig(*rally + ".yml")
 	if cfgerr != nil {
-		log.Fatal(cfgerr)
+		return failWith(ExitConfig, cfgerr)
+	}
+	postcodeRegions, cfgerr = loadPostcodeRegions(words.PostcodeCSV)
+	if cfgerr != nil {
+		return failWith(ExitConfig, cfgerr)
+	}
+	bikeCatalogue, cfgerr = NewBikeCatalogue(words.BikeFile)
+	if cfgerr != nil {
+		return failWith(ExitConfig, cfgerr)
+	}
+	dataRules, cfgerr = NewRuleSet(cfg.Rules)
+	if cfgerr != nil {
+		return failWith(ExitConfig, cfgerr)
+	}
+	for _, p := range cfg.NotDuplicates {
+		if len(p) != 2 {
+			return failWith(ExitConfig, fmt.Errorf("notduplicates %v should be a pair of entrant numbers", p))
+		}
+	}
+	if err := checkRBLRStatuses(cfg.RBLRStatus); err != nil {
+		return failWith(ExitConfig, err)
+	}
+	rblrStatus = cfg.RBLRStatus
+	cfg.Currency = strings.ToUpper(strings.TrimSpace(cfg.Currency))
+	if err := checkRates(cfg.Rates); err != nil {
+		return failWith(ExitConfig, err)
+	}
+	if err := checkPricing(cfg.Pricing); err != nil {
+		return failWith(ExitConfig, err)
+	}
+	if err := completePolicy(&cfg.Cancellation); err != nil {
+		return failWith(ExitConfig, err)
+	}
+	if len(cfg.Tshirts) > max_tshirt_sizes {
+		return failWith(ExitConfig, fmt.Errorf("%v T-shirt sizes specified, no more than %v allowed", len(cfg.Tshirts), max_tshirt_sizes))
 	}
 	if *csvAdmin {
 		*csvReport = false
 	}
 	if *csvReport {
 		dbfieldsx = fieldlistFromConfig(cfg.Rfields)
-		fmt.Printf("CSV downloaded from Wufoo report\n")
+		slog.Info("CSV downloaded from Wufoo report")
 	} else {
 		dbfieldsx = fieldlistFromConfig(cfg.Afields)
-		fmt.Printf("CSV downloaded from Wufoo Administrator page\n")
+		slog.Info("CSV downloaded from Wufoo Administrator page")
 	}
 
 	if *allTabs {
@@ -66,10 +104,10 @@ func init() {
 	}
 
 	if cfg.Rally == "rblr" {
-		fmt.Printf("Running in RBLR mode, %v\n", sm)
+		slog.Info("Running in RBLR mode", "format", sm)
 		sqlx = sqlx_rblr
 	} else {
-		fmt.Printf("Running in rally mode, %v\n", sm)
+		slog.Info("Running in rally mode", "format", sm)
 		sqlx = sqlx_rally
 	}
 	sqlx = "SELECT " + sqlx + " FROM entrants"
@@ -78,88 +116,113 @@ func init() {
 	}
 	sqlx += " ORDER BY " + cfg.EntrantOrder
 
-	if *expReport == "" {
+	if *expReport == "" && (running("all") || running("watch")) {
 		*expReport = cfg.Rally + cfg.Year
 	}
-	if filepath.Ext(*expReport) == "" {
+	if *expReport != "" && filepath.Ext(*expReport) == "" {
 		*expReport = *expReport + ".csv"
 	}
 
-	//fmt.Printf("Creating %v\n", *xlsName)
-
 	exportingCSV = *expReport != ""
 	exportingEmail = *expEmail != ""
-	exportingGmail = *expGmail != ""
 
 	// This needs to be at least as big as the number of sizes declared
 	num_tshirt_sizes = len(cfg.Tshirts)
-	if num_tshirt_sizes > max_tshirt_sizes {
-		num_tshirt_sizes = max_tshirt_sizes
+
+	resetTotals()
+
+	switch command.Name {
+	case "import", "diff", "serve", "dashboard", "certs": // Nothing is looked up
+		*noLookup = true
 	}
 
-	// 6 is the number of RBLR routes - should be more generalised class taken from config, slapped wrist
-	tot = NewTotals(6, max_tshirt_sizes, 0)
+	includeShopTab = len(cfg.Tshirts) > 0 || cfg.Patchavail
+	if includeShopTab {
+		slog.Info("Including shop tab")
+		for i := 0; i < len(cfg.Tshirts); i++ {
+			tshirt_sizes[i] = " T-shirt " + cfg.Tshirts[i] // The leading space just makes sense
+		}
+	}
+
+	// Fix columns for patches
+	numsizes := len(cfg.Tshirts)
+	n, _ := excelize.ColumnNameToNumber("S")
+	overview_patch_column, _ = excelize.ColumnNumberToName(n + numsizes)
+	n, _ = excelize.ColumnNameToNumber("D")
+	shop_patch_column, _ = excelize.ColumnNumberToName(n + numsizes)
+
+	return nil
+}
+
+// openDatabases opens the SQLite database and, for those commands that use
+// it, the RBLR database
+func openDatabases() error {
 
 	var err error
 	db, err = sql.Open("sqlite3", *sqlName)
 	if err != nil {
-		log.Fatal(err)
+		return failWith(ExitDatabase, err)
 	}
 
-	if cfg.RBLRDB != "" {
+	updatesRBLR := running("all") || running("build") || running("watch") || running("serve") || running("certs")
+	if cfg.RBLRDB != "" && updatesRBLR {
 		rblrdb, err = sql.Open("sqlite3", cfg.RBLRDB)
-		checkerr(err)
-		_, err := rblrdb.Query("SELECT DBInitialised FROM config")
 		if err != nil {
-			log.Fatal("RBLR database is not setup, please do so before running me")
+			return failWith(ExitDatabase, err)
 		}
-		fmt.Println("RBLR database " + cfg.RBLRDB + " is opened")
-		sqlx := "DELETE FROM entrants"
-		rblrdb.Exec(sqlx)
+		rows, err := rblrdb.Query("SELECT DBInitialised FROM config")
+		if err != nil {
+			return failWith(ExitDatabase, errors.New("RBLR database is not setup, please do so before running me"))
+		}
+		rows.Close()
+		slog.Info("RBLR database is opened", "path", cfg.RBLRDB)
+	}
+	return nil
+}
+
+// closeDatabases closes whatever openDatabases opened
+func closeDatabases() {
+
+	if rblrdb != nil {
+		rblrdb.Close()
+		rblrdb = nil
+	}
+	if db != nil {
+		db.Close()
+		db = nil
 	}
+}
+
+// setupLookup decides how, if at all, IBA members are to be identified,
+// checking whether the online database can be reached
+func setupLookup() error {
 
-	lookupOnline = lookupOnlineAvail()
+	if !*noLookup {
+		lookupOnline = lookupOnlineAvail()
+	}
 
 	*noLookup = *noLookup || (*ridesdb == "" && !lookupOnline)
 
 	if !*noLookup && *ridesdb != "" {
-		if _, err = os.Stat(*ridesdb); os.IsNotExist(err) {
+		if _, err := os.Stat(*ridesdb); os.IsNotExist(err) {
 			*noLookup = true
 		} else {
 			_, err = db.Exec("ATTACH '" + *ridesdb + "' As rd")
 			if err != nil {
-				log.Fatal(err)
+				return failWith(ExitDatabase, err)
 			}
 			lookupOnline = false
 		}
 	}
 
 	if *noLookup {
-		fmt.Printf("Automatic IBA member identification not running\n")
+		slog.Info("Automatic IBA member identification not running")
 	} else if *ridesdb == "" {
-		fmt.Print("IBA member details being checked online")
-		if *verbose {
-			fmt.Printf(" %v", words.LiveDBURL)
-		}
-		fmt.Println()
+		slog.Info("IBA member details being checked online", "url", words.LiveDBURL)
 	} else {
-		fmt.Printf("Unidentified IBA members looked up using %v\n", *ridesdb)
-	}
-
-	includeShopTab = len(cfg.Tshirts) > 0 || cfg.Patchavail
-	if includeShopTab {
-		fmt.Printf("Including shop tab\n")
-		for i := 0; i < len(cfg.Tshirts); i++ { // Let's just have an uncontrolled panic if someone specifies too many sizes
-			tshirt_sizes[i] = " T-shirt " + cfg.Tshirts[i] // The leading space just makes sense
-		}
+		slog.Info("Unidentified IBA members looked up in rides database", "path", *ridesdb)
 	}
-
-	// Fix columns for patches
-	numsizes := len(cfg.Tshirts)
-	n, _ := excelize.ColumnNameToNumber("S")
-	overview_patch_column, _ = excelize.ColumnNumberToName(n + numsizes)
-	n, _ = excelize.ColumnNameToNumber("D")
-	shop_patch_column, _ = excelize.ColumnNumberToName(n + numsizes)
+	return nil
 }
 
 func initStyles() {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// avery7163 is the default label sheet, 14 labels per A4 sheet
+var avery7163 = LabelSheet{Paper: "A4", Columns: 2, Rows: 7, Width: 99.1, Height: 38.1, Left: 4.65, Top: 15.15, HPitch: 101.6, VPitch: 38.1}
+
+// badgePad is the margin around, and between, everything on a badge
+const badgePad = 3.0
+
+// badgeMinText is the narrowest space worth printing a badge's text in
+const badgeMinText = 20.0
+
+// label is the content of a single printed label
+type label struct {
+	Number  string
+	Name    string
+	Role    string
+	Route   string
+	Novice  bool
+	Sticker bool
+}
+
+// labelsFor returns the name badges and the bike sticker for one entrant
+func labelsFor(e Entrant) []label {
+
+	var res []label
+	route := strings.TrimSpace(e.RouteClass)
+	res = append(res, label{Number: e.Entrantid, Name: strings.TrimSpace(e.RiderFirst + " " + e.RiderLast),
+		Role: "Rider", Route: route, Novice: e.RiderNovice == "Y"})
+	if strings.TrimSpace(e.PillionFirst+e.PillionLast) != "" {
+		res = append(res, label{Number: e.Entrantid, Name: strings.TrimSpace(e.PillionFirst + " " + e.PillionLast),
+			Role: "Pillion", Route: route, Novice: e.PillionNovice == "Y"})
+	}
+	res = append(res, label{Number: e.Entrantid, Sticker: true})
+	return res
+}
+
+// checked returns the sheet ready to print on, falling back to the default
+// if the labels aren't described and spacing them at least their own size
+// apart. Labels too small to hold a badge's margins, or more than fit on the
+// paper, are rejected.
+func (sheet LabelSheet) checked() (LabelSheet, error) {
+
+	if sheet.Columns < 1 || sheet.Rows < 1 || sheet.Width <= 0 || sheet.Height <= 0 {
+		sheet = avery7163
+	}
+	if sheet.HPitch < sheet.Width {
+		sheet.HPitch = sheet.Width
+	}
+	if sheet.VPitch < sheet.Height {
+		sheet.VPitch = sheet.Height
+	}
+	if sheet.Width <= 2*badgePad || sheet.Height <= 2*badgePad {
+		return sheet, fmt.Errorf("labels %vmm wide by %vmm high are too small to print on", sheet.Width, sheet.Height)
+	}
+	pdf, _ := newPDF("P", sheet.Paper)
+	if err := pdf.Error(); err != nil {
+		return sheet, fmt.Errorf("labels paper %v: %v", sheet.Paper, err)
+	}
+	pw, ph := pdf.GetPageSize()
+	const slack = 0.01 // For rounding
+	if right := sheet.Left + float64(sheet.Columns-1)*sheet.HPitch + sheet.Width; right > pw+slack {
+		return sheet, fmt.Errorf("%v columns of labels reach %.1fmm across, the paper is %.1fmm wide", sheet.Columns, right, pw)
+	}
+	if bottom := sheet.Top + float64(sheet.Rows-1)*sheet.VPitch + sheet.Height; bottom > ph+slack {
+		return sheet, fmt.Errorf("%v rows of labels reach %.1fmm down, the paper is %.1fmm high", sheet.Rows, bottom, ph)
+	}
+	return sheet, nil
+}
+
+// writeLabels produces sheets of name badges and bike stickers for all entrants
+func writeLabels(pdfname string, entrants []Entrant) error {
+
+	sheet, err := cfg.Labels.checked()
+	if err != nil {
+		return err
+	}
+
+	var labels []label
+	for _, e := range entrants {
+		labels = append(labels, labelsFor(e)...)
+	}
+
+	pdf, tr := newPDF("P", sheet.Paper)
+	perpage := sheet.Columns * sheet.Rows
+	for i, lbl := range labels {
+		if i%perpage == 0 {
+			pdf.AddPage()
+		}
+		n := i % perpage
+		x := sheet.Left + float64(n%sheet.Columns)*sheet.HPitch
+		y := sheet.Top + float64(n/sheet.Columns)*sheet.VPitch
+		if lbl.Sticker {
+			drawSticker(pdf, tr, lbl, x, y, sheet.Width, sheet.Height)
+		} else {
+			drawBadge(pdf, tr, lbl, x, y, sheet.Width, sheet.Height)
+		}
+	}
+	if len(labels) == 0 {
+		pdf.AddPage()
+	}
+	return pdf.OutputFileAndClose(pdfname)
+}
+
+// badgeLayout gives the size of the QR code on a badge w by h and the
+// width left for the text beside it. Badges too narrow for both go without
+// the QR code, which is on the registration form anyway.
+func badgeLayout(w, h float64) (qs, cw float64) {
+
+	qs = h - 2*badgePad
+	cw = w - 3*badgePad - qs
+	if qs <= 0 || cw < badgeMinText {
+		return 0, w - 2*badgePad
+	}
+	return qs, cw
+}
+
+// drawBadge prints a name badge with the entrant number, route/class, a
+// marker for novices and, room permitting, the entrant's QR code
+func drawBadge(pdf *gofpdf.Fpdf, tr func(string) string, lbl label, x, y, w, h float64) {
+
+	const pad = badgePad
+	qs, cw := badgeLayout(w, h) // Content width, left of the QR code
+	if qs > 0 {
+		drawEntrantQR(pdf, lbl.Number, x+w-pad-qs, y+pad, qs)
+	}
+
+	pdf.SetXY(x+pad, y+pad)
+	pdf.SetFont("Helvetica", "B", h*0.35)
+	pdf.CellFormat(cw*0.4, h*0.3, lbl.Number, "", 0, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", h*0.22)
+	pdf.CellFormat(cw*0.6, h*0.3, tr(strings.ToUpper(cfg.Rally)+" "+cfg.Year), "", 1, "R", false, 0, "")
+
+	pdf.SetXY(x+pad, y+h*0.38)
+	fs := h * 0.45
+	pdf.SetFont("Helvetica", "B", fs)
+	for fs > 6 && pdf.GetStringWidth(tr(lbl.Name)) > cw {
+		fs--
+		pdf.SetFont("Helvetica", "B", fs)
+	}
+	pdf.CellFormat(cw, h*0.3, tr(lbl.Name), "", 1, "C", false, 0, "")
+
+	pdf.SetXY(x+pad, y+h-pad-h*0.2)
+	pdf.SetFont("Helvetica", "", h*0.22)
+	pdf.CellFormat(cw/2, h*0.2, tr(lbl.Role+" "+lbl.Route), "", 0, "L", false, 0, "")
+	if lbl.Novice {
+		pdf.SetFont("Helvetica", "B", h*0.22)
+		pdf.CellFormat(cw/2, h*0.2, tr(strings.ToUpper(cfg.Novice)), "", 0, "R", false, 0, "")
+	}
+}
+
+// drawSticker prints the entrant number as large as will fit, for the bike
+func drawSticker(pdf *gofpdf.Fpdf, tr func(string) string, lbl label, x, y, w, h float64) {
+
+	fs := h * 2.2 // points, roughly filling the label height
+	pdf.SetFont("Helvetica", "B", fs)
+	for fs > 10 && pdf.GetStringWidth(lbl.Number) > w*0.9 {
+		fs -= 2
+		pdf.SetFont("Helvetica", "B", fs)
+	}
+	pdf.SetXY(x, y)
+	pdf.CellFormat(w, h, tr(lbl.Number), "", 0, "CM", false, 0, "")
+}
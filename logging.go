@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Diagnostics go through log/slog, to stderr, so they can be filtered by
+// level and, with -logjson, read by other programs. Problems found with
+// individual entrants are also collected, along with the files written and
+// how long everything took, into the run report written by -report.
+
+// newLogger makes the handler for the chosen level and format
+func newLogger(w io.Writer, level slog.Level, asJSON bool) *slog.Logger {
+
+	opts := &slog.HandlerOptions{Level: level}
+	if asJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey && len(groups) == 0 { // The date is just clutter on a console
+			a.Value = slog.StringValue(a.Value.Time().Format("15:04:05"))
+		}
+		return a
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// setupLogging installs the logger asked for on the commandline
+func setupLogging() error {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return failWith(ExitUsage, fmt.Errorf("-log %q should be debug, info, warn or error", *logLevel))
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(newLogger(os.Stderr, level, *logJSON))
+	return nil
+}
+
+// EntrantWarning is a problem with one entrant's details
+type EntrantWarning struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Entrant  string `json:"entrant,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+}
+
+// PhaseTiming records how long one part of the run took
+type PhaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// RunReport describes a run so that a script can decide whether it was clean
+type RunReport struct {
+	Program  string           `json:"program"`
+	Command  string           `json:"command"`
+	Rally    string           `json:"rally,omitempty"`
+	Year     string           `json:"year,omitempty"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Seconds  float64          `json:"seconds"`
+	Timings  []PhaseTiming    `json:"timings"`
+	ExitCode int              `json:"exitcode"`
+	Error    string           `json:"error,omitempty"`
+	Clean    bool             `json:"clean"` // Exited OK with no errors or warnings
+	Counts   map[string]int   `json:"counts"`
+	Warnings []EntrantWarning `json:"warnings"`
+	Outputs  []string         `json:"outputs"`
+
+	silent bool // Warnings are recorded but not logged
+}
+
+func NewRunReport() *RunReport {
+
+	title, _, _ := strings.Cut(apptitle, "\n")
+	return &RunReport{
+		Program:  title,
+		Started:  time.Now(),
+		Timings:  []PhaseTiming{},
+		Counts:   make(map[string]int),
+		Warnings: []EntrantWarning{},
+		Outputs:  []string{},
+	}
+}
+
+// runReport is the report of this run
+var runReport = NewRunReport()
+
+// StartPass forgets the warnings and outputs of an earlier pass through the
+// entrants, as in watch mode, so only the latest is reported
+func (r *RunReport) StartPass() {
+
+	r.Warnings = r.Warnings[:0]
+	r.Outputs = r.Outputs[:0]
+}
+
+// Output records a file written
+func (r *RunReport) Output(path string) {
+	r.Outputs = append(r.Outputs, path)
+}
+
+// Time starts timing a phase, the returned function stops it
+func (r *RunReport) Time(phase string) func() {
+
+	start := time.Now()
+	return func() {
+		r.Timings = append(r.Timings, PhaseTiming{phase, time.Since(start).Seconds()})
+	}
+}
+
+// CountTotals records the figures from a pass through the entrants
+func (r *RunReport) CountTotals(t *Totals) {
+
+	r.Counts["riders"] = t.NumRiders
+	r.Counts["pillions"] = t.NumPillions
+	r.Counts["novices"] = t.NumNovices
+	r.Counts["ibamembers"] = t.NumIBAMembers
+	r.Counts["withdrawn"] = t.NumWithdrawn
+}
+
+// Write finishes the report and saves it as path
+func (r *RunReport) Write(path string, code int, err error) error {
+
+	r.Finished = time.Now()
+	r.Seconds = r.Finished.Sub(r.Started).Seconds()
+	if command != nil {
+		r.Command = command.Name
+	}
+	if cfg != nil {
+		r.Rally = cfg.Rally
+		r.Year = cfg.Year
+	}
+	r.ExitCode = code
+	if err != nil && code != ExitOK {
+		r.Error = err.Error()
+	}
+	r.Clean = code == ExitOK && countIssues(SeverityError)+countIssues(SeverityWarning) == 0
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// warnEntrant logs a problem with an entrant's details, at the severity
+// configured for its rule, and adds it to the report
+func warnEntrant(code, entrant, field, format string, args ...any) {
+
+	severity := dataRules.Severity(code)
+	if severity == SeverityOff {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !runReport.silent {
+		slog.Log(context.Background(), severityLevel(severity), msg, "code", code, "entrant", entrant, "field", field)
+	}
+	runReport.Warnings = append(runReport.Warnings, EntrantWarning{code, severity, entrant, field, msg})
+}
@@ -11,12 +11,14 @@ package main
  */
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -42,29 +44,58 @@ var safemode *bool = flag.Bool("safe", true, "Safe mode avoid formulas, no live
 var livemode *bool = flag.Bool("live", false, "Self-updating, live mode")
 var expReport *string = flag.String("exp", "", "Path to output standard format CSV, default to cfg name+year")
 var expEmail *string = flag.String("email", "", "Path CSV output for generic email")
-var expGmail *string = flag.String("gmail", "", "Path to CSV output for Gmail")
+var expGmail *string = flag.String("gmail", "", "Path to CSV output for Gmail contacts")
+var expOutlook *string = flag.String("outlook", "", "Path to CSV output for Outlook contacts")
+var expVCard *string = flag.String("vcard", "", "Path to vCard (.vcf) output for phone contacts")
+var expForms *string = flag.String("forms", "", "Path to PDF output of registration/disclaimer forms")
+var expCerts *string = flag.String("certs", "", "Path to PDF output of finisher certificates from the RBLR database")
+var expLabels *string = flag.String("labels", "", "Path to PDF output of name badges and bike stickers")
+var carparkQR *bool = flag.Bool("qr", false, "Show entrant QR codes on the Carpark tab")
+var expNok *bool = flag.Bool("nok", false, "Include emergency contact with exported contacts")
 var ridesdb *string = flag.String("rd", "", "Path of rides database for lookup")
 var noLookup *bool = flag.Bool("nolookup", false, "Don't lookup unidentified IBA members")
 var summaryOnly *bool = flag.Bool("summary", true, "Produce Summary/overview tabs only")
 var allTabs *bool = flag.Bool("full", false, "Generate all tabs")
+var serveAddr *string = flag.String("addr", ":8080", "Address for the serve and dashboard web servers")
+var watchEvery *time.Duration = flag.Duration("watch", 0, "Keep polling csvurl at this interval, rebuilding when it changes")
+var refreshStats *time.Duration = flag.Duration("refresh", time.Minute, "How often the dashboard recalculates, 0 = every request")
 var showusage *bool = flag.Bool("?", false, "Show this help")
 var verbose *bool = flag.Bool("v", false, "Verbose mode, debugging")
+var logLevel *string = flag.String("log", "info", "Logging level: debug, info, warn or error")
+var logJSON *bool = flag.Bool("logjson", false, "Log as JSON rather than text")
+var runReportPath *string = flag.String("report", "", "Path to JSON report of this run")
+var paypalCSV *string = flag.String("paypal", "", "Path to PayPal, or other merchant, transaction CSV to reconcile")
+
+// The commands other than all make each of the choices above that takes a
+// pair of flags with a single flag instead
+var csvSource = newChoiceFlag("source", "Where the CSV was downloaded from: report or admin", "report", map[string]func(){
+	"report": func() { *csvReport, *csvAdmin = true, false },
+	"admin":  func() { *csvReport, *csvAdmin = false, true },
+})
+var sheetFormat = newChoiceFlag("format", "Spreadsheet format: safe, values only, or live, with updateable totals", "safe", map[string]func(){
+	"safe": func() { *safemode, *livemode = true, false },
+	"live": func() { *safemode, *livemode = false, true },
+})
+var sheetTabs = newChoiceFlag("tabs", "Tabs to produce: summary, the overview tabs only, or full", "summary", map[string]func(){
+	"summary": func() { *summaryOnly, *allTabs = true, false },
+	"full":    func() { *summaryOnly, *allTabs = false, true },
+})
 
 const apptitle = "IBAUK Reglist v1.33\nCopyright (c) 2025 Bob Stammers\n\n"
-const progdesc = `I parse and enhance rally entrant records in CSV format downloaded from Wufoo forms either 
+const progdesc = `Usage: reglist [command] -cfg rally [options]
+
+I parse and enhance rally entrant records in CSV format downloaded from Wufoo forms either 
 using the admin interface or one of the reports. I output a spreadsheet in XLSX format of
 the records presented in various useful ways and, optionally, a CSV containing the enhanced
-data in a format suitable for input to a ScoreMaster database and, optionally, a CSV suitable for import to
-a Gmail account.
+data in a format suitable for input to a ScoreMaster database and, optionally, contacts suitable for
+import to Gmail, Outlook or a phone (vCard).
+
+Without a command, "all" is assumed.
 `
 
 var rblr_routes = [...]string{" A-NC", " B-NAC", " C-SC", " D-SAC", " E-5C", " F-5AC"}
 var rblr_routes_ridden = [...]int{0, 0, 0, 0, 0, 0}
 
-// cancelsLoseOut determines whether entrants with Paid=Cancelled lose T-shirts, camping and patches
-// If so, they aren't counted and moneys paid are added to sponsorship
-const cancelsLoseOut = false
-
 const max_tshirt_sizes int = 10
 
 var tshirt_sizes [max_tshirt_sizes]string
@@ -81,6 +112,9 @@ var noksheet string = "Contacts"
 var paysheet string = "Money"
 var subssheet string = "Sponsorship"
 var unpaidsheet string = "Unpaids"
+var issuesheet string = "Data issues"
+var dupesheet string = "Possible duplicates"
+var reconsheet string = "Reconciliation"
 
 // The Stats sheet (totsheet) needs to be first as otherwise Google Sheets
 // doesn't show the chart. Much diagnostic phaffery has led me to this
@@ -102,7 +136,7 @@ ifnull(NoviceRider,''),ifnull(NovicePillion,''),ifnull(odometer_counts,''),ifnul
 ifnull(MilestravelledToSquires,''),ifnull(FreeCamping,''),
 ifnull(Address1,''),ifnull(Address2,''),ifnull(Town,''),ifnull(County,''),
 ifnull(Postcode,''),ifnull(Country,''),ifnull(Email,''),ifnull(Mobilephone,''),
-ifnull(Date_Created,''),ifnull(Withdrawn,''),ifnull(HasPillion,'')`
+ifnull(Date_Created,''),ifnull(Withdrawn,''),ifnull(HasPillion,''),ifnull(Payment_Currency,'')`
 
 const sqlx_rally = `ifnull(RiderName,''),ifnull(RiderLast,''),ifnull(RiderIBANumber,''),
 ifnull(PillionName,''),ifnull(PillionLast,''),ifnull(PillionIBANumber,''),
@@ -114,7 +148,7 @@ FinalRiderNumber,ifnull(PaymentTotal,''),ifnull(PaymentStatus,''),
 ifnull(NoviceRider,''),ifnull(NovicePillion,''),ifnull(odometer_counts,''),ifnull(Registration,''),
 ifnull(Address1,''),ifnull(Address2,''),ifnull(Town,''),ifnull(County,''),
 ifnull(Postcode,''),ifnull(Country,''),ifnull(Email,''),ifnull(Mobilephone,''),
-ifnull(Date_Created,''),ifnull(Withdrawn,''),ifnull(HasPillion,'')`
+ifnull(Date_Created,''),ifnull(Withdrawn,''),ifnull(HasPillion,''),ifnull(Payment_Currency,'')`
 
 var sqlx string
 
@@ -122,20 +156,24 @@ var styleH, styleH2, styleH2L, styleT, styleV, styleV2, styleV2L, styleV2LBig, s
 
 var cfg *Config
 var words *Words
+var dataRules *RuleSet
 
 var db *sql.DB
 var rblrdb *sql.DB
 var includeShopTab bool
 var xl *excelize.File
 var exportingCSV bool
-var exportingGmail bool
 var exportingEmail bool
 var csvF *os.File
 var csvW *csv.Writer
 var csvFEmail *os.File
 var csvEmail *csv.Writer
-var csvFGmail *os.File
-var csvGmail *csv.Writer
+var contactFiles []*os.File
+var contactExports []ContactExporter
+
+// entrantList holds the finished records of all entrants still taking part,
+// in entrant order, for use by the printed outputs
+var entrantList []Entrant
 var num_tshirt_sizes int
 var totTShirts [max_tshirt_sizes]int = [max_tshirt_sizes]int{0}
 
@@ -150,55 +188,139 @@ var lookupOnline bool
 
 func main() {
 
-	if !*noCSV {
-		if *csvName != "" {
-			loadCSVFile()
-			fixRiderNumbers()
-		} else if cfg.CsvUrl != "" {
-			downloadCSVFile()
-			fixRiderNumbers()
-		} else {
-			fmt.Println("No CSV input available")
-			return
+	slog.SetDefault(newLogger(os.Stderr, slog.LevelInfo, false)) // Until the commandline is read
+	err := run(os.Args[1:])
+	code := exitCode(err)
+	if *runReportPath != "" {
+		if rerr := runReport.Write(*runReportPath, code, err); rerr != nil {
+			slog.Error("can't write run report", "err", rerr)
+			if code == ExitOK {
+				code = ExitOutput
+			}
 		}
 	}
+	os.Exit(code)
+}
 
-	if *verbose {
-		fmt.Println("dbg: Initialising spreadsheet")
+// run carries out the command given on the commandline. Everything that
+// goes wrong comes back here, via an ExitError where the exit code matters.
+func run(args []string) error {
+
+	if err := parseCommandLine(args); err != nil {
+		return err
 	}
-	initSpreadsheet()
-	if *verbose {
-		fmt.Println("dbg: Spreadsheet initialised")
+	if err := setupLogging(); err != nil {
+		return err
 	}
 
-	if exportingCSV {
-		initExportCSV()
-		defer csvF.Close()
+	fmt.Print(apptitle)
+
+	if running("certs") && *expCerts == "" {
+		return failWith(ExitUsage, errors.New("certs needs the PDF to write, eg -pdf certs.pdf"))
 	}
-	if exportingEmail {
-		initExportEmail()
-		defer csvFEmail.Close()
+	if running("watch") && *watchEvery <= 0 {
+		return failWith(ExitUsage, errors.New("watch needs an interval, eg -every 10m"))
 	}
-	if exportingGmail {
-		initExportGmail()
-		defer csvFGmail.Close()
+
+	err := setup()
+	defer closeDatabases()
+	if err != nil {
+		return err
+	}
+
+	switch command.Name {
+	case "serve":
+		return failWith(ExitServer, runServer(*serveAddr))
+	case "dashboard":
+		return failWith(ExitServer, runDashboard(*serveAddr, *refreshStats))
+	case "import":
+		return importInput()
+	case "build":
+		return buildOutputs()
+	case "export":
+		return exportOutputs()
+	case "check":
+		return checkEntries()
+	case "diff":
+		return diffInput()
+	case "lookup":
+		return lookupMembers(commandArgs)
+	}
+
+	if *expCerts != "" {
+		if err := writeCertificates(*expCerts); err != nil {
+			return failWith(ExitOutput, fmt.Errorf("can't produce certificates: %w", err))
+		}
+		runReport.Output(*expCerts)
+		slog.Info("Certificates written", "path", *expCerts)
+		return nil
 	}
 
-	mainloop()
+	if *watchEvery > 0 {
+		if *noCSV || *csvName != "" || cfg.CsvUrl == "" {
+			return failWith(ExitUsage, errors.New("-watch needs the csvurl from the configuration file"))
+		}
+		runWatch(*watchEvery)
+		return nil
+	}
 
-	if exportingCSV {
-		csvW.Flush()
+	if !*noCSV {
+		if err := importInput(); err != nil {
+			return err
+		}
 	}
-	if exportingEmail {
-		csvEmail.Flush()
+
+	return buildOutputs()
+}
+
+// buildOutputs produces the spreadsheet and all the requested exports from
+// whatever is currently loaded in the database
+func buildOutputs() error {
+
+	defer runReport.Time("build")()
+	resetTotals()
+	rblrWritten = make(map[int]bool)
+
+	slog.Debug("Initialising spreadsheet")
+	initSpreadsheet()
+	slog.Debug("Spreadsheet initialised")
+
+	if err := openExports(); err != nil {
+		return err
 	}
-	if exportingGmail {
-		csvGmail.Flush()
+
+	// The RBLR database is rewritten all or nothing, so a failed build
+	// leaves the carpark with the entries it had
+	var rtx *sql.Tx
+	if rblrdb != nil {
+		var err error
+		if rtx, err = rblrdb.Begin(); err != nil {
+			closeExports()
+			return failWith(ExitDatabase, err)
+		}
+		defer rtx.Rollback()
+	}
+
+	err := mainloop(rtx)
+
+	closeExports()
+	if err == nil {
+		err = pruneRBLR(rtx)
+	}
+	if err == nil && rtx != nil {
+		if err = rtx.Commit(); err != nil {
+			err = failWith(ExitDatabase, err)
+		}
+	}
+	if err != nil {
+		return err
 	}
 	if tot.NumWithdrawn > 0 {
-		fmt.Printf("%v entries withdrawn\n", tot.NumWithdrawn)
+		slog.Info("Entries withdrawn", "count", tot.NumWithdrawn)
 	}
-	fmt.Printf("%v entrants written\n", tot.NumRiders)
+	slog.Info("Entrants written", "count", tot.NumRiders)
+
+	writePrintedOutputs()
 
 	writeTotals()
 
@@ -207,43 +329,74 @@ func main() {
 	markSpreadsheet()
 
 	if cfg.Rally == "rblr" {
-		reportOutstanding()
+		if err := reportOutstanding(); err != nil {
+			return err
+		}
+	}
+	dupes, err := reportDuplicates()
+	if err != nil {
+		return err
+	}
+	writeDuplicatesSheet(dupes)
+	reportDuplicatePlates()
+	recs, err := reportReconciliation()
+	if err != nil {
+		return err
 	}
+	writeReconciliationSheet(recs)
+	writeIssuesSheet()
+	summariseIssues()
 
 	// Save spreadsheet by the given path.
 	if err := xl.SaveAs(*xlsName); err != nil {
-		fmt.Println(err)
-	}
-
-	if *verbose {
-		reportDuplicates()
+		return failWith(ExitOutput, err)
 	}
+	runReport.Output(*xlsName)
+	return nil
 }
 
 // Alphabetic from here on down ==========================================================
 
-func checkerr(err error) {
+func downloadCSVFile() error {
+
+	slog.Debug("Downloading", "url", cfg.CsvUrl)
+	data, err := fetchCSV(cfg.CsvUrl)
 	if err != nil {
-		panic(err)
+		return failWith(ExitInput, fmt.Errorf("error downloading %w", err))
+	}
+	err = importCSV(bytes.NewReader(data))
+	if err == errCSVHeader {
+		slog.Warn("Is csvurl valid? Has the Wufoo report been flagged as Public?", "url", cfg.CsvUrl)
+		return failWith(ExitInput, err)
 	}
+	return err
 }
 
-func downloadCSVFile() {
+// fetchCSV downloads the whole of the Wufoo report
+func fetchCSV(url string) ([]byte, error) {
 
-	if *verbose {
-		fmt.Printf("Downloading from %v\n", cfg.CsvUrl)
-	}
-	resp, err := http.Get(cfg.CsvUrl)
+	resp, err := http.Get(url)
 	if err != nil {
-		fmt.Printf("Error downloading %v\n", err)
-		return
+		return nil, err
 	}
-
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+var errCSVHeader = errors.New("CSV header could not be read")
 
-	reader := csv.NewReader(resp.Body)
+// importCSV replaces the entrants table with the records read from a
+// downloaded CSV. A bad record after the header just ends the import.
+func importCSV(r io.Reader) error {
 
-	makeSQLTable(db)
+	reader := csv.NewReader(r)
+
+	if err := makeSQLTable(db); err != nil {
+		return err
+	}
 
 	hdrSkipped := false
 
@@ -256,15 +409,14 @@ func downloadCSVFile() {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			fmt.Printf("\nDownloading CSV - Record - %v - Error: %v\n", record, err)
+			slog.Warn("Downloaded CSV unreadable, import ends here", "record", record, "err", err)
+			db.Exec("COMMIT")
 			if !hdrSkipped {
-				fmt.Printf("Is %v a valid URL?\nHas the Wufoo report been flagged as Public?\n\n", cfg.CsvUrl)
-				os.Exit(-4)
+				return errCSVHeader
 			}
-			return
-		} else if *verbose {
-			fmt.Printf("CSV == (%v) %v\n", len(record), record)
+			return nil
 		}
+		slog.Debug("CSV record", "fields", len(record), "record", record)
 
 		if !hdrSkipped {
 			hdrSkipped = true
@@ -273,9 +425,7 @@ func downloadCSVFile() {
 
 		debugCount++
 
-		if *verbose {
-			fmt.Printf("dbg: Loading %v\n", debugCount)
-		}
+		slog.Debug("Loading", "record", debugCount)
 
 		sqlx := "INSERT INTO entrants ("
 		sqlx += dbfieldsx
@@ -302,16 +452,14 @@ func downloadCSVFile() {
 		_, err = db.Exec(sqlx)
 		if err != nil {
 			db.Exec("COMMIT")
-			fmt.Println(sqlx)
-			log.Fatal(err)
+			slog.Error("Can't store entry", "sql", sqlx)
+			return failWith(ExitDatabase, err)
 		}
 	}
 
 	db.Exec("COMMIT")
-	if *verbose {
-		fmt.Println("dbg: Load complete")
-	}
-
+	slog.Debug("Load complete")
+	return nil
 }
 
 func fieldlistFromConfig(cols []string) string {
@@ -330,7 +478,7 @@ func fieldlistFromConfig(cols []string) string {
 
 // fixRiderNumbers creates the field FinalRiderNumber in the database. The original EntryID is
 // adjusted by cfg.Add2entrantid or overridden by RiderNumber if non-zero.
-func fixRiderNumbers() {
+func fixRiderNumbers() error {
 
 	var old string
 	var new, newseq int
@@ -339,13 +487,11 @@ func fixRiderNumbers() {
 
 	oldnew := make(map[string]int, 250) // More than enough
 
-	if *verbose {
-		fmt.Println("dbg: Reading rider numbers")
-	}
+	slog.Debug("Reading rider numbers")
 	sqlx := "SELECT EntryId,ifnull(RiderNumber,''),ifnull(withdrawn,'') FROM entrants"
 	rows, err := db.Query(sqlx) // There is scope for renumber alphabetically if desired.
 	if err != nil {
-		log.Fatal(err)
+		return failWith(ExitDatabase, err)
 	}
 	for rows.Next() {
 
@@ -366,28 +512,30 @@ func fixRiderNumbers() {
 		oldnew[old] = new
 	}
 
-	if *verbose {
-		fmt.Println("dbg: Writing rider numbers")
+	slog.Debug("Writing rider numbers")
+	rows.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return failWith(ExitDatabase, err)
 	}
-	tx, _ := db.Begin()
 	for old, new := range oldnew {
 		sqlx := "UPDATE entrants SET FinalRiderNumber=" + strconv.Itoa(new) + " WHERE EntryId='" + old + "'"
-		if *verbose {
-			fmt.Println(sqlx)
-		}
+		slog.Debug(sqlx)
 		_, err := tx.Exec(sqlx)
 		if err != nil {
-			log.Fatal(err)
+			tx.Rollback()
+			return failWith(ExitDatabase, err)
 		}
 	}
 	err = tx.Commit()
 	if err != nil {
-		log.Fatal()
+		return failWith(ExitDatabase, err)
 	}
 
 	n := len(oldnew)
-	fmt.Printf("%v entries loaded\n", n)
-	rows.Close()
+	runReport.Counts["loaded"] = n
+	slog.Info("Entries loaded", "count", n)
+	return nil
 }
 
 // formatSheet sets printed properties include page orientation and margins
@@ -423,26 +571,89 @@ func formatSheet(sheetName string, portrait bool) {
 
 }
 
-func initExportCSV() {
-	csvF = makeFile(*expReport)
-	csvW = makeCSVFile(csvF, false, false)
-	fmt.Printf("Exporting CSV to %v\n", *expReport)
+// closeExports flushes and closes everything opened by openExports
+func closeExports() {
+
+	if csvF != nil {
+		csvW.Flush()
+		csvF.Close()
+		csvF = nil
+	}
+	if csvFEmail != nil {
+		csvEmail.Flush()
+		csvFEmail.Close()
+		csvFEmail = nil
+	}
+	for _, c := range contactExports {
+		if err := c.Flush(); err != nil {
+			slog.Error("Contacts export failed", "kind", c.Name(), "err", err)
+		}
+	}
+	for _, f := range contactFiles {
+		f.Close()
+	}
+	contactFiles = nil
+	contactExports = nil
 }
-func initExportEmail() {
-	csvFEmail = makeFile(*expEmail)
-	csvEmail = makeCSVFile(csvFEmail, false, true)
-	fmt.Printf("Exporting Email CSV to %v\n", *expEmail)
+
+func initExportCSV() error {
+	f, err := makeFile(*expReport)
+	if err != nil {
+		return err
+	}
+	csvF = f
+	csvW = makeCSVFile(csvF, false)
+	runReport.Output(*expReport)
+	slog.Info("Exporting CSV", "path", *expReport)
+	return nil
 }
+func initExportEmail() error {
+	f, err := makeFile(*expEmail)
+	if err != nil {
+		return err
+	}
+	csvFEmail = f
+	csvEmail = makeCSVFile(csvFEmail, true)
+	runReport.Output(*expEmail)
+	slog.Info("Exporting Email CSV", "path", *expEmail)
+	return nil
+}
+
+// initExportContacts opens each of the requested address book exports
+func initExportContacts() error {
+
+	kinds := []struct {
+		kind string
+		path *string
+	}{{"gmail", expGmail}, {"outlook", expOutlook}, {"vcard", expVCard}}
 
-func initExportGmail() {
-	csvFGmail = makeFile(*expGmail)
-	csvGmail = makeCSVFile(csvFGmail, true, false)
-	fmt.Printf("Exporting Gmail CSV to %v\n", *expGmail)
+	for _, k := range kinds {
+		if *k.path == "" {
+			continue
+		}
+		f, err := makeFile(*k.path)
+		if err != nil {
+			return err
+		}
+		contactFiles = append(contactFiles, f)
+		c, err := newContactExporter(k.kind, f, *expNok)
+		if err == nil {
+			err = c.WriteHeader()
+		}
+		if err != nil {
+			return failWith(ExitOutput, err)
+		}
+		contactExports = append(contactExports, c)
+		runReport.Output(*k.path)
+		slog.Info("Exporting contacts", "kind", c.Name(), "path", *k.path)
+	}
+	return nil
 }
 
 func initSpreadsheet() {
 
 	xl = excelize.NewFile()
+	totsheet = "Sheet1" // May already have been renamed by an earlier build
 
 	if *xlsName == "" {
 		*xlsName = cfg.Rally + cfg.Year
@@ -451,7 +662,7 @@ func initSpreadsheet() {
 		*xlsName = *xlsName + ".xlsx"
 	}
 
-	fmt.Printf("Creating %v\n", *xlsName)
+	slog.Info("Creating spreadsheet", "path", *xlsName)
 
 	initStyles()
 	// First sheet is called Sheet1
@@ -509,13 +720,16 @@ func initSpreadsheet() {
 		}
 		xl.SetCellStyle(noksheet, "A1", "H1", styleH2L)
 
-		xl.SetCellStyle(paysheet, "A1", "K1", styleH2)
+		xl.SetCellStyle(paysheet, "A1", "O1", styleH2)
 		if cfg.Rally == "rblr" {
 			xl.SetCellStyle(subssheet, "A1", "I1", styleH2)
 		}
 
 		xl.SetCellStyle(chksheet, "A1", "C1", styleH2L)
 		xl.SetCellStyle(chksheet, "D1", "E1", styleH2)
+		if *carparkQR {
+			xl.SetCellStyle(chksheet, "F1", "F1", styleH2)
+		}
 
 		if includeShopTab {
 			xl.SetCellStyle(shopsheet, "A1", shop_patch_column+"1", styleH2)
@@ -548,10 +762,32 @@ func initSpreadsheetUnpaids() {
 	xl.SetColWidth(unpaidsheet, "F", "F", 10)
 
 }
+
+// openExports starts each of the requested CSV and contact exports. If
+// any can't be started, those already open are closed again.
+func openExports() error {
+
+	var err error
+	if exportingCSV {
+		err = initExportCSV()
+	}
+	if err == nil && exportingEmail {
+		err = initExportEmail()
+	}
+	if err == nil {
+		err = initExportContacts()
+	}
+	if err != nil {
+		closeExports()
+	}
+	return err
+}
+
+var digitsRE = regexp.MustCompile(`(\d+)`)
+
 func intval(x string) int {
 
-	re := regexp.MustCompile(`(\d+)`)
-	sm := re.FindSubmatch([]byte(x))
+	sm := digitsRE.FindSubmatch([]byte(x))
 	if len(sm) < 2 {
 		return 0
 	}
@@ -563,16 +799,13 @@ func intval(x string) int {
 
 }
 
-func loadCSVFile() {
+func loadCSVFile() error {
 
-	if *verbose {
-		fmt.Printf("dbg: loadCSVFile = %v\n", *csvName)
-	}
+	slog.Debug("Loading CSV file", "path", *csvName)
 	file, err := os.Open(*csvName)
-	// error - if we have one exit as CSV file not right
+	// error - if we have one give up as CSV file not right
 	if err != nil {
-		fmt.Printf("ERROR: %s\n", err)
-		os.Exit(-3)
+		return failWith(ExitInput, err)
 	}
 	// now file is open - defer the close of CSV file handle until we return
 	defer file.Close()
@@ -581,7 +814,9 @@ func loadCSVFile() {
 	// TODO : is there an error from this to check?
 	reader := csv.NewReader(file)
 
-	makeSQLTable(db)
+	if err := makeSQLTable(db); err != nil {
+		return err
+	}
 
 	hdrSkipped := false
 
@@ -593,8 +828,9 @@ func loadCSVFile() {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			fmt.Println("Error:", err)
-			return
+			slog.Warn("CSV unreadable, import ends here", "path", *csvName, "err", err)
+			db.Exec("COMMIT")
+			return nil
 		}
 
 		if !hdrSkipped {
@@ -604,9 +840,7 @@ func loadCSVFile() {
 
 		debugCount++
 
-		if *verbose {
-			fmt.Printf("dbg: Loading %v\n", debugCount)
-		}
+		slog.Debug("Loading", "record", debugCount)
 
 		sqlx := "INSERT INTO entrants ("
 		sqlx += dbfieldsx
@@ -626,70 +860,94 @@ func loadCSVFile() {
 		_, err = db.Exec(sqlx)
 		if err != nil {
 			db.Exec("COMMIT")
-			fmt.Println(sqlx)
-			log.Fatal(err)
+			slog.Error("Can't store entry", "sql", sqlx)
+			return failWith(ExitDatabase, err)
 		}
 	}
 
 	db.Exec("COMMIT")
-	if *verbose {
-		fmt.Println("dbg: Load complete")
-	}
-
+	slog.Debug("Load complete")
+	return nil
 }
 
-func makeCSVFile(f *os.File, gmail bool, email bool) *csv.Writer {
+func makeCSVFile(f *os.File, email bool) *csv.Writer {
 
 	writer := csv.NewWriter(f)
 	if email {
 		writer.Write(EntrantHeadersEmail())
-	} else if gmail {
-		writer.Write(EntrantHeadersGmail())
 	} else {
 		writer.Write(EntrantHeaders())
 	}
 	return writer
 }
 
-func makeFile(csvname string) *os.File {
+func makeFile(csvname string) (*os.File, error) {
 
 	file, err := os.Create(csvname)
 	if err != nil {
-		panic(err)
+		return nil, failWith(ExitOutput, err)
 	}
-	return file
+	return file, nil
+
+}
 
+// otherColumns are read by reglist besides those in the main query
+var otherColumns = []string{"Payment_Merchant", "Payment_Confirmation"}
+
+var queryColumnRE = regexp.MustCompile(`ifnull\((\w+)`)
+
+// missingColumns lists, for the CREATE TABLE, the columns reglist reads that
+// the configuration's fields don't include. They're left empty, so a form
+// without, say, pillions or withdrawals still builds.
+func missingColumns(fields string) string {
+
+	var res string
+	seen := map[string]bool{}
+	have := strings.ToLower(fields)
+	cols := otherColumns
+	for _, m := range queryColumnRE.FindAllStringSubmatch(sqlx, -1) {
+		cols = append(cols, m[1])
+	}
+	for _, col := range cols {
+		lc := strings.ToLower(col)
+		if seen[lc] || strings.Contains(have, `"`+lc+`"`) {
+			continue
+		}
+		seen[lc] = true
+		res += `,"` + col + `"`
+	}
+	return res
 }
 
-func makeSQLTable(db *sql.DB) {
+func makeSQLTable(db *sql.DB) error {
 
 	var x string = ""
 	re := regexp.MustCompile(`\bRiderNumber\b`)
 	if !re.Match([]byte(dbfieldsx)) {
 		x = ",RiderNumber"
 	}
+	x += missingColumns(dbfieldsx)
 	x += ",FinalRiderNumber"
 
-	if *verbose {
-		fmt.Println("dbg: Initialising database")
-	}
+	slog.Debug("Initialising database")
 	db.Exec("PRAGMA foreign_keys=OFF")
 	db.Exec("BEGIN TRANSACTION")
 	_, err := db.Exec("DROP TABLE IF EXISTS entrants")
 	if err != nil {
-		log.Fatal(err)
+		db.Exec("ROLLBACK")
+		return failWith(ExitDatabase, err)
 	}
 
-	if *verbose {
-		fmt.Printf("Making entrants => %v\n", dbfieldsx)
-	}
+	slog.Debug("Making entrants", "fields", dbfieldsx)
 	_, err = db.Exec("CREATE TABLE entrants (" + dbfieldsx + x + " INTEGER)")
 	if err != nil {
-		log.Fatal(err)
+		db.Exec("ROLLBACK")
+		return failWith(ExitDatabase, err)
 	}
 	_, err = db.Exec("DROP TABLE IF EXISTS rally")
 	if err != nil {
-		log.Fatal(err)
+		db.Exec("ROLLBACK")
+		return failWith(ExitDatabase, err)
 	}
 	_, err = db.Exec(`CREATE TABLE "rally" (
 		"name"	TEXT,
@@ -698,7 +956,8 @@ func makeSQLTable(db *sql.DB) {
 		"csv" TEXT
 	)`)
 	if err != nil {
-		log.Fatal(err)
+		db.Exec("ROLLBACK")
+		return failWith(ExitDatabase, err)
 	}
 	_, err = db.Exec("INSERT INTO rally (name,Year,extracted,csv) VALUES(?,?,?,?)",
 		cfg.Rally,
@@ -706,12 +965,11 @@ func makeSQLTable(db *sql.DB) {
 		time.Now().Format("Mon Jan 2 15:04:05 MST 2006"),
 		filepath.Base(*csvName))
 	if err != nil {
-		log.Fatal(err)
-	}
-	if *verbose {
-		fmt.Println("dbg: Database initialised")
+		db.Exec("ROLLBACK")
+		return failWith(ExitDatabase, err)
 	}
-
+	slog.Debug("Database initialised")
+	return nil
 }
 
 func markCancelledEntrants() {
@@ -755,7 +1013,7 @@ func markSpreadsheet() {
 	dp.Title = "Rally management spreadsheet"
 	err := xl.SetDocProps(&dp)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		slog.Warn("Can't set spreadsheet properties", "err", err)
 	}
 
 }
@@ -767,22 +1025,6 @@ func renameSheet(oldname *string, newname string) {
 
 }
 
-func reportDuplicates() {
-
-	var name, last string
-	var rex int
-
-	dupes, err := db.Query("SELECT RiderName,RiderLast,Count(*) FROM entrants WHERE Withdrawn IS NULL GROUP BY Upper(Trim(RiderLast)), Upper(Trim(RiderName)) HAVING Count(EntryID) > 1;")
-	if err != nil {
-		panic(err)
-	}
-	for dupes.Next() {
-		dupes.Scan(&name, &last, &rex)
-		fmt.Printf("*** Rider %v %v is entered more than once (%v times!)\n", name, last, rex)
-	}
-
-}
-
 // This reports riders who've tried but so far failed to complete entry (not yet paid)
 type UnpaidEntrant struct {
 	First   string
@@ -796,7 +1038,7 @@ type UnpaidEntrant struct {
 	Unpaid  string
 }
 
-func reportOutstanding() {
+func reportOutstanding() error {
 	var this, last UnpaidEntrant
 	var paidok bool
 
@@ -804,8 +1046,9 @@ func reportOutstanding() {
 
 	entries, err := db.Query(sqlx)
 	if err != nil {
-		panic(err)
+		return failWith(ExitDatabase, err)
 	}
+	defer entries.Close()
 	rowix := 3
 	sheetok := false
 	for entries.Next() {
@@ -813,7 +1056,7 @@ func reportOutstanding() {
 
 		if this.First != last.First || this.Last != last.Last {
 			if !paidok && last.First != "" {
-				fmt.Printf("*** Rider %v %v is still unpaid\n", properName(last.First), properName(last.Last))
+				warnEntrant("unpaid", "", "PaymentStatus", "Rider %v %v is still unpaid", properName(last.First), properName(last.Last))
 				reportOutstandingDetails(last, rowix, sheetok)
 				rowix++
 				sheetok = true
@@ -826,10 +1069,10 @@ func reportOutstanding() {
 
 	}
 	if last.First != "" && !paidok {
-		fmt.Printf("*** Rider %v %v is still unpaid\n", properName(last.First), properName(last.Last))
+		warnEntrant("unpaid", "", "PaymentStatus", "Rider %v %v is still unpaid", properName(last.First), properName(last.Last))
 		reportOutstandingDetails(last, rowix, sheetok)
 	}
-
+	return entries.Err()
 }
 
 func reportOutstandingDetails(e UnpaidEntrant, rowix int, sheetok bool) {
@@ -861,6 +1104,15 @@ func reportOutstandingDetails(e UnpaidEntrant, rowix int, sheetok bool) {
 	xl.SetCellStyle(unpaidsheet, "D"+row, "F"+row, styleV3)
 
 }
+
+// periodLabel turns a ReportingPeriod ("mm-dd" or "mm-") into a readable label
+func periodLabel(period string) string {
+
+	md := strings.Split(period, "-")
+	mth := []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}[intval(md[0])-1]
+	return mth + " " + md[1]
+}
+
 func reportEntriesByPeriod() {
 
 	var reportingperiod string
@@ -887,9 +1139,7 @@ func reportEntriesByPeriod() {
 	row := 3
 	for _, p := range tot.EntriesByPeriod {
 		srow := strconv.Itoa(row)
-		md := strings.Split(p.Month, "-")
-		mth := []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}[intval(md[0])-1]
-		xl.SetCellValue(totsheet, "H"+srow, mth+" "+md[1])
+		xl.SetCellValue(totsheet, "H"+srow, periodLabel(p.Month))
 		xl.SetCellValue(totsheet, "L"+srow, p.Total)
 		xl.SetCellValue(totsheet, "J"+srow, p.NumIBA)
 		xl.SetCellValue(totsheet, "K"+srow, p.NumNovice)
@@ -951,7 +1201,7 @@ func reportEntriesByPeriod() {
 
 	err := xl.AddChart(totsheet, "N2", &fmtx)
 	if err != nil {
-		fmt.Printf("OMG: %v\n%v\n", err, fmtx)
+		slog.Warn("Can't add chart", "err", err, "chart", fmtx)
 	}
 
 	xl.SetColVisible(totsheet, "H:M", false)
@@ -1016,6 +1266,27 @@ func setTabFormats() {
 	markCancelledEntrants()
 }
 
+// writePrintedOutputs produces the requested PDFs from the entrants just processed
+func writePrintedOutputs() {
+
+	if *expForms != "" {
+		if err := writeForms(*expForms, entrantList); err != nil {
+			slog.Error("Can't create forms", "err", err)
+		} else {
+			runReport.Output(*expForms)
+			slog.Info("Registration forms written", "count", len(entrantList), "path", *expForms)
+		}
+	}
+	if *expLabels != "" {
+		if err := writeLabels(*expLabels, entrantList); err != nil {
+			slog.Error("Can't create labels", "err", err)
+		} else {
+			runReport.Output(*expLabels)
+			slog.Info("Badges and stickers written", "path", *expLabels)
+		}
+	}
+}
+
 func writeTotals() {
 
 	reportEntriesByPeriod()
@@ -1061,7 +1332,7 @@ func writeTotals() {
 		xl.SetCellInt(totsheet, "B11", tot.NumCamping)
 		if *safemode {
 
-			xl.SetCellInt(totsheet, "B12", tot.TotMoneySponsor)
+			setMoneyCell(totsheet, "B12", tot.TotMoneySponsor)
 			r := 13
 			for i := 0; i < len(rblr_routes_ridden); i++ {
 				if rblr_routes_ridden[i] > 0 {
@@ -1132,6 +1403,7 @@ func writeTotals() {
 		xl.SetCellStyle(paysheet, "A2", "A"+totx.srowx, styleV3)
 		xl.SetCellStyle(paysheet, "D2", "J"+totx.srowx, styleV)
 		xl.SetCellStyle(paysheet, "K2", "K"+totx.srowx, styleV)
+		xl.SetCellStyle(paysheet, "L2", "N"+totx.srowx, styleV)
 		if cfg.Rally == "rblr" {
 			xl.SetCellStyle(subssheet, "A2", "A"+totx.srowx, styleV3)
 			xl.SetCellStyle(subssheet, "D2", "I"+totx.srowx, styleV)
@@ -1217,41 +1489,41 @@ func writeTotals() {
 	if *safemode {
 		// paysheet totals
 		ncol, _ = excelize.ColumnNameToNumber("D")
-		var moneytot int = 0
+		var moneytot Money = 0
 
 		// Riders
 		xcol, _ = excelize.ColumnNumberToName(ncol)
-		moneytot = tot.NumRiders * cfg.Riderfee
+		moneytot = tot.TotMoneyEntries
 		if !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
 		// Pillions
 		xcol, _ = excelize.ColumnNumberToName(ncol)
-		moneytot = tot.NumPillions * cfg.Pillionfee
+		moneytot = tot.TotMoneyPillions
 		if !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
 		// T-shirts
 		xcol, _ = excelize.ColumnNumberToName(ncol)
-		moneytot = tot.NumTshirts * cfg.Tshirtcost
+		moneytot = tot.TotMoneyTshirts
 		if num_tshirt_sizes > 0 && !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
 		// Patches
 		xcol, _ = excelize.ColumnNumberToName(ncol)
-		moneytot = tot.NumPatches * cfg.Patchcost
+		moneytot = tot.TotMoneyPatches
 		if cfg.Patchavail && !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
@@ -1262,7 +1534,7 @@ func writeTotals() {
 		moneytot = tot.TotMoneySponsor
 		if cfg.Sponsorship && !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
@@ -1271,12 +1543,22 @@ func writeTotals() {
 		moneytot = tot.TotMoneyMainPaypal + tot.TotMoneyCashPaypal
 		if !*summaryOnly {
 			xl.SetCellStyle(paysheet, xcol+srowt, xcol+srowt, styleT)
-			xl.SetCellInt(paysheet, xcol+srowt, moneytot)
+			setMoneyCell(paysheet, xcol+srowt, moneytot)
 		}
 		ncol++
 
+		// Payments converted
+		moneytot = 0
+		for _, ct := range tot.Currencies {
+			moneytot += ct.Converted
+		}
+		if moneytot != 0 && !*summaryOnly {
+			xl.SetCellStyle(paysheet, "N"+srowt, "N"+srowt, styleT)
+			setMoneyCell(paysheet, "N"+srowt, moneytot)
+		}
+
 	} else {
-		for _, c := range "DEFGHIJKL" {
+		for _, c := range "DEFGHIJKN" {
 			ff := "sum(" + string(c) + "2:" + string(c) + totx.srowx + ")"
 			if !*summaryOnly {
 				xl.SetCellFormula(paysheet, string(c)+strconv.Itoa(totx.srow), "if("+ff+"=0,\"\","+ff+")")
@@ -1284,6 +1566,9 @@ func writeTotals() {
 			}
 		}
 	}
+	if !*summaryOnly {
+		writeCurrencyTotals(totx.srow + 2)
+	}
 	xl.SetActiveSheet(0)
 	if cfg.Rally == "rblr" {
 		xl.SetCellValue(overviewsheet, "A1", "BL")
@@ -1343,6 +1628,9 @@ func writeTotals() {
 		xl.SetCellValue(regsheet, "F1", "✓")
 		xl.SetCellValue(chksheet, "D1", "Odo")
 		xl.SetCellValue(chksheet, "E1", "Time")
+		if *carparkQR {
+			xl.SetCellValue(chksheet, "F1", "QR")
+		}
 
 	}
 
@@ -1384,12 +1672,19 @@ func writeTotals() {
 		//xl.SetCellValue(paysheet, "K1", "+Cash")
 		xl.SetCellValue(paysheet, "J1", "Total received")
 		xl.SetCellValue(paysheet, "K1", "JustGiving")
+		xl.SetCellValue(paysheet, "L1", "Paid")
+		xl.SetCellValue(paysheet, "M1", "Currency")
+		xl.SetCellValue(paysheet, "N1", "Paid in "+cfg.Currency)
+		xl.SetCellValue(paysheet, "O1", "Pricing")
 		xl.SetColWidth(paysheet, "B", "B", 12)
 		xl.SetColWidth(paysheet, "C", "C", 12)
 		xl.SetColWidth(paysheet, "D", "G", 8)
 		xl.SetColWidth(paysheet, "H", "J", 12)
 		xl.SetColWidth(paysheet, "J", "J", 15)
 		xl.SetColWidth(paysheet, "K", "K", 30)
+		xl.SetColWidth(paysheet, "L", "M", 10)
+		xl.SetColWidth(paysheet, "N", "N", 12)
+		xl.SetColWidth(paysheet, "O", "O", 30)
 		if cfg.Rally == "rblr" {
 			xl.SetColWidth(subssheet, "B", "B", 12)
 			xl.SetColWidth(subssheet, "C", "C", 18)
@@ -1409,6 +1704,9 @@ func writeTotals() {
 		xl.SetColWidth(chksheet, "B", "B", 15)
 		xl.SetColWidth(chksheet, "C", "C", 18)
 		xl.SetColWidth(chksheet, "D", "E", 20)
+		if *carparkQR {
+			xl.SetColWidth(chksheet, "F", "F", 12)
+		}
 		//xl.SetColWidth(chksheet, "F", "G", 10)
 		//xl.SetColWidth(chksheet, "H", "H", 40)
 	}
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-// This handles any testing flags that would otherwise be passed
-// through to the main program and cause problems
-var _ = func() bool {
-	testing.Init()
-	return true
-}()
+// TestMain loads the word lists used by the name and bike functions
+func TestMain(m *testing.M) {
+
+	var err error
+	words, err = NewWords()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(ExitConfig)
+	}
+	os.Exit(m.Run())
+}
 
 func TestIntval(t *testing.T) {
 	tables := []struct {
@@ -33,6 +52,287 @@ func TestIntval(t *testing.T) {
 		}
 	}
 }
+
+func TestMoney(t *testing.T) {
+	tables := []struct {
+		x   string
+		m   Money
+		bad bool
+	}{
+		{"12.50", 1250, false},
+		{"£12.50", 1250, false},
+		{"12,50", 1250, false},
+		{"1,250.00", 125000, false},
+		{"1.250,00", 125000, false},
+		{"1,250", 125000, false},
+		{"GBP 30", 3000, false},
+		{"(5.00)", -500, false},
+		{"-£3", -300, false},
+		{"30.5", 3050, false},
+		{"1,234.567", 123457, false},
+		{"abc", 0, true},
+		{"", 0, true},
+	}
+	for _, table := range tables {
+		m, err := ParseMoney(table.x)
+		if m != table.m || (err != nil) != table.bad {
+			t.Errorf("%q gives %v, %v", table.x, m, err)
+		}
+	}
+
+	vals := []struct {
+		x   string
+		m   Money
+		str string
+		num string
+	}{
+		{"Include £50 in my payment", 5000, "50.00", "50"},
+		{"€60,00", 6000, "60.00", "60"},
+		{"70.50", 7050, "70.50", "70.5"},
+		{"-£2.05", -205, "-2.05", "-2.05"},
+		{"none", 0, "0.00", "0"},
+	}
+	for _, table := range vals {
+		m := moneyval(table.x)
+		if m != table.m || m.String() != table.str || m.Number() != table.num {
+			t.Errorf("%q gives %v, %v, %v", table.x, int64(m), m.String(), m.Number())
+		}
+	}
+}
+
+func TestConvertMoney(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &Config{Currency: "GBP", Rates: map[string]float64{"EUR": 0.85, "USD": 0.7777}}
+
+	tables := []struct {
+		m        Money
+		currency string
+		res      Money
+		ok       bool
+	}{
+		{6000, currencyCode("eur"), 5100, true},
+		{7050, currencyCode(""), 7050, true},
+		{1000, "USD", 778, true},
+		{2500, "CHF", 2500, false},
+	}
+	for _, table := range tables {
+		res, ok := convertMoney(table.m, table.currency)
+		if res != table.res || ok != table.ok {
+			t.Errorf("%v %v gives %v, %v", table.m, table.currency, res, ok)
+		}
+	}
+	if checkRates(map[string]float64{"eur": 1}) == nil || checkRates(map[string]float64{"EUR": 0}) == nil {
+		t.Error("bad rates accepted")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &Config{Currency: "GBP", Cancellation: Policy{Statuses: map[string]string{"Settled": statePaid}}}
+	if err := completePolicy(&cfg.Cancellation); err != nil {
+		t.Fatal(err)
+	}
+
+	txns, err := LoadTransactions("testdata/bbr-paypal.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 5 || txns[0].Date != "01/02/2025" || txns[1].Gross != 6000 || txns[1].Fee != -240 {
+		t.Fatalf("transactions loaded as %+v", txns)
+	}
+	pays := []Payment{
+		{Entrant: "1", Email: "bob@example.com", Status: "Completed", Confirmation: "TX1001", Currency: "GBP", Amount: 6500},
+		{Entrant: "2", Email: "mj@example.com", Status: "Completed", Merchant: "PayPal", Confirmation: "TX1002", Currency: "GBP", Amount: 7050},
+		{Entrant: "3", Email: "pierre@example.fr", Status: "Completed", Currency: "EUR", Amount: 6000},
+		{Entrant: "4", Email: "alan@example.com", Status: "Cancelled", Confirmation: "TX1004", Currency: "GBP", Amount: 2500},
+		{Entrant: "7", Email: "cheque@example.com", Status: "Completed", Merchant: "Cheque", Currency: "GBP", Amount: 9000},
+		{Entrant: "8", Email: "sam@example.com", Status: "Settled", Currency: "GBP", Amount: 6500},
+		{Entrant: "9", Email: "jo@example.com", Status: "Unpaid", Currency: "GBP", Amount: 6500},
+	}
+	want := map[string]string{ // Transaction, or entrant if none, to state and entrant
+		"TX1001": reconDiffers + " 1", "TX1003": reconMatched + " 3", "TX1004": reconMatched + " 4",
+		"TX1104": reconRefund + " 4", "TX9999": reconUnmatched + " ", "#2": reconMissing + " 2",
+		"#8": reconMissing + " 8",
+	}
+	recs := reconcile(txns, pays, "PayPal")
+	if len(recs) != len(want) {
+		t.Errorf("%v results, wanted %v", len(recs), len(want))
+	}
+	for _, r := range recs {
+		key, entrant := "", ""
+		if r.Payment != nil {
+			entrant = r.Payment.Entrant
+			key = "#" + entrant
+		}
+		if r.Transaction != nil {
+			key = r.Transaction.ID
+		}
+		if got := r.State + " " + entrant; got != want[key] {
+			t.Errorf("%v gives %q, wanted %q", key, got, want[key])
+		}
+	}
+}
+
+func TestPricing(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	yes, no := true, false
+	cfg = &Config{Riderfee: 9000, Pillionfee: 2000, Tshirtcost: 1500, Pricing: []PriceRule{
+		{Name: "Early bird", Item: "rider", Before: "2025-02-01", Price: 8000},
+		{Name: "Late", Item: "rider", From: "2025-06-01", Price: 10000},
+		{Name: "Novice member", Item: "rider", Member: &yes, Novice: &yes, Price: 7500},
+		{Name: "Non-member pillion", Item: "pillion", Member: &no, Price: 2500},
+		{Name: "Three shirts", Item: "tshirt", Quantity: 3, Price: 1200},
+	}}
+	if err := checkPricing(cfg.Pricing); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		p     Purchase
+		price Money
+		rule  string
+	}{
+		{Purchase{"rider", "2025-01-31 23:59:59", false, false, 1}, 8000, "Early bird"},
+		{Purchase{"rider", "2025-02-01 00:00:00", false, false, 1}, 9000, ""},
+		{Purchase{"rider", "2025-06-01 09:00:00", true, true, 1}, 10000, "Late"},
+		{Purchase{"rider", "2025-03-01 09:00:00", true, true, 1}, 7500, "Novice member"},
+		{Purchase{"rider", "", true, false, 1}, 9000, ""},
+		{Purchase{"pillion", "2025-01-01 09:00:00", false, false, 1}, 2500, "Non-member pillion"},
+		{Purchase{"pillion", "2025-01-01 09:00:00", true, false, 1}, 2000, ""},
+		{Purchase{"tshirt", "", false, false, 2}, 1500, ""},
+		{Purchase{"tshirt", "", false, false, 3}, 1200, "Three shirts"},
+		{Purchase{"patch", "", false, false, 1}, 0, ""},
+	}
+	for _, table := range tables {
+		price, rule := priceOf(table.p)
+		if price != table.price || rule != table.rule {
+			t.Errorf("%+v gives %v %q", table.p, price, rule)
+		}
+	}
+
+	for _, bad := range []PriceRule{{Item: "rider"}, {Name: "x", Item: "camping"}, {Name: "x", Item: "rider", Before: "1/2/2025"}} {
+		if checkPricing([]PriceRule{bad}) == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+
+	for _, table := range []struct {
+		novice string
+		answer string
+		res    bool
+	}{
+		{"novice", "I'm a novice", true},
+		{"novice", "Old hand", false},
+		{"", "Old hand", false},
+		{"", "", false},
+	} {
+		cfg.Novice = table.novice
+		if res := isNovice(table.answer); res != table.res {
+			t.Errorf("%q with novice %q gives %v", table.answer, table.novice, res)
+		}
+	}
+
+	fees, err := NewConfig(filepath.Join("testdata", "bbr-fees.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = fees
+	if err := checkPricing(cfg.Pricing); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []struct {
+		p     Purchase
+		price Money
+		rule  string
+	}{
+		{Purchase{"rider", "2025-01-15 10:00:00", true, false, 1}, 8000, "Early bird"},
+		{Purchase{"rider", "2025-03-01 10:00:00", true, false, 1}, 8500, "IBA member"},
+		{Purchase{"rider", "2025-03-01 10:00:00", false, false, 1}, 9000, ""},
+		{Purchase{"pillion", "2025-01-15 10:00:00", true, false, 1}, 2000, ""},
+	} {
+		price, rule := priceOf(table.p)
+		if price != table.price || rule != table.rule {
+			t.Errorf("testdata/bbr-fees.yml: %+v gives %v %q", table.p, price, rule)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	no := false
+	cfg = &Config{Cancellation: Policy{
+		Statuses: map[string]string{"Refunded": "refunded", "Deferred": "deferred", "Withdrawn": "cancelled", "Disputed": "disputed"},
+		Settings: map[string]StateSettings{
+			"cancelled": {Money: "donation"},
+			"refunded":  {Merchandise: &no},
+			"deferred":  {Counted: &no},
+			"disputed":  {},
+		},
+	}}
+	if err := completePolicy(&cfg.Cancellation); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		status string
+		state  string
+		policy StatePolicy
+	}{
+		{"Completed", "paid", StatePolicy{true, moneyFees, true}},
+		{"Refunded", "refunded", StatePolicy{false, moneyRefund, false}},
+		{"Cancelled", "cancelled", StatePolicy{true, moneyDonation, false}},
+		{"Withdrawn", "cancelled", StatePolicy{true, moneyDonation, false}},
+		{"Deferred", "deferred", StatePolicy{true, moneyFees, false}},
+		{"Disputed", "disputed", StatePolicy{true, moneyFees, true}},
+		{"Unpaid", "pending", StatePolicy{true, moneyFees, true}},
+		{"Failed", "pending", StatePolicy{true, moneyFees, true}},
+	}
+	for _, table := range tables {
+		state, policy := paymentState(table.status)
+		if state != table.state || policy != table.policy {
+			t.Errorf("%v gives %v %+v", table.status, state, policy)
+		}
+	}
+
+	bad := []Policy{
+		{Statuses: map[string]string{"Completed": "settled"}},
+		{Settings: map[string]StateSettings{"paid": {Money: "kept"}}},
+	}
+	for _, p := range bad {
+		if completePolicy(&p) == nil {
+			t.Errorf("%+v accepted", p)
+		}
+	}
+}
+
+func TestMissingColumns(t *testing.T) {
+
+	saved := sqlx
+	defer func() { sqlx = saved }()
+	sqlx = "SELECT ifnull(RiderName,''),ifnull(Withdrawn,''),round(ifnull(Miles,'0')),ifnull(withdrawn,'') FROM entrants"
+
+	tables := []struct {
+		fields string
+		res    string
+	}{
+		{`"EntryId","RiderName"`, `,"Payment_Merchant","Payment_Confirmation","Withdrawn","Miles"`},
+		{`"EntryId","ridername","WITHDRAWN","Payment_Merchant"`, `,"Payment_Confirmation","Miles"`},
+		{`"RiderName","Withdrawn","Miles","Payment_Merchant","Payment_Confirmation"`, ``},
+	}
+	for _, table := range tables {
+		if res := missingColumns(table.fields); res != table.res {
+			t.Errorf("%v gives %v", table.fields, res)
+		}
+	}
+}
 func TestMakeModel(t *testing.T) {
 	tables := []struct {
 		bk string
@@ -79,6 +379,26 @@ func TestProperName(t *testing.T) {
 		{"bob stammers", "Bob Stammers"},
 		{"colin mccrea", "Colin McCrea"},
 		{"john o'keefe", "John O'Keefe"},
+		{"MARY-JANE SMITH-JONES", "Mary-Jane Smith-Jones"},
+		{"van der berg", "van der Berg"},
+		{"de la cruz", "de la Cruz"},
+		{"LE", "Le"},
+		{"LE SUEUR", "Le Sueur"},
+		{"DE VILLE", "De Ville"},
+		{"john van der berg", "John van der Berg"},
+		{"VAN DER", "Van Der"},
+		{"JOSÉ", "José"},
+		{"émile zola", "Émile Zola"},
+		{"mcdonald", "McDonald"},
+		{"macdonald", "MacDonald"},
+		{"mack", "Mack"},
+		{"machin", "Machin"},
+		{"o’brien", "O’Brien"},
+		{"d'angelo", "D'Angelo"},
+		{"smith-mcdonald", "Smith-McDonald"},
+		{"  bob   stammers ", "Bob Stammers"},
+		{"DeVito", "DeVito"},
+		{"mccrea", "McCrea"},
 	}
 	for _, table := range tables {
 		x := properName(table.ip)
@@ -87,3 +407,1054 @@ func TestProperName(t *testing.T) {
 		}
 	}
 }
+
+func TestEntrantQR(t *testing.T) {
+
+	p := EntrantQRPayload("rblr", "25", 42)
+	qt, err := DecodeEntrantQR(p)
+	if err != nil {
+		t.Fatalf("%v doesn't decode: %v", p, err)
+	}
+	if qt.EntrantID != 42 || !qt.Matches("RBLR", "25") || qt.Matches("bbr", "25") {
+		t.Errorf("%v decodes as %+v", p, qt)
+	}
+	tables := []struct {
+		x   string
+		err error
+	}{
+		{"", ErrQRFormat},
+		{"IBAUK:rblr:25:42", ErrQRFormat},
+		{"IBAUK:rblr:25:x:00000000", ErrQRFormat},
+		{strings.Replace(p, ":42:", ":43:", 1), ErrQRChecksum},
+	}
+	for _, table := range tables {
+		_, err := DecodeEntrantQR(table.x)
+		if err != table.err {
+			t.Errorf("%v gives %v", table.x, err)
+		}
+	}
+}
+
+// newRBLRTestDB makes an in-memory stand-in for the RBLR database
+func newRBLRTestDB(t *testing.T) *sql.DB {
+
+	rdb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+	rdb.SetMaxOpenConns(1) // Every connection to :memory: is a new database
+	person := ""
+	for _, p := range []string{"Rider", "Pillion"} {
+		for _, f := range []string{"First", "Last", "Address1", "Address2", "Town", "County", "Postcode", "Country", "IBA", "RBL", "Phone", "Email"} {
+			person += p + f + " TEXT,"
+		}
+	}
+	_, err = rdb.Exec(`CREATE TABLE entrants (EntrantID INTEGER, EntrantStatus INTEGER, ` + person + `
+		Bike TEXT, BikeReg TEXT, NokName TEXT, NokRelation TEXT, NokPhone TEXT, Route TEXT,
+		OdoCounts TEXT, OdoStart TEXT, OdoFinish TEXT, StartTime TEXT, FinishTime TEXT, EntryDonation TEXT, FreeCamping TEXT,
+		CertificateAvailable TEXT DEFAULT 'N', CertificateDelivered TEXT, Tshirt1 TEXT, Tshirt2 TEXT, Patches TEXT)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rdb
+}
+
+func TestCertificates(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &Config{Rally: "rblr", Year: "25"}
+
+	rdb := newRBLRTestDB(t)
+	_, err := rdb.Exec(`INSERT INTO entrants (EntrantID,RiderFirst,RiderLast,PillionFirst,PillionLast,Bike,Route,OdoCounts,OdoStart,OdoFinish,StartTime,FinishTime,EntrantStatus) VALUES
+		(1,'bob','stammers',NULL,NULL,'Honda','A-NCW','M','1000','1525','2025-06-07T05:00','2025-06-07T21:30',8),
+		(2,'mary-jane','smith-jones','jo','smith-jones','BMW','D-SAC','K','100','1100','2025-06-07 05:00:00','2025-06-08 04:59:00',9),
+		(3,'alan','late',NULL,NULL,'Triumph','B-NAC',NULL,'200','500','2025-06-07T06:00','2025-06-07T05:00',8),
+		(4,'dnf','rider',NULL,NULL,'Ducati','C-SCW','M','300','400','2025-06-07T05:00','',3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finishers, err := loadFinishers(rdb, []int{rblrStatus.Finisher, rblrStatus.LateFinisher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		id       int
+		rider    string
+		pillion  string
+		route    string
+		distance int
+		units    string
+		miles    int
+		duration string
+		date     string
+	}{
+		{1, "Bob Stammers", "", "North clockwise", 525, "miles", 525, "16 hours 30 minutes", "7 June 2025"},
+		{2, "Mary-Jane Smith-Jones", "Jo Smith-Jones", "South anti-clockwise", 1000, "km", 621, "23 hours 59 minutes", "8 June 2025"},
+		{3, "Alan Late", "", "North anti-clockwise", 300, "miles", 300, "", "7 June 2025"},
+	}
+	if len(finishers) != len(tables) {
+		t.Fatalf("%v finishers loaded, wanted %v", len(finishers), len(tables))
+	}
+	for i, table := range tables {
+		c := finishers[i]
+		if c.EntrantID != table.id || c.Rider != table.rider || c.Pillion != table.pillion || c.RouteName != table.route ||
+			c.Distance != table.distance || c.Units != table.units || c.Miles != table.miles ||
+			c.Duration != table.duration || c.FinishDate != table.date || c.Rally != "rblr" {
+			t.Errorf("entrant %v loads as %+v", table.id, c)
+		}
+	}
+
+	if err := markCertificatesAvailable(rdb, []int{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int]string{1: "Y", 2: "N", 3: "Y", 4: "N"} {
+		var got string
+		if err := rdb.QueryRow("SELECT CertificateAvailable FROM entrants WHERE EntrantID=?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("entrant %v certificate available %v, wanted %v", id, got, want)
+		}
+	}
+
+	// Certificates are only produced by -certs if there's a certificate
+	// section with something in it
+	for _, table := range []struct {
+		yml   string
+		avail string
+	}{
+		{"rally: rblr\n", "Y"},
+		{"certificate:\n", "Y"},
+		{"certificate:\n  title: Well done\n", "N"},
+		{"certificate:\n  landscape: false\n", "N"},
+		{"certificate:\n  finisherstatus: [8]\n", "N"},
+	} {
+		path := filepath.Join(t.TempDir(), "rally.yml")
+		if err := os.WriteFile(path, []byte(table.yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificate = c.Certificate
+		if E := BuildRBLR(Entrant{RouteClass: "A"}); E.CertificateAvailable != table.avail {
+			t.Errorf("%q gives certificate available %v", table.yml, E.CertificateAvailable)
+		}
+	}
+}
+
+func TestRBLRStatus(t *testing.T) {
+
+	tables := []struct {
+		yml  string
+		want RBLRStatuses
+		ok   bool
+	}{
+		{"rally: rblr\n", defaultRBLRStatuses, true},
+		{"rblrstatus:\n  finisher: 5\n  latefinisher: 6\n",
+			RBLRStatuses{DNS: 0, Registered: 1, CheckedOut: 2, DNF: 3, CheckedIn: 4, Finisher: 5, LateFinisher: 6}, true},
+		{"rblrstatus:\n  finisher: 3\n", RBLRStatuses{DNS: 0, Registered: 1, CheckedOut: 2, DNF: 3, CheckedIn: 4, Finisher: 3, LateFinisher: 9}, false},
+	}
+	for _, table := range tables {
+		path := filepath.Join(t.TempDir(), "rally.yml")
+		if err := os.WriteFile(path, []byte(table.yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkRBLRStatuses(c.RBLRStatus)
+		if c.RBLRStatus != table.want || (err == nil) != table.ok {
+			t.Errorf("%q gives %+v %v", table.yml, c.RBLRStatus, err)
+		}
+	}
+}
+
+func TestCarpark(t *testing.T) {
+
+	saved, savedDB := cfg, rblrdb
+	defer func() { cfg, rblrdb = saved, savedDB }()
+	cfg = &Config{Rally: "rblr", Year: "25"}
+	rblrdb = newRBLRTestDB(t)
+
+	rblrWritten = make(map[int]bool)
+	tx, err := rblrdb.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Entrant{
+		{Entrantid: "1", RiderFirst: "Bob", RiderLast: "Stammers", BikeMake: "Honda", RouteClass: "A"},
+		{Entrantid: "2", RiderFirst: "Mary", RiderLast: "Smith", BikeMake: "BMW", RouteClass: "C"},
+		{Entrantid: "3", RiderFirst: "Alan", RiderLast: "Jones", BikeMake: "Triumph", RouteClass: "B"},
+	} {
+		E := BuildRBLR(e)
+		if err := writeRBLR(tx, &E); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer((&carparkServer{db: rblrdb}).routes())
+	defer srv.Close()
+	client := srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	steps := []struct {
+		method string
+		path   string
+		form   url.Values
+		code   int
+		want   string // In the page, or where it redirects to
+	}{
+		{"GET", "/?q=stammers", nil, http.StatusOK, "#1 Bob Stammers"},
+		{"GET", "/?q=nobody", nil, http.StatusOK, "No entrant matches nobody"},
+		{"GET", "/?id=2", nil, http.StatusOK, "#2 Mary Smith"},
+		{"GET", "/nowhere", nil, http.StatusNotFound, ""},
+		{"GET", "/checkout", nil, http.StatusSeeOther, "/"},
+		{"POST", "/checkin", url.Values{"id": {"2"}, "odo": {"1525"}, "time": {"2025-06-07T21:30"}, "status": {"8"}}, http.StatusOK, "can't be checked in, their status is DNS"},
+		{"POST", "/checkout", url.Values{"id": {"1"}, "odo": {"1000"}, "time": {"2025-06-07T05:00"}}, http.StatusSeeOther, "checked+out"},
+		{"POST", "/checkout", url.Values{"id": {"3"}, "odo": {"200"}, "time": {"2025-06-07T05:10"}}, http.StatusSeeOther, "checked+out"},
+		{"POST", "/checkout", url.Values{"id": {"2"}, "odo": {"lots"}, "time": {"2025-06-07T05:00"}}, http.StatusOK, "must be a whole number"},
+		{"POST", "/checkout", url.Values{"id": {"99"}, "odo": {"5"}, "time": {"2025-06-07T05:00"}}, http.StatusOK, "entrant 99 not found"},
+		{"GET", "/", nil, http.StatusOK, "Still out (2)"},
+		{"POST", "/checkin", url.Values{"id": {"1"}, "odo": {"900"}, "time": {"2025-06-07T21:30"}, "status": {"8"}}, http.StatusOK, "less than the check-out reading"},
+		{"POST", "/checkin", url.Values{"id": {"1"}, "odo": {"1525"}, "time": {"2025-06-07T21:30"}, "status": {"5"}}, http.StatusOK, "finish status 5 is not valid"},
+		{"POST", "/checkin", url.Values{"id": {"99"}, "odo": {"1525"}, "time": {"2025-06-07T21:30"}, "status": {"8"}}, http.StatusOK, "entrant 99 not found"},
+		{"POST", "/checkin", url.Values{"id": {"1"}, "odo": {"1525"}, "time": {"2025-06-07T21:30"}, "status": {"8"}}, http.StatusSeeOther, "checked+in"},
+		{"GET", "/?id=1", nil, http.StatusOK, "Finisher"},
+		{"GET", "/?id=3", nil, http.StatusOK, "Check in</button>"},
+		{"POST", "/checkout", url.Values{"id": {"1"}, "odo": {"1600"}, "time": {"2025-06-08T05:00"}}, http.StatusOK, "can't be checked out, their status is Finisher"},
+		{"POST", "/checkin", url.Values{"id": {"1"}, "odo": {"1600"}, "time": {"2025-06-08T05:00"}, "status": {"3"}}, http.StatusOK, "can't be checked in, their status is Finisher"},
+		{"GET", "/", nil, http.StatusOK, "Still out (1)"},
+	}
+	for _, step := range steps {
+		var res *http.Response
+		var err error
+		if step.method == "POST" {
+			res, err = client.PostForm(srv.URL+step.path, step.form)
+		} else {
+			res, err = client.Get(srv.URL + step.path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		got := html.UnescapeString(string(body))
+		if res.StatusCode == http.StatusSeeOther {
+			got = res.Header.Get("Location")
+		}
+		if res.StatusCode != step.code || !strings.Contains(got, step.want) {
+			t.Errorf("%v %v %v gives %v %.200q", step.method, step.path, step.form, res.StatusCode, got)
+		}
+	}
+
+	// Rebuilding keeps what the carpark recorded and drops only those no
+	// longer entered who haven't been through it, and a rebuild that fails
+	// part way leaves nothing behind
+	for _, bike := range []string{"Kawasaki", "Suzuki"} {
+		rblrWritten = make(map[int]bool)
+		tx, err := rblrdb.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		E := BuildRBLR(Entrant{Entrantid: "1", RiderFirst: "Bob", RiderLast: "Stammers", BikeMake: bike, RouteClass: "A"})
+		if err := writeRBLR(tx, &E); err != nil {
+			t.Fatal(err)
+		}
+		if err := pruneRBLR(tx); err != nil {
+			t.Fatal(err)
+		}
+		if bike == "Kawasaki" {
+			err = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"1 8 Suzuki 1000 1525", "3 2 Triumph 200 "}
+	var got []string
+	rows, err := rblrdb.Query("SELECT EntrantID,EntrantStatus,trim(Bike),ifnull(OdoStart,''),ifnull(OdoFinish,'') FROM entrants ORDER BY EntrantID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id, status int
+		var bike, start, finish string
+		if err := rows.Scan(&id, &status, &bike, &start, &finish); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%v %v %v %v %v", id, status, bike, start, finish))
+	}
+	rows.Close()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after rebuilding the RBLR database holds %q not %q", got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+
+	for i := range commands {
+		c := &commands[i]
+		fs, err := newCommandFlags(c)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for alias := range c.Help {
+			if fs.Lookup(alias) == nil {
+				t.Errorf("command %v has help for flag %v which it doesn't take", c.Name, alias)
+			}
+		}
+	}
+
+	bad := Command{Name: "frob", Flags: []string{"csv", "nosuchflag"}}
+	if _, err := newCommandFlags(&bad); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+
+	tables := []struct {
+		args []string
+		cmd  string
+		code int
+	}{
+		{[]string{"-cfg", "bbr"}, "all", ExitOK},
+		{[]string{"-cfg", "bbr", "-live", "-full", "-adm"}, "all", ExitOK},
+		{[]string{"build", "-cfg", "bbr", "-tabs", "full"}, "build", ExitOK},
+		{[]string{"lookup", "-cfg", "bbr", "Bob Stammers"}, "lookup", ExitOK},
+		{[]string{"frob"}, "", ExitUsage},
+		{[]string{"import", "-full"}, "", ExitUsage},
+		{[]string{"build", "-live"}, "", ExitUsage},
+		{[]string{"build", "-format", "pretty"}, "", ExitUsage},
+		{[]string{"import", "-adm"}, "", ExitUsage},
+		{[]string{"-cfg", "bbr", "-format", "live"}, "", ExitUsage},
+	}
+	for _, table := range tables {
+		err := parseCommandLine(table.args)
+		if exitCode(err) != table.code {
+			t.Errorf("%v gives %v", table.args, err)
+		} else if err == nil && command.Name != table.cmd {
+			t.Errorf("%v runs %v", table.args, command.Name)
+		}
+	}
+	if len(commandArgs) != 0 {
+		t.Errorf("commandArgs left as %v", commandArgs)
+	}
+
+	choices := []struct {
+		args  []string
+		flags []*bool
+		want  []bool
+	}{
+		{[]string{"build", "-format", "live", "-tabs", "full"}, []*bool{safemode, livemode, summaryOnly, allTabs}, []bool{false, true, false, true}},
+		{[]string{"watch", "-format", "SAFE", "-tabs", "summary"}, []*bool{safemode, livemode, summaryOnly, allTabs}, []bool{true, false, true, false}},
+		{[]string{"import", "-source", "admin"}, []*bool{csvReport, csvAdmin}, []bool{false, true}},
+		{[]string{"diff", "-source", "report"}, []*bool{csvReport, csvAdmin}, []bool{true, false}},
+	}
+	for _, table := range choices {
+		if err := parseCommandLine(table.args); err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range table.flags {
+			if *f != table.want[i] {
+				t.Errorf("%v leaves flag %v as %v", table.args, i, *f)
+			}
+		}
+	}
+
+	var ee *ExitError
+	err := failWith(ExitInput, fmt.Errorf("loading: %w", failWith(ExitDatabase, errors.New("locked"))))
+	if !errors.As(err, &ee) || ee.Code != ExitDatabase {
+		t.Errorf("%v has lost its exit code", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+
+	configured := []Rule{
+		{Code: "no-email", Field: "Email", Required: true, Severity: SeverityError},
+		{Code: "bad-email", Field: "Email", Pattern: `^[^@\s]+@[^@\s]+\.[^@\s]+$`, Message: "Email {Email} looks wrong"},
+		{Code: "tshirt", Field: "Tshirt1", Allowed: []string{"S", "M", "L"}},
+		{Code: "miles", Field: "Miles2Squires", Op: "le", Value: "500"},
+		{Code: "nok-same-phone", Severity: SeverityOff},
+	}
+	rs, err := NewRuleSet(configured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		e    Entrant
+		want string
+	}{
+		{Entrant{Email: "bob@example.com", Tshirt1: "m", Miles2Squires: "80"}, ""},
+		{Entrant{Tshirt1: "XXL", Miles2Squires: "800"}, "no-email tshirt miles"},
+		{Entrant{Email: "bob.example.com"}, "bad-email"},
+		{Entrant{Email: "a@b.cc", RiderFirst: "Bob", RiderLast: "Smith", NokName: "bob  SMITH"}, "nok-is-rider"},
+		{Entrant{Email: "a@b.cc", Phone: "07700 900123", NokPhone: "07700900123"}, ""},
+	}
+	for _, table := range tables {
+		got := strings.Join(rs.Check(&table.e), " ")
+		if got != table.want {
+			t.Errorf("%+v breaks %q not %q", table.e, got, table.want)
+		}
+	}
+	if rs.Severity("nok-same-phone") != SeverityOff || rs.Severity("no-email") != SeverityError {
+		t.Errorf("configured severities not used")
+	}
+
+	bad := [][]Rule{
+		{{Field: "Email"}},
+		{{Code: "x", Field: "Emale", Required: true}},
+		{{Code: "x", Field: "Email", Op: "like", Value: "a"}},
+		{{Code: "x", Field: "Email", Pattern: "("}},
+		{{Code: "x", Field: "Email", Severity: "fatal"}},
+	}
+	for _, b := range bad {
+		if _, err := NewRuleSet(b); err == nil {
+			t.Errorf("%+v accepted", b)
+		}
+	}
+}
+
+func TestParsePhone(t *testing.T) {
+
+	saved := words.MaxPhone
+	defer func() { words.MaxPhone = saved }()
+	words.MaxPhone = 20
+
+	tables := []struct {
+		tel, country string
+		e164, shown  string
+		ok           bool
+	}{
+		{"07700 900123", "United Kingdom", "+447700900123", "07700 900123", true},
+		{"07700900123", "", "+447700900123", "07700 900123", true},
+		{"+44 (0)20 7946 0018", "France", "+442079460018", "020 7946 0018", true},
+		{"0044 1904 123456", "", "+441904123456", "01904 123456", true},
+		{"447700900123", "UK", "+447700900123", "07700 900123", true},
+		{"06 12 34 56 78", "France", "+33612345678", "+33 612 345 678", true},
+		{"+1 (415) 555-2671", "", "+14155552671", "+1 415 555 2671", true},
+		{"087 123 4567", "Ireland", "+353871234567", "+353 871 234 567", true},
+		{"0300 123 4567", "", "+443001234567", "0300 123 4567", true},
+		{"01134960000", "", "+441134960000", "0113 496 0000", true},
+		{"+44 161 4960000", "", "+441614960000", "0161 496 0000", true},
+		{"0191 498 0123", "", "+441914980123", "0191 498 0123", true},
+		{"01632 960123", "", "+441632960123", "01632 960123", true},
+		{"07123456789", "", "+447123456789", "07123 456789", true},
+		{"07700 900123 ext 4", "", "+447700900123", "07700 900123", true},
+		{"0", "", "", "0", false},
+		{"7", "", "", "7", false},
+		{"07700 9001", "", "", "07700 9001", false},
+		{"07700 900123 4567", "", "", "07700 900123 4567", false},
+		{"06 12 34 56 78", "Ruritania", "", "06 12 34 56 78", false},
+		{"same as rider", "", "", "same as rider", false},
+		{"07700 900123 or 01904 123456 evenings", "", "", "07700 900123 or 0190", false},
+		{"", "", "", "", true},
+	}
+	for _, table := range tables {
+		p := ParsePhone(table.tel, table.country)
+		if p.E164 != table.e164 || p.String() != table.shown || (p.Problem == "") != table.ok {
+			t.Errorf("%q in %q gives %q %q %q", table.tel, table.country, p.E164, p.String(), p.Problem)
+		}
+		// Numbers that can't be understood are exported whole
+		want := table.e164
+		if want == "" {
+			want = strings.TrimSpace(table.tel)
+		}
+		if p.Value() != want {
+			t.Errorf("%q in %q is exported as %q", table.tel, table.country, p.Value())
+		}
+	}
+}
+
+func TestContacts(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &Config{Rally: "rblr", Year: "25"}
+
+	escapes := []struct {
+		in, out string
+	}{
+		{"Mary-Jane Smith", "Mary-Jane Smith"},
+		{" Flat 2, Old Mill ", `Flat 2\, Old Mill`},
+		{`C:\bikes; spares`, `C:\\bikes\; spares`},
+		{"line one\r\nline two\nthree", `line one\nline two\nthree`},
+	}
+	for _, x := range escapes {
+		if got := vcardEscape(x.in); got != x.out {
+			t.Errorf("escape %q gives %q, expected %q", x.in, got, x.out)
+		}
+	}
+
+	folds := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{strings.Repeat("a", 75), strings.Repeat("a", 75)},
+		{strings.Repeat("a", 80), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 5)},
+		{strings.Repeat("a", 74) + "é", strings.Repeat("a", 74) + "\r\n é"},
+		{strings.Repeat("a", 160), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n " + strings.Repeat("a", 11)},
+	}
+	for _, x := range folds {
+		got := vcardFold(x.in)
+		if got != x.out {
+			t.Errorf("fold of %d bytes gives %q, expected %q", len(x.in), got, x.out)
+		}
+		if strings.ReplaceAll(got, "\r\n ", "") != x.in {
+			t.Errorf("fold of %d bytes doesn't unfold", len(x.in))
+		}
+	}
+
+	e := Entrant{RiderFirst: "Mary-Jane", RiderLast: "Smith", Email: "mj@example.com", Phone: "07700 900123",
+		Address1: "1 High Street", Address2: "Flat 2, Old Mill", Town: "York", County: "North Yorkshire",
+		Postcode: "YO1 7HH", Country: "United Kingdom",
+		NokName: "John Smith", NokRelation: "Husband", NokPhone: "07700 900456",
+		phoneNumber: ParsePhone("07700900123", ""), nokPhoneNumber: ParsePhone("+44 7700 900456", "")}
+	nok := "Emergency contact: John Smith (Husband) 07700 900456"
+
+	gmail := map[string]string{
+		"Name": "Mary-Jane Smith", "Given Name": "Mary-Jane", "Family Name": "Smith",
+		"Group Membership": "rblr25 ::: * myContacts",
+		"E-mail 1 - Type":  "* Home", "E-mail 1 - Value": "mj@example.com",
+		"Phone 1 - Type": "Mobile", "Phone 1 - Value": "+447700900123",
+		"Phone 2 - Type": "Emergency", "Phone 2 - Value": "+447700900456",
+		"Address 1 - Type":      "Home",
+		"Address 1 - Formatted": "1 High Street, Flat 2, Old Mill, York, North Yorkshire, YO1 7HH, United Kingdom",
+		"Address 1 - Street":    "1 High Street", "Address 1 - Extended Address": "Flat 2, Old Mill",
+		"Address 1 - City": "York", "Address 1 - Region": "North Yorkshire",
+		"Address 1 - Postal Code": "YO1 7HH", "Address 1 - Country": "United Kingdom",
+		"Relation 1 - Type": "Husband", "Relation 1 - Value": "John Smith",
+		"Notes": nok}
+	outlook := map[string]string{
+		"First Name": "Mary-Jane", "Last Name": "Smith",
+		"E-mail Address": "mj@example.com", "E-mail Display Name": "Mary-Jane Smith (mj@example.com)",
+		"Mobile Phone": "+447700900123", "Other Phone": "+447700900456",
+		"Home Street": "1 High Street", "Home Street 2": "Flat 2, Old Mill", "Home City": "York",
+		"Home State": "North Yorkshire", "Home Postal Code": "YO1 7HH", "Home Country/Region": "United Kingdom",
+		"Categories": "rblr25", "Notes": nok}
+	vcard := map[string]string{
+		"BEGIN": "VCARD", "VERSION": "4.0", "FN": "Mary-Jane Smith", "N": "Smith;Mary-Jane;;;",
+		"EMAIL;TYPE=home":                 "mj@example.com",
+		`TEL;VALUE=uri;TYPE="cell,voice"`: "tel:+447700900123",
+		"ADR;TYPE=home":                   `;Flat 2\, Old Mill;1 High Street;York;North Yorkshire;YO1 7HH;United Kingdom`,
+		"CATEGORIES":                      "rblr25",
+		"RELATED;TYPE=contact;VALUE=text": nok,
+		"END":                             "VCARD"}
+	without := func(m map[string]string, keys ...string) map[string]string {
+		res := maps.Clone(m)
+		for _, k := range keys {
+			delete(res, k)
+		}
+		return res
+	}
+
+	// Columns, or vCard properties, not listed must be blank
+	tables := []struct {
+		kind string
+		nok  bool
+		want map[string]string
+	}{
+		{"gmail", true, gmail},
+		{"gmail", false, without(gmail, "Phone 2 - Type", "Phone 2 - Value", "Relation 1 - Type", "Relation 1 - Value", "Notes")},
+		{"Outlook", true, outlook},
+		{"outlook", false, without(outlook, "Other Phone", "Notes")},
+		{"vcard", true, vcard},
+		{"vCard", false, without(vcard, "RELATED;TYPE=contact;VALUE=text")},
+	}
+	for _, table := range tables {
+		var out strings.Builder
+		x, err := newContactExporter(table.kind, &out, table.nok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := x.WriteHeader(); err != nil {
+			t.Fatal(err)
+		}
+		if err := x.WriteContact(e); err != nil {
+			t.Fatal(err)
+		}
+		if err := x.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]string)
+		if x.Name() == "vCard" {
+			for _, ln := range strings.Split(strings.ReplaceAll(out.String(), "\r\n ", ""), "\r\n") {
+				if k, v, ok := strings.Cut(ln, ":"); ok {
+					got[k] = v
+				}
+			}
+		} else {
+			rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+			if err != nil || len(rows) != 2 {
+				t.Fatalf("%v gives %d rows %v", x.Name(), len(rows), err)
+			}
+			for i, h := range rows[0] {
+				got[h] = rows[1][i]
+			}
+		}
+		for k := range table.want {
+			if _, ok := got[k]; !ok {
+				t.Errorf("%v nok=%v has no %q", x.Name(), table.nok, k)
+			}
+		}
+		for k, v := range got {
+			if v != table.want[k] {
+				t.Errorf("%v nok=%v %q is %q, expected %q", x.Name(), table.nok, k, v, table.want[k])
+			}
+		}
+	}
+
+	if _, err := newContactExporter("palm", io.Discard, false); err == nil {
+		t.Error("unknown contacts format accepted")
+	}
+}
+
+func TestAddress(t *testing.T) {
+
+	postcodes := []struct{ in, out string }{
+		{"yo1 7hh", "YO1 7HH"},
+		{"SW1A2AA", "SW1A 2AA"},
+		{" ec1a  1bb ", "EC1A 1BB"},
+		{"York", ""},
+		{"75001", ""},
+	}
+	for _, table := range postcodes {
+		if got := normalisePostcode(table.in); got != table.out {
+			t.Errorf("normalisePostcode(%q) gives %q not %q", table.in, got, table.out)
+		}
+	}
+
+	counties := []struct{ in, out string }{
+		{"N. Yorks", "North Yorkshire"},
+		{"herts", "Hertfordshire"},
+		{"WEST SUSSEX", "West Sussex"},
+		{"Co. Durham", "County Durham"},
+	}
+	for _, table := range counties {
+		if got := normaliseCounty(table.in); got != table.out {
+			t.Errorf("normaliseCounty(%q) gives %q not %q", table.in, got, table.out)
+		}
+	}
+
+	addresses := []struct {
+		town, county, postcode, country string
+		wantTown, wantPostcode          string
+	}{
+		{"York", "", "yo17hh", "", "York", "YO1 7HH"},
+		{"York YO1 7HH", "", "", "United Kingdom", "York", "YO1 7HH"},
+		{"York", "", "Tel 01904 YO1 7HH", "", "York", "YO1 7HH"},
+		{"Paris", "", "75001", "France", "Paris", "75001"},
+		{"Dublin", "", "d02 x285", "Ireland", "Dublin", "D02 X285"},
+	}
+	for _, table := range addresses {
+		e := Entrant{Address1: "1 High Street", Town: table.town, County: table.county, Postcode: table.postcode, Country: table.country}
+		checkAddress(&e)
+		if e.Town != table.wantTown || e.Postcode != table.wantPostcode {
+			t.Errorf("%q %q %q gives %q %q", table.town, table.postcode, table.country, e.Town, e.Postcode)
+		}
+	}
+
+	misplaced := []struct {
+		address1, address2         string
+		wantAddress1, wantAddress2 string
+		wantPostcode               string
+	}{
+		{"1 High Street", "York yo1 7hh", "1 High Street", "York", "YO1 7HH"},
+		{"Kadıköy Sk 1 SW1A 1AA Flat 2", "", "Kadıköy Sk 1 Flat 2", "", "SW1A 1AA"},
+		{"1 High Street", "ɐɐɐ SW1A 1AA", "1 High Street", "ɐɐɐ", "SW1A 1AA"},
+		{"Straße 1", "Münster", "Straße 1", "Münster", ""},
+	}
+	for _, table := range misplaced {
+		e := Entrant{Address1: table.address1, Address2: table.address2}
+		pc, _ := findPostcode(&e)
+		if e.Address1 != table.wantAddress1 || e.Address2 != table.wantAddress2 || pc != table.wantPostcode {
+			t.Errorf("%q %q gives %q %q %q", table.address1, table.address2, e.Address1, e.Address2, pc)
+		}
+	}
+}
+
+func TestParsePlate(t *testing.T) {
+
+	tables := []struct {
+		reg, country string
+		shown        string
+		ok           bool
+	}{
+		{"ab12cde", "", "AB12 CDE", true},
+		{" AB-12 C.D.E ", "United Kingdom", "AB12 CDE", true},
+		{"a123 bcd", "", "A123 BCD", true},
+		{"ABC123D", "UK", "ABC 123D", true},
+		{"BUN 1", "", "BUN 1", true},
+		{"ABZ 1234", "", "ABZ 1234", true},
+		{"AB12CDEF", "", "AB12CDEF", false},
+		{"ab-123-cd", "France", "AB-123-CD", true},
+		{"191 D 12345", "Ireland", "191-D-12345", true},
+		{"M AB 1234", "Germany", "M-AB 1234", true},
+		{"1234 bcd", "Spain", "1234 BCD", true},
+		{"ca 123-456", "Ruritania", "CA 123 456", true},
+		{"", "", "", true},
+	}
+	for _, table := range tables {
+		p := ParsePlate(table.reg, table.country)
+		if p.Normalised != table.shown || (p.Problem == "") != table.ok {
+			t.Errorf("%q in %q gives %q %q", table.reg, table.country, p.Normalised, p.Problem)
+		}
+	}
+	if a, b := ParsePlate("AB12CDE", ""), ParsePlate("ab12 cde", ""); a.Key() != b.Key() {
+		t.Errorf("%q and %q should be the same bike", a.Entered, b.Entered)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+
+	names := []struct {
+		f1, l1, f2, l2 string
+		similar        bool
+	}{
+		{"Bob", "Stammers", "BOB", "STAMMERS", true},
+		{"Mary-Jane", "Smith-Jones", "Mary Jane", "Smith Jones", true},
+		{"Rob", "Smith", "Robert", "Smith", true},
+		{"Bill", "Smith", "Will", "Smith", true},
+		{"Bob", "Smyth", "Bob", "Smith", true},
+		{"Bob", "Smith", "Jane", "Smith", false},
+		{"Jo", "Smith", "John", "Smith", false},
+		{"Bob", "Smith", "", "", false},
+	}
+	for _, table := range names {
+		if similarNames(table.f1, table.l1, table.f2, table.l2) != table.similar {
+			t.Errorf("%v %v and %v %v similar should be %v", table.f1, table.l1, table.f2, table.l2, table.similar)
+		}
+	}
+
+	entrants := []Entrant{
+		{Entrantid: "1", RiderFirst: "Bob", RiderLast: "Stammers", Email: "bob@example.com"},
+		{Entrantid: "2", RiderFirst: "Jane", RiderLast: "Stammers", Email: "BOB@example.com"},
+		{Entrantid: "3", RiderFirst: "Fred", RiderLast: "Bloggs", PillionFirst: "Robert", PillionLast: "Stammers"},
+		{Entrantid: "4", RiderFirst: "Alf", RiderLast: "Smith", Phone: "+447700900123", BikeReg: "AB12 CDE"},
+		{Entrantid: "5", RiderFirst: "Alfred", RiderLast: "Smith", Phone: "+447700900123", BikeReg: "AB12CDE"},
+		{Entrantid: "6", RiderFirst: "Carol", RiderLast: "Jones", BikeReg: "TBC"},
+		{Entrantid: "7", RiderFirst: "Dave", RiderLast: "Brown", BikeReg: "tbc"},
+		{Entrantid: "8", RiderFirst: "Eve", RiderLast: "White", BikeReg: "TBA"},
+	}
+	got := map[string]string{}
+	for _, p := range findDuplicates(entrants, [][]int{{2, 1}}) {
+		got[p.A.Entrantid+"-"+p.B.Entrantid] = strings.Join(p.Reasons, ", ")
+	}
+	want := map[string]string{
+		"1-3": "Bob Stammers is also pillion to 3",
+		"4-5": "similar names, same mobile, same registration",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("findDuplicates gives %v not %v", got, want)
+	}
+}
+
+func TestBikeCatalogue(t *testing.T) {
+
+	bc, err := NewBikeCatalogue("bikes.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		bike, mk, md string
+		conf         float64
+	}{
+		{"BMW R1250GSA", "BMW", "R 1250 GS Adventure", matchExact},
+		{"bmw r 1250 gs adventure", "BMW", "R 1250 GS Adventure", matchExact},
+		{"2019 BMW R1250GS", "BMW", "R 1250 GS", matchExact},
+		{"royal enfield himalayan", "Royal Enfield", "Himalayan", matchExact},
+		{"Harley-Davidson Electra Glide Ultra", "Harley-Davidson", "Electra Glide", matchPrefix},
+		{"Honda Deauvile", "Honda", "Deauville", matchClose},
+		{"Goldwing", "Honda", "Gold Wing", matchNoMake},
+		{"Honda CG125", "Honda", "CG125", matchNoModel},
+		{"BMW R1100GS", "BMW", "R1100GS", matchNoModel},
+		{"BMW R1100RT", "BMW", "R1100RT", matchNoModel},
+		{"Honda", "Honda", "", matchExact},
+		{"Bloggs Special", "", "", 0},
+	}
+	for _, table := range tables {
+		m := bc.Resolve(table.bike)
+		if m.Make != table.mk || m.Model != table.md || m.Confidence != table.conf {
+			t.Errorf("%q gives %q %q %v", table.bike, m.Make, m.Model, m.Confidence)
+		}
+	}
+}
+
+func TestSummariseChanges(t *testing.T) {
+
+	bob := watchedEntry{Name: "Bob Smith", Status: "Unpaid"}
+	mary := watchedEntry{Name: "Mary Jones", Status: "Paid"}
+	paid := bob
+	paid.Status = "Paid"
+	gone := mary
+	gone.Withdrawn = "Withdrawn"
+	renamed := mary
+	renamed.Name = "Mary Smith-Jones"
+
+	tables := []struct {
+		name     string
+		was, now map[string]watchedEntry
+		changes  string
+	}{
+		{"first pass", nil, map[string]watchedEntry{"1": bob}, "New entry Bob Smith"},
+		{"no change", map[string]watchedEntry{"1": bob, "2": mary}, map[string]watchedEntry{"1": bob, "2": mary}, ""},
+		{"new", map[string]watchedEntry{"1": bob}, map[string]watchedEntry{"1": bob, "2": mary}, "New entry Mary Jones"},
+		{"removed", map[string]watchedEntry{"1": bob, "2": mary}, map[string]watchedEntry{"2": mary}, "Removed Bob Smith"},
+		{"paid", map[string]watchedEntry{"1": bob}, map[string]watchedEntry{"1": paid}, `Bob Smith payment "Unpaid" now "Paid"`},
+		{"withdrawn", map[string]watchedEntry{"2": mary}, map[string]watchedEntry{"2": gone}, "Withdrawn Mary Jones"},
+		{"reinstated", map[string]watchedEntry{"2": gone}, map[string]watchedEntry{"2": mary}, "Amended Mary Jones"},
+		{"renamed", map[string]watchedEntry{"2": mary}, map[string]watchedEntry{"2": renamed}, "Amended Mary Smith-Jones"},
+		{"sorted", map[string]watchedEntry{"1": bob, "2": mary}, map[string]watchedEntry{"1": paid, "2": gone, "3": renamed},
+			`Bob Smith payment "Unpaid" now "Paid"|New entry Mary Smith-Jones|Withdrawn Mary Jones`},
+	}
+	for _, table := range tables {
+		if res := strings.Join(summariseChanges(table.was, table.now), "|"); res != table.changes {
+			t.Errorf("%v gives %q, expected %q", table.name, res, table.changes)
+		}
+	}
+}
+
+func TestRunReport(t *testing.T) {
+
+	savedCfg, savedCmd, savedReport := cfg, command, runReport
+	defer func() { cfg, command, runReport = savedCfg, savedCmd, savedReport }()
+	cfg = &Config{Rally: "rblr", Year: "25"}
+	command = findCommand("build")
+
+	warning := EntrantWarning{Code: "nok-is-rider", Severity: SeverityWarning, Entrant: "2", Message: "own contact"}
+	info := EntrantWarning{Code: "bike-unknown", Severity: SeverityInfo, Entrant: "3", Message: "odd bike"}
+	problem := errors.New("no such table: entrants")
+
+	tables := []struct {
+		name     string
+		warnings []EntrantWarning
+		code     int
+		err      error
+		clean    bool
+		msg      string
+	}{
+		{"clean", nil, ExitOK, nil, true, ""},
+		{"info only", []EntrantWarning{info}, ExitOK, nil, true, ""},
+		{"warning", []EntrantWarning{info, warning}, ExitOK, nil, false, ""},
+		{"failed", nil, ExitConfig, problem, false, "no such table: entrants"},
+		{"error ignored", nil, ExitOK, problem, true, ""},
+	}
+	for _, table := range tables {
+		runReport = NewRunReport()
+		runReport.Warnings = append(runReport.Warnings, table.warnings...)
+		runReport.Output("rblr.xlsx")
+		runReport.CountTotals(&Totals{NumRiders: 6, NumPillions: 1, NumWithdrawn: 1})
+
+		path := filepath.Join(t.TempDir(), "report.json")
+		if err := runReport.Write(path, table.code, table.err); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res RunReport
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Clean != table.clean || res.ExitCode != table.code || res.Error != table.msg {
+			t.Errorf("%v gives clean %v exit %v error %q", table.name, res.Clean, res.ExitCode, res.Error)
+		}
+		if res.Command != "build" || res.Rally != "rblr" || res.Year != "25" {
+			t.Errorf("%v reports %q for %q %q", table.name, res.Command, res.Rally, res.Year)
+		}
+		if res.Counts["riders"] != 6 || res.Counts["withdrawn"] != 1 || len(res.Warnings) != len(table.warnings) ||
+			len(res.Outputs) != 1 || res.Finished.Before(res.Started) {
+			t.Errorf("%v reports %v, %d warnings, outputs %v", table.name, res.Counts, len(res.Warnings), res.Outputs)
+		}
+	}
+}
+
+func TestForms(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &Config{Rally: "rblr", Year: "25", Novice: "novice", Tshirts: []string{"M", "L", "XL"}}
+
+	for _, f := range defaultFormFields {
+		if _, ok := formFields[f]; !ok {
+			t.Errorf("default form field %v is not recognised", f)
+		}
+	}
+
+	solo := Entrant{Entrantid: "7", RiderFirst: "Mary-Jane", RiderLast: "Smith", RiderNovice: "Y",
+		Phone: "07700 900123", OdoKms: "K", Tshirt1: "L", Tshirt2: "XL"}
+	duo := solo
+	duo.PillionFirst, duo.PillionIBA = "John", "12345"
+	duo.OdoKms, duo.Tshirt2 = "M", "XXXL"
+
+	tables := []struct {
+		fields []string
+		e      Entrant
+		rows   string
+	}{
+		{[]string{"entrant", "rider", "pillion", "pillioniba"}, solo, "Entrant number=7|Rider=Mary-Jane Smith"},
+		{[]string{"entrant", "rider", "pillion", "pillioniba"}, duo, "Entrant number=7|Rider=Mary-Jane Smith|Pillion=John|Pillion IBA #=12345"},
+		{[]string{"RiderNovice", "phone"}, solo, "Novice=Yes|Mobile=07700 900123"},
+		{[]string{"odo", "tshirts"}, solo, "Odometer counts=Kilometres|T-shirts=L + XL"},
+		{[]string{"odo", "tshirts"}, duo, "Odometer counts=Miles|T-shirts=L"},
+		{nil, solo, ""},
+	}
+	for _, table := range tables {
+		var rows []string
+		for _, r := range formRows(table.fields, table.e) {
+			rows = append(rows, r[0]+"="+r[1])
+		}
+		if res := strings.Join(rows, "|"); res != table.rows {
+			t.Errorf("%v gives %q, expected %q", table.fields, res, table.rows)
+		}
+	}
+
+	pdfname := filepath.Join(t.TempDir(), "forms.pdf")
+	if err := writeForms(pdfname, []Entrant{solo, duo}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(pdfname); err != nil || fi.Size() == 0 {
+		t.Errorf("forms not written %v", err)
+	}
+
+	// A form too long for the page carries on over the next
+	cfg.Forms.Disclaimer = []string{strings.Repeat("I will not ride on the pavement. ", 300)}
+	pdf, err := formsPDF([]Entrant{solo, duo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pdf.PageCount() < 4 {
+		t.Errorf("2 long forms take %v pages", pdf.PageCount())
+	}
+
+	cfg.Forms.Fields = []string{"rider", "shoesize"}
+	if err := writeForms(pdfname, []Entrant{solo}); err == nil {
+		t.Error("unknown form field accepted")
+	}
+}
+
+func TestLabels(t *testing.T) {
+
+	mm := func(f float64) string { return fmt.Sprintf("%.1f", f) }
+
+	layouts := []struct {
+		w, h   float64
+		qs, cw string
+	}{
+		{63.5, 38.1, "32.1", "22.4"},
+		{99.1, 38.1, "32.1", "58.0"}, // Avery L7163
+		{50, 38.1, "0.0", "44.0"},    // Too narrow for the QR code and text
+		{40, 10, "4.0", "27.0"},
+		{40, 6, "0.0", "34.0"},
+	}
+	for _, l := range layouts {
+		qs, cw := badgeLayout(l.w, l.h)
+		if mm(qs) != l.qs || mm(cw) != l.cw {
+			t.Errorf("%vx%v gives QR %v text %v, expected %v %v", l.w, l.h, mm(qs), mm(cw), l.qs, l.cw)
+		}
+	}
+
+	sheets := []struct {
+		name           string
+		in             LabelSheet
+		columns        int
+		hpitch, vpitch string
+		ok             bool
+	}{
+		{"default", LabelSheet{}, 2, "101.6", "38.1", true},
+		{"no rows", LabelSheet{Columns: 3, Width: 70, Height: 37}, 2, "101.6", "38.1", true},
+		{"pitch too small", LabelSheet{Columns: 3, Rows: 8, Width: 70, Height: 37, HPitch: 50}, 3, "70.0", "37.0", true},
+		{"pitch kept", LabelSheet{Columns: 3, Rows: 8, Width: 63.5, Height: 33.9, HPitch: 66, VPitch: 34}, 3, "66.0", "34.0", true},
+		{"too narrow", LabelSheet{Columns: 1, Rows: 1, Width: 5, Height: 30}, 1, "5.0", "30.0", false},
+		{"too short", LabelSheet{Columns: 1, Rows: 1, Width: 50, Height: 6}, 1, "50.0", "6.0", false},
+		{"too wide for the paper", LabelSheet{Columns: 3, Rows: 7, Width: 70, Height: 37, Left: 5}, 3, "70.0", "37.0", false},
+		{"too tall for the paper", LabelSheet{Columns: 3, Rows: 8, Width: 70, Height: 37, Top: 5}, 3, "70.0", "37.0", false},
+		{"fits bigger paper", LabelSheet{Paper: "A3", Columns: 4, Rows: 8, Width: 70, Height: 37, Left: 5, Top: 5}, 4, "70.0", "37.0", true},
+		{"unknown paper", LabelSheet{Paper: "Foolscap", Columns: 1, Rows: 1, Width: 50, Height: 30}, 1, "50.0", "30.0", false},
+	}
+	for _, s := range sheets {
+		sheet, err := s.in.checked()
+		if (err == nil) != s.ok {
+			t.Errorf("%v: error %v", s.name, err)
+			continue
+		}
+		if sheet.Columns != s.columns || mm(sheet.HPitch) != s.hpitch || mm(sheet.VPitch) != s.vpitch {
+			t.Errorf("%v gives %v columns at %v x %v", s.name, sheet.Columns, mm(sheet.HPitch), mm(sheet.VPitch))
+		}
+	}
+}
+
+// The benchmarks show the cost of tidying each entrant, as paid on every
+// pass in watch mode: go test -run XXX -bench .
+
+var benchBikes = []string{"honda cbf1000", "BMW R1250GSA", "royal enfield himalayan", "2005 suzuki bandit 1200", "Triumph Tiger 800 XC"}
+var benchNames = []string{"BOB", "STAMMERS", "mary-jane", "o'sullivan", "McCrea", "de la Cruz"}
+
+func BenchmarkProperBike(b *testing.B) {
+
+	for i := 0; i < b.N; i++ {
+		properBike(benchBikes[i%len(benchBikes)])
+	}
+}
+
+func BenchmarkProperBikeUncached(b *testing.B) {
+
+	n, _ := NewNormaliser(words)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.properBike(benchBikes[i%len(benchBikes)])
+	}
+}
+
+func BenchmarkProperName(b *testing.B) {
+
+	for i := 0; i < b.N; i++ {
+		properName(benchNames[i%len(benchNames)])
+	}
+}
+
+func BenchmarkIntval(b *testing.B) {
+
+	for i := 0; i < b.N; i++ {
+		intval("£30.00")
+	}
+}
+
+// BenchmarkEntrant tidies the details of one entrant as mainloop does
+func BenchmarkEntrant(b *testing.B) {
+
+	saved := bikeCatalogue
+	defer func() { bikeCatalogue = saved }()
+	var err error
+	if bikeCatalogue, err = NewBikeCatalogue(words.BikeFile); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := Entrant{Entrantid: "1", Address1: "1 High Street", Town: "York", County: "n yorks", Postcode: "yo17hh"}
+		e.RiderFirst = properName(benchNames[i%len(benchNames)])
+		e.RiderLast = properName(benchNames[(i+1)%len(benchNames)])
+		e.PillionFirst = properName(benchNames[(i+2)%len(benchNames)])
+		e.NokName = properName("JANE STAMMERS")
+		e.BikeMake, e.BikeModel = resolveBike(e.Entrantid, benchBikes[i%len(benchBikes)])
+		e.BikeReg = ParsePlate("ab12cde", e.Country).Normalised
+		e.Phone = ParsePhone("07700 900123", e.Country).Value()
+		e.NokPhone = ParsePhone("07700 900456", e.Country).Value()
+		checkAddress(&e)
+	}
+}
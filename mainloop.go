@@ -1,30 +1,29 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
-	"log"
-	"regexp"
+	"log/slog"
 	"strconv"
 	"strings"
 
 	"github.com/xuri/excelize/v2"
 )
 
-func mainloop() {
+// mainloop writes every entrant to the exports and, given a transaction,
+// the RBLR database
+func mainloop(rtx *sql.Tx) error {
 
 	//fmt.Println(sqlx)
 	rows1, err1 := db.Query(sqlx)
 	if err1 != nil {
-		log.Fatal(err1)
+		return failWith(ExitDatabase, err1)
 	}
+	defer rows1.Close()
 	totx.srow = 2 // First spreadsheet row to populate
 
 	var tshirts [max_tshirt_sizes]int
 
-	if rblrdb != nil {
-		rblrdb.Exec("BEGIN")
-	}
-
 	for rows1.Next() {
 		var RiderFirst string
 		var RiderLast string
@@ -35,21 +34,19 @@ func mainloop() {
 		var Miles string
 		var Camp, Route, T1, T2, Patches string
 		var Mobile, NokName, NokNumber, NokRelation string
-		var PayTot string
+		var PayTot, PayCurrency string
 		var Sponsor, Paid, Cash string
 		var novicerider, novicepillion string
 		var miles2squires, freecamping string
 		var entrantid int
-		var feesdue int = 0
+		var feesdue Money = 0
 		var odocounts string
-		var isFOC bool = false
 		var withdrawn string
 		var isWithdrawn bool = false
-		var isCancelled bool = false
+		var isCancelled bool = false // Not counted, whatever the status
 		var hasPillionVal string
 		var hasPillion bool = false
-		var NokRiderClash bool = false
-		var NokPillionClash bool = false
+		var NokNameClash bool = false
 		var NokMobileClash bool = false
 
 		// Entrant record for export
@@ -66,38 +63,26 @@ func mainloop() {
 				&Mobile, &NokName, &NokNumber, &NokRelation, &entrantid, &PayTot, &Sponsor, &Paid, &novicerider, &novicepillion,
 				&odocounts, &e.BikeReg, &miles2squires, &freecamping,
 				&e.Address1, &e.Address2, &e.Town, &e.County, &e.Postcode, &e.Country,
-				&e.Email, &e.Phone, &e.EnteredDate, &withdrawn, &hasPillionVal)
+				&e.Email, &e.Phone, &e.EnteredDate, &withdrawn, &hasPillionVal, &PayCurrency)
 		} else {
 			err2 = rows1.Scan(&RiderFirst, &RiderLast, &RiderIBA, &PillionFirst, &PillionLast, &PillionIBA,
 				&Bike, &T1, &T2,
 				&Mobile, &NokName, &NokNumber, &NokRelation, &entrantid, &PayTot, &Paid, &novicerider, &novicepillion, &odocounts,
 				&e.BikeReg, &e.Address1, &e.Address2, &e.Town, &e.County, &e.Postcode, &e.Country,
-				&e.Email, &e.Phone, &e.EnteredDate, &withdrawn, &hasPillionVal)
+				&e.Email, &e.Phone, &e.EnteredDate, &withdrawn, &hasPillionVal, &PayCurrency)
 		}
 		if err2 != nil {
-			log.Fatalf("mainloop/err2 %v\n", err2)
+			return failWith(ExitDatabase, fmt.Errorf("mainloop/err2 %w", err2))
 		}
 
-		isFOC = Paid == "Refunded"
-		isCancelled = Paid == "Cancelled"
+		state, policy := paymentState(Paid)
+		isCancelled = !policy.Counted
 		isWithdrawn = withdrawn == "Withdrawn"
 		hasPillion = strings.ToLower(hasPillionVal) != "no pillion" && hasPillionVal != ""
 
 		//fmt.Printf("[ %v ] = %v \n", hasPillionVal, hasPillion)
 
-		Bike = properMake2(Bike)
-		Bike = properBike(Bike)
-		if words.DefaultRE != "" {
-			re := regexp.MustCompile(words.DefaultRE)
-			if re.MatchString(Bike) {
-				Make = words.DefaultBike
-				Model = ""
-			} else {
-				Make, Model = extractMakeModel(Bike)
-			}
-		} else {
-			Make, Model = extractMakeModel(Bike)
-		}
+		Make, Model = resolveBike(strconv.Itoa(entrantid), Bike)
 		if Make != words.DefaultBike && Model == "" {
 			Model = words.DefaultBike
 		}
@@ -107,13 +92,11 @@ func mainloop() {
 		e.RiderLast = properName(RiderLast)
 		if isWithdrawn {
 			tot.NumWithdrawn++
-			if *verbose {
-				fmt.Printf("    Rider %v %v [#%v] is withdrawn\n", e.RiderFirst, e.RiderLast, e.Entrantid)
-			}
+			slog.Debug("Rider is withdrawn", "entrant", e.Entrantid, "name", e.RiderFirst+" "+e.RiderLast)
 			e.RiderLast += " (PROV)"
 			continue
-		} else if *verbose && Paid != "Completed" {
-			fmt.Printf("    Rider %v %v [#%v] has payment status = %v\n", e.RiderFirst, e.RiderLast, e.Entrantid, Paid)
+		} else if state != statePaid {
+			slog.Debug("Rider has not completed payment", "entrant", e.Entrantid, "name", e.RiderFirst+" "+e.RiderLast, "status", Paid, "state", state)
 		}
 		e.RiderIBA = fmtIBA(RiderIBA)
 		e.RiderRBL = fmtRBL(RiderRBL)
@@ -131,13 +114,27 @@ func mainloop() {
 		e.BikeModel = Model
 		e.OdoKms = fmtOdoKM(odocounts)
 
-		e.BikeReg = strings.ToUpper(e.BikeReg)
-		e.Postcode = strings.ToUpper(e.Postcode)
+		plate := ParsePlate(e.BikeReg, e.Country)
+		if plate.Problem != "" {
+			warnEntrant("reg-invalid", e.Entrantid, "BikeReg", "%v %v's registration %v %v", e.RiderFirst, e.RiderLast, plate.Entered, plate.Problem)
+		}
+		e.BikeReg = plate.Normalised
+		checkAddress(&e)
 
 		e.NokName = properName(NokName)
-		e.NokPhone = NokNumber
 		e.NokRelation = properName(NokRelation)
 
+		mobile := ParsePhone(Mobile, e.Country)
+		if mobile.Problem != "" {
+			warnEntrant("phone-invalid", e.Entrantid, "Phone", "Rider %v %v's mobile %v %v", e.RiderFirst, e.RiderLast, mobile.Entered, mobile.Problem)
+		}
+		e.Phone, e.phoneNumber = mobile.String(), mobile
+		nokPhone := ParsePhone(NokNumber, e.Country)
+		if nokPhone.Problem != "" {
+			warnEntrant("phone-invalid", e.Entrantid, "NokPhone", "Emergency contact number %v for %v %v %v", nokPhone.Entered, e.RiderFirst, e.RiderLast, nokPhone.Problem)
+		}
+		e.NokPhone, e.nokPhoneNumber = nokPhone.String(), nokPhone
+
 		e.RouteClass = Route
 		e.Tshirt1 = T1
 		e.Tshirt2 = T2
@@ -146,9 +143,9 @@ func mainloop() {
 		e.Miles2Squires = strconv.Itoa(intval(miles2squires))
 		e.Bike = fmt.Sprintf("%v %v", e.BikeMake, e.BikeModel)
 
-		ss := intval(Sponsor)
+		ss := moneyval(Sponsor)
 		if ss > 0 {
-			e.Sponsorship = strconv.Itoa(ss)
+			e.Sponsorship = ss.Number()
 		}
 
 		if !*noLookup {
@@ -157,7 +154,9 @@ func mainloop() {
 
 		if *rally == "rblr" {
 			rblre := BuildRBLR(e)
-			writeRBLR(&rblre)
+			if err := writeRBLR(rtx, &rblre); err != nil {
+				return failWith(ExitDatabase, err)
+			}
 		}
 
 		RiderFirst = properName(e.RiderFirst)
@@ -165,27 +164,26 @@ func mainloop() {
 		PillionFirst = properName(e.PillionFirst)
 		PillionLast = properName(e.PillionLast)
 
-		if isFOC && *verbose {
-			fmt.Printf("    Rider %v %v [#%v] has Paid=%v and is therefore FOC\n", e.RiderFirst, e.RiderLast, e.Entrantid, Paid)
+		if policy.Money == moneyWaived {
+			slog.Debug("Rider is FOC", "entrant", e.Entrantid, "name", e.RiderFirst+" "+e.RiderLast, "status", Paid)
 		}
-		if isCancelled && *verbose {
-			fmt.Printf("    Rider %v %v [#%v] has Paid=%v\n", e.RiderFirst, e.RiderLast, e.Entrantid, Paid)
+		if isCancelled {
+			slog.Debug("Rider is cancelled", "entrant", e.Entrantid, "name", e.RiderFirst+" "+e.RiderLast, "status", Paid, "state", state)
 		}
 
-		if e.RiderFirst+" "+e.RiderLast == e.NokName {
-			fmt.Printf("*** Rider %v [#%v] is the emergency contact (%v)\n", e.NokName, e.Entrantid, e.NokRelation)
-			NokRiderClash = true
-			e.NokName = ""
-		} else if e.PillionFirst+" "+e.PillionLast == e.NokName {
-			fmt.Printf("*** Pillion %v %v [#%v] is the emergency contact (%v)\n", e.PillionFirst, e.PillionLast, e.Entrantid, e.NokRelation)
-			NokPillionClash = true
+		for _, code := range dataRules.Check(&e) {
+			switch code {
+			case "nok-is-rider", "nok-is-pillion":
+				NokNameClash = true
+			case "nok-same-phone":
+				NokMobileClash = true
+			}
+		}
+		if NokNameClash {
 			e.NokName = ""
 		}
-
-		if strings.ReplaceAll(e.Phone, " ", "") == strings.ReplaceAll(e.NokPhone, " ", "") {
-			fmt.Printf("*** Rider %v %v [#%v] has the same mobile as emergency contact %v\n", e.RiderFirst, e.RiderLast, e.Entrantid, e.Phone)
-			NokMobileClash = true
-			e.NokPhone = ""
+		if NokMobileClash {
+			e.NokPhone, e.nokPhoneNumber = "", PhoneNumber{}
 		}
 
 		npatches := intval(Patches)
@@ -193,7 +191,7 @@ func mainloop() {
 
 		ebym := Entrystats{ReportingPeriod(e.EnteredDate), 1, 0, 0, 0, 0}
 
-		if !isCancelled || !cancelsLoseOut {
+		if policy.Merchandise {
 			for i := 0; i < num_tshirt_sizes; i++ {
 				if cfg.Tshirts[i] == T1 {
 					tshirts[i]++
@@ -274,7 +272,7 @@ func mainloop() {
 
 		} // !isCancelled
 
-		if !isCancelled || !cancelsLoseOut {
+		if policy.Merchandise {
 
 			if cfg.Rally == "rblr" {
 				if intval(miles2squires) < tot.LoMiles2Squires {
@@ -300,6 +298,9 @@ func mainloop() {
 				xl.SetRowVisible(chksheet, totx.srow, false)
 				xl.SetRowVisible(regsheet, totx.srow, false)
 				xl.SetRowVisible(noksheet, totx.srow, false)
+			} else if *carparkQR {
+				xl.SetRowHeight(chksheet, totx.srow, 60)
+				addCarparkQR(e.Entrantid, "F"+strconv.Itoa(totx.srow))
 			} else {
 				xl.SetRowHeight(chksheet, totx.srow, 25)
 			}
@@ -354,27 +355,35 @@ func mainloop() {
 
 		}
 
-		cancelledFees := 0
+		var pricing []string // The pricing rules applied
+		member := e.RiderIBA != ""
+		novice := isNovice(novicerider)
 
+		fee, rule := priceOf(Purchase{"rider", e.EnteredDate, member, novice, 1})
 		if !isCancelled {
 			if !*summaryOnly {
 				// Fees on Money tab
-				xl.SetCellInt(paysheet, "D"+totx.srowx, cfg.Riderfee) // Basic entry fee
+				setMoneyCell(paysheet, "D"+totx.srowx, fee) // Basic entry fee
+			}
+			feesdue += fee
+			tot.TotMoneyEntries += fee
+			if rule != "" {
+				pricing = append(pricing, rule)
 			}
-			feesdue += cfg.Riderfee
-		} else {
-			cancelledFees += cfg.Riderfee
 		}
 
 		if PillionFirst != "" && PillionLast != "" {
+			fee, rule := priceOf(Purchase{"pillion", e.EnteredDate, e.PillionIBA != "", isNovice(novicepillion), 1})
 			if !isCancelled {
 				if !*summaryOnly {
-					xl.SetCellInt(paysheet, "E"+totx.srowx, cfg.Pillionfee)
+					setMoneyCell(paysheet, "E"+totx.srowx, fee)
 				}
 				tot.NumPillions++
-				feesdue += cfg.Pillionfee
-			} else {
-				cancelledFees += cfg.Pillionfee
+				feesdue += fee
+				tot.TotMoneyPillions += fee
+				if rule != "" {
+					pricing = append(pricing, rule)
+				}
 			}
 		}
 		var nt int = 0
@@ -382,48 +391,82 @@ func mainloop() {
 			nt += tshirts[i]
 		}
 		if nt > 0 {
-			if !isCancelled || !cancelsLoseOut {
+			each, rule := priceOf(Purchase{"tshirt", e.EnteredDate, member, novice, nt})
+			if policy.Merchandise {
 				if !*summaryOnly {
-					xl.SetCellInt(paysheet, "F"+totx.srowx, cfg.Tshirtcost*nt)
+					setMoneyCell(paysheet, "F"+totx.srowx, each*Money(nt))
+				}
+				feesdue += Money(nt) * each
+				tot.TotMoneyTshirts += Money(nt) * each
+				if rule != "" {
+					pricing = append(pricing, rule)
 				}
-				feesdue += nt * cfg.Tshirtcost
-			} else {
-				cancelledFees += nt * cfg.Tshirtcost
 			}
 		}
 
 		if cfg.Patchavail && npatches > 0 {
-			if !isCancelled || !cancelsLoseOut {
+			each, rule := priceOf(Purchase{"patch", e.EnteredDate, member, novice, npatches})
+			if policy.Merchandise {
 				xl.SetCellInt(overviewsheet, "X"+totx.srowx, npatches) // Overview tab
 
 				if !*summaryOnly {
-					xl.SetCellInt(paysheet, "G"+totx.srowx, npatches*cfg.Patchcost)
+					setMoneyCell(paysheet, "G"+totx.srowx, Money(npatches)*each)
 					xl.SetCellInt(shopsheet, shop_patch_column+totx.srowx, npatches) // Shop tab
 				}
-				feesdue += npatches * cfg.Patchcost
-
-			} else {
-				cancelledFees += npatches * cfg.Patchcost
+				feesdue += Money(npatches) * each
+				tot.TotMoneyPatches += Money(npatches) * each
+				if rule != "" {
+					pricing = append(pricing, rule)
+				}
 			}
 		}
+		if len(pricing) > 0 && !*summaryOnly {
+			xl.SetCellValue(paysheet, "O"+totx.srowx, strings.Join(pricing, ", "))
+		}
 
-		intCash := intval(Cash)
-
-		tot.TotMoneyCashPaypal += intCash
+		cash := moneyval(Cash)
 
-		if isFOC {
-			PayTot = strconv.Itoa(feesdue - intCash)
+		currency := currencyCode(PayCurrency)
+		original := moneyval(PayTot)
+		paid, converted := convertMoney(original, currency)
+		if !converted {
+			warnEntrant("currency-unknown", e.Entrantid, "PaymentTotal", "Paid %v %v but there's no rate for %v", original, currency, currency)
+		}
+		if original != 0 && (policy.Money == moneyFees || policy.Money == moneyDonation) {
+			ct := tot.Currencies[currency]
+			if ct == nil {
+				ct = &CurrencyTotal{}
+				tot.Currencies[currency] = ct
+			}
+			ct.Count++
+			ct.Paid += original
+			ct.Converted += paid
+			if !*summaryOnly {
+				setMoneyCell(paysheet, "L"+totx.srowx, original)
+				xl.SetCellValue(paysheet, "M"+totx.srowx, currency)
+				setMoneyCell(paysheet, "N"+totx.srowx, paid)
+			}
+		}
+		switch policy.Money {
+		case moneyWaived:
+			paid = feesdue - cash
+		case moneyRefund:
+			paid, cash = 0, 0
 		}
 
-		Sponsorship := 0 /* cancelledFees - PW 2024-07-18 */
+		var Sponsorship Money = 0
 
-		tot.TotMoneyMainPaypal += intval(PayTot)
+		tot.TotMoneyCashPaypal += cash
+		tot.TotMoneyMainPaypal += paid
 
-		due := (intval(PayTot) + intCash) - feesdue
+		due := (paid + cash) - feesdue
+		if policy.Money == moneyRefund {
+			due = 0
+		}
 
 		if cfg.Sponsorship {
 			// This extracts a number if present from either "Include ..." or "I'll bring ..."
-			Sponsorship += intval(Sponsor) // "50"
+			Sponsorship += moneyval(Sponsor) // "50"
 
 			due -= Sponsorship
 			if due > 0 {
@@ -436,51 +479,54 @@ func mainloop() {
 			if !*summaryOnly {
 				if *safemode {
 					if Sponsorship != 0 {
-						xl.SetCellInt(paysheet, "I"+totx.srowx, Sponsorship)
+						setMoneyCell(paysheet, "I"+totx.srowx, Sponsorship)
 						if cfg.Rally == "rblr" {
-							xl.SetCellInt(subssheet, "D"+totx.srowx, Sponsorship)
+							setMoneyCell(subssheet, "D"+totx.srowx, Sponsorship)
 						}
 					}
-					xl.SetCellInt(paysheet, "J"+totx.srowx, intCash+intval(PayTot))
+					setMoneyCell(paysheet, "J"+totx.srowx, cash+paid)
 				} else {
-					sf := "H" + totx.srowx + "+" + strconv.Itoa(Sponsorship)
+					sf := "H" + totx.srowx + "+" + Sponsorship.Number()
 					xl.SetCellFormula(paysheet, "I"+totx.srowx, "if("+sf+"=0,\"0\","+sf+")")
-					xl.SetCellFormula(paysheet, "J"+totx.srowx, "H"+totx.srowx+"+"+strconv.Itoa(intCash)+"+"+strconv.Itoa(intval(PayTot)))
+					xl.SetCellFormula(paysheet, "J"+totx.srowx, "H"+totx.srowx+"+"+cash.Number()+"+"+paid.Number())
 				}
 
 			} else {
-				xl.SetCellInt(paysheet, "J"+totx.srowx, intval(PayTot))
+				setMoneyCell(paysheet, "J"+totx.srowx, paid)
 			}
 
 		}
+		if policy.Money == moneyDonation && due > 0 && !cfg.Sponsorship {
+			tot.TotMoneySponsor += due // Kept rather than owed back
+			due = 0
+		}
 		if !*summaryOnly {
-			if Paid == "Unpaid" && true {
+			if state == statePending {
 				xl.SetCellValue(paysheet, "K"+totx.srowx, " UNPAID")
 				xl.SetCellStyle(paysheet, "K"+totx.srowx, "K"+totx.srowx, styleW)
 			} else if !*safemode {
 				ff := "J" + totx.srowx + "-(sum(D" + totx.srowx + ":G" + totx.srowx + ")+I" + totx.srowx + ")"
 				xl.SetCellFormula(paysheet, "K"+totx.srowx, "if("+ff+"=0,\"\","+ff+")")
 			} else {
-				//due := (intval(PayTot) + intCash) - (feesdue + Sponsorship)
 				if due != 0 {
-					xl.SetCellInt(paysheet, "K"+totx.srowx, due)
+					setMoneyCell(paysheet, "K"+totx.srowx, due)
 				}
 			}
 		}
 
 		if !*summaryOnly {
 			// NOK List
-			xl.SetCellValue(noksheet, "D"+totx.srowx, trimPhone(Mobile))
+			xl.SetCellValue(noksheet, "D"+totx.srowx, mobile.String())
 			xl.SetCellStyle(noksheet, "B"+totx.srowx, "H"+totx.srowx, styleV2L)
 
 			if !isCancelled {
 				xl.SetCellValue(noksheet, "E"+totx.srowx, properName(NokName))
 				xl.SetCellValue(noksheet, "F"+totx.srowx, properName(NokRelation))
-				xl.SetCellValue(noksheet, "G"+totx.srowx, trimPhone(NokNumber))
+				xl.SetCellValue(noksheet, "G"+totx.srowx, nokPhone.String())
 				if NokMobileClash {
 					xl.SetCellStyle(noksheet, "G"+totx.srowx, "G"+totx.srowx, styleCancel)
 				}
-				if NokRiderClash || NokPillionClash {
+				if NokNameClash {
 					xl.SetCellStyle(noksheet, "E"+totx.srowx, "E"+totx.srowx, styleCancel)
 				}
 			}
@@ -495,6 +541,9 @@ func mainloop() {
 				xl.SetCellValue(regsheet, "H"+totx.srowx, e.BikeReg)
 			}
 		}
+		if key := plate.Key(); key != "" && !plate.Pending && !isCancelled {
+			tot.Plates[key] = append(tot.Plates[key], PlateUse{plate.Normalised, e.Entrantid, e.RiderFirst + " " + e.RiderLast, totx.srow})
+		}
 		// Overview
 		xl.SetCellValue(overviewsheet, "D"+totx.srowx, fmtIBA(e.RiderIBA))
 
@@ -513,7 +562,7 @@ func mainloop() {
 
 		xl.SetCellValue(overviewsheet, "K"+totx.srowx, Miles)
 
-		if Camp == "Yes" && cfg.Rally == "rblr" && (!isCancelled || !cancelsLoseOut) {
+		if Camp == "Yes" && cfg.Rally == "rblr" && policy.Merchandise {
 			xl.SetCellValue(overviewsheet, "L"+totx.srowx, "Y")
 		}
 		var cols string = "MNOPQR"
@@ -560,14 +609,17 @@ func mainloop() {
 		if exportingEmail && !isWithdrawn && !isCancelled {
 			csvEmail.Write(Entrant2Email(e))
 		}
-		if exportingGmail && !isWithdrawn && !isCancelled {
-			csvGmail.Write(Entrant2Gmail(e))
+		if !isWithdrawn && !isCancelled {
+			entrantList = append(entrantList, e)
+			for _, c := range contactExports {
+				if err := c.WriteContact(e); err != nil {
+					slog.Error("Contact not written", "kind", c.Name(), "entrant", e.Entrantid, "err", err)
+				}
+			}
 		}
 
 	} // End reading loop
 
-	if rblrdb != nil {
-		rblrdb.Exec("COMMIT")
-	}
-
+	runReport.CountTotals(tot)
+	return rows1.Err()
 }
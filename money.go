@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Money is held in minor units, pence for sterling, so that fees, totals
+// and PayPal payments add up to the penny. Amounts are read from whatever
+// people and payment systems write: "£12.50", "12,50", "GBP 1,250.00",
+// "(5.00)" and so on.
+
+// Money is an amount in minor units
+type Money int64
+
+// currencyMarks are the symbols and codes that may come with an amount
+var currencyMarks = []string{"£", "$", "€", "¥", "GBP", "EUR", "USD", "CHF", "SEK", "NOK", "DKK", "AUD", "CAD", "NZD"}
+
+// ParseMoney reads an amount that's nothing but an amount
+func ParseMoney(s string) (Money, error) {
+
+	x := strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(x, "(") && strings.HasSuffix(x, ")") { // Accountants' negative
+		neg = true
+		x = x[1 : len(x)-1]
+	}
+	for _, c := range currencyMarks {
+		x = strings.ReplaceAll(strings.ReplaceAll(x, c, ""), strings.ToLower(c), "")
+	}
+	x = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, x)
+	if after, ok := strings.CutPrefix(x, "-"); ok {
+		neg = !neg
+		x = after
+	} else {
+		x = strings.TrimPrefix(x, "+")
+	}
+	if x == "" {
+		return 0, fmt.Errorf("%q has no amount", s)
+	}
+	m, err := parseAmount(x)
+	if err != nil {
+		return 0, fmt.Errorf("%q %w", s, err)
+	}
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+// parseAmount reads digits with thousands and decimal separators. With
+// both , and . the last is the decimal point. With just one of them it's
+// the decimal point unless it's followed by three digits, as in 1,250.
+func parseAmount(x string) (Money, error) {
+
+	if strings.Trim(x, "0123456789.,") != "" {
+		return 0, errors.New("isn't an amount")
+	}
+	dot, comma := strings.LastIndex(x, "."), strings.LastIndex(x, ",")
+	point := max(dot, comma)
+	if dot < 0 || comma < 0 {
+		sep := x[point+1:]
+		if point >= 0 && (len(sep) == 3 || strings.Count(x, x[point:point+1]) > 1) {
+			point = -1 // Thousands
+		}
+	}
+	whole, frac := x, ""
+	if point >= 0 {
+		whole, frac = x[:point], x[point+1:]
+	}
+	whole = strings.NewReplacer(",", "", ".", "").Replace(whole)
+	if strings.ContainsAny(frac, ".,") {
+		return 0, errors.New("has separators in the wrong place")
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	pounds, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, errors.New("isn't an amount")
+	}
+	pence := 0.0
+	if frac != "" {
+		f, _ := strconv.ParseFloat("0."+frac, 64)
+		pence = math.Round(f * 100)
+	}
+	return Money(pounds*100 + int64(pence)), nil
+}
+
+// moneyval finds the first amount in some text, eg "Include £50 in my
+// payment", or zero. Like intval it never fails.
+func moneyval(s string) Money {
+
+	start := strings.IndexFunc(s, unicode.IsDigit)
+	if start < 0 {
+		return 0
+	}
+	end := start
+	for end < len(s) && strings.ContainsRune("0123456789.,", rune(s[end])) {
+		end++
+	}
+	num := strings.TrimRight(s[start:end], ".,")
+	m, err := parseAmount(num)
+	if err != nil {
+		return 0
+	}
+	before := strings.TrimRight(s[:start], " £$€")
+	for _, c := range currencyMarks {
+		before = strings.TrimSuffix(strings.TrimRight(before, " "), c)
+	}
+	if strings.HasSuffix(strings.TrimSpace(before), "-") || strings.HasSuffix(strings.TrimSpace(before), "(") {
+		m = -m
+	}
+	return m
+}
+
+// String gives the amount with two decimal places, eg 12.50
+func (m Money) String() string {
+
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%v%d.%02d", sign, m/100, m%100)
+}
+
+// Number gives the amount as briefly as possible, eg 12.5 or 30, for
+// spreadsheet formulas
+func (m Money) Number() string {
+	return strconv.FormatFloat(m.Float(), 'f', -1, 64)
+}
+
+// Float gives the amount in major units
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+// UnmarshalYAML reads fees given in the configuration as 25, 12.50 or "£12.50"
+func (m *Money) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	x, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = x
+	return nil
+}
+
+// setMoneyCell puts an amount in a spreadsheet cell as a number
+func setMoneyCell(sheet, cell string, m Money) {
+	xl.SetCellFloat(sheet, cell, m.Float(), -1, 64)
+}
+
+// Entrants from abroad pay in their own currency, given by Payment_Currency.
+// Amounts are converted to the event's currency using the rates in the
+// configuration, each the value of one unit of that currency in the
+// event's, eg EUR: 0.85. Both are shown on the Money tab.
+
+// CurrencyTotal is what was paid in one currency
+type CurrencyTotal struct {
+	Count     int
+	Paid      Money // In the currency itself
+	Converted Money // In the event's currency
+}
+
+// currencyCode tidies a currency as given, blank meaning the event's own
+func currencyCode(c string) string {
+
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if c == "" {
+		return cfg.Currency
+	}
+	return c
+}
+
+// convertMoney gives an amount paid in currency in the event's currency.
+// It's false if there's no rate for the currency, when the amount is
+// returned unchanged.
+func convertMoney(m Money, currency string) (Money, bool) {
+
+	if currency == cfg.Currency {
+		return m, true
+	}
+	rate, ok := cfg.Rates[currency]
+	if !ok {
+		return m, false
+	}
+	return Money(math.Round(float64(m) * rate)), true
+}
+
+// checkRates makes sure the rate table makes sense
+func checkRates(rates map[string]float64) error {
+
+	for c, r := range rates {
+		if c != strings.ToUpper(c) || len(c) != 3 {
+			return fmt.Errorf("rates: %q should be a three letter currency code such as EUR", c)
+		}
+		if r <= 0 {
+			return fmt.Errorf("rates: %v rate %v should be more than zero", c, r)
+		}
+	}
+	return nil
+}
+
+// writeCurrencyTotals breaks down the payments on the Money tab by
+// currency, starting at row, if they weren't all in the event's currency
+func writeCurrencyTotals(row int) {
+
+	if len(tot.Currencies) < 2 && tot.Currencies[cfg.Currency] != nil {
+		return
+	}
+	codes := make([]string, 0, len(tot.Currencies))
+	for c := range tot.Currencies {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		ct := tot.Currencies[c]
+		rx := strconv.Itoa(row)
+		xl.SetCellValue(paysheet, "K"+rx, fmt.Sprintf("%v payment(s) in %v", ct.Count, c))
+		setMoneyCell(paysheet, "L"+rx, ct.Paid)
+		xl.SetCellValue(paysheet, "M"+rx, c)
+		setMoneyCell(paysheet, "N"+rx, ct.Converted)
+		xl.SetCellStyle(paysheet, "K"+rx, "N"+rx, styleT)
+		row++
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Names and bikes are tidied using the word lists in reglist.yml. Everything
+// those need, the regular expressions in particular, is prepared once when
+// the lists are loaded and the results remembered, as the same names and
+// bikes come round on every pass in watch mode and in the dashboard.
+
+// bikeWord is one of the bikewords with its expressions ready compiled
+type bikeWord struct {
+	word      string
+	alone     *regexp.Regexp // A word on its own
+	afterSize *regexp.Regexp // Or right after an engine size, eg 1200GS
+}
+
+// Normaliser tidies names and bikes as set out by a Words
+type Normaliser struct {
+	words     *Words
+	bikewords []bikeWord
+	specials  map[string]string // Keyed in lower case
+	defaultRE *regexp.Regexp
+
+	mu    sync.Mutex
+	names map[string]string
+	bikes map[string]string
+}
+
+// NewNormaliser prepares the word lists. A bad defaultre is reported but
+// the Normaliser returned is still usable, treating no bike as unknown.
+func NewNormaliser(w *Words) (*Normaliser, error) {
+
+	n := &Normaliser{
+		words:    w,
+		specials: make(map[string]string),
+		names:    make(map[string]string),
+		bikes:    make(map[string]string),
+	}
+	for _, e := range w.Bikewords {
+		n.bikewords = append(n.bikewords, bikeWord{
+			word:      e,
+			alone:     regexp.MustCompile(`(?i)(.*)\b(` + e + `)\b(.*)`),
+			afterSize: regexp.MustCompile(`(?i)(.*)(0` + e + `)\b(.*)`),
+		})
+	}
+	for _, s := range w.Specialnames {
+		n.specials[strings.ToLower(s)] = s
+	}
+	if w.DefaultRE != "" {
+		re, err := regexp.Compile(w.DefaultRE)
+		if err != nil {
+			return n, err
+		}
+		n.defaultRE = re
+	}
+	return n, nil
+}
+
+var normaliserMu sync.Mutex
+var normaliser *Normaliser
+
+// textNormaliser returns the Normaliser for the current word lists,
+// preparing it again if they've been reloaded
+func textNormaliser() *Normaliser {
+
+	normaliserMu.Lock()
+	defer normaliserMu.Unlock()
+	if normaliser == nil || normaliser.words != words {
+		normaliser, _ = NewNormaliser(words) // loadConfig has already reported any error
+	}
+	return normaliser
+}
+
+// IsDefault says whether s is one of the ways of saying "don't know yet"
+// matched by defaultre
+func (n *Normaliser) IsDefault(s string) bool {
+	return n.defaultRE != nil && n.defaultRE.MatchString(s)
+}
+
+// ProperName capitalises a name given all in one case
+func (n *Normaliser) ProperName(x string) string {
+
+	n.mu.Lock()
+	res, ok := n.names[x]
+	n.mu.Unlock()
+	if ok {
+		return res
+	}
+	res = n.properName(x)
+	n.mu.Lock()
+	n.names[x] = res
+	n.mu.Unlock()
+	return res
+}
+
+func (n *Normaliser) properName(x string) string {
+
+	var xx = strings.TrimSpace(x)
+	if strings.ToUpper(xx) != xx && strings.ToLower(xx) != xx {
+		return xx // Mixed case is taken to be as the person wants it
+	}
+	w := strings.Fields(xx)
+	particles := particleRuns(w)
+	for i := range w {
+		if wy, ok := n.specials[strings.ToLower(w[i])]; ok {
+			w[i] = wy
+			continue
+		}
+		if !n.words.Propernames {
+			continue
+		}
+		lw := strings.ToLower(w[i])
+		if particles[i] {
+			w[i] = lw
+			continue
+		}
+		parts := strings.Split(lw, "-")
+		for j, p := range parts {
+			if wy, ok := n.specials[p]; ok {
+				parts[j] = wy
+			} else {
+				parts[j] = capitaliseName(p)
+			}
+		}
+		w[i] = strings.Join(parts, "-")
+	}
+	return strings.Join(w, " ")
+}
+
+// particleRuns marks the words of a name in runs of two or more particles
+// followed by the rest of the name, as in de la Cruz, which are left in
+// lower case. A lone particle is as often part of the surname, as in Le
+// Sueur, so is left to specialnames.
+func particleRuns(w []string) []bool {
+
+	res := make([]bool, len(w))
+	for i := 0; i < len(w); {
+		j := i
+		for j < len(w)-1 && nameParticles[strings.ToLower(w[j])] {
+			j++
+		}
+		for k := i; k < j && j-i >= 2; k++ {
+			res[k] = true
+		}
+		i = j + 1
+	}
+	return res
+}
+
+// nameParticles are left in lower case within a name when two or more
+// come together
+var nameParticles = map[string]bool{
+	"van": true, "von": true, "der": true, "den": true, "de": true, "del": true, "della": true,
+	"di": true, "da": true, "dos": true, "das": true, "du": true, "des": true, "la": true,
+	"le": true, "ter": true, "ten": true, "bin": true, "ibn": true, "y": true,
+}
+
+// macExceptions are names starting Mac that aren't MacSomething
+var macExceptions = map[string]bool{
+	"mace": true, "macey": true, "macy": true, "mack": true, "mackie": true, "mackle": true,
+	"macklin": true, "machin": true, "machado": true, "macias": true, "macedo": true,
+	"machen": true, "machon": true, "macken": true, "mackey": true, "macho": true,
+	"macaulay": true, "macari": true, "macchi": true,
+}
+
+// capitaliseName capitalises one lower case word or hyphenated part of a
+// name, following the usual patterns of O'Brien, McCrea and MacDonald
+func capitaliseName(p string) string {
+
+	r := []rune(p)
+	switch {
+	case len(r) > 2 && (r[1] == '\'' || r[1] == '’') && strings.ContainsRune("odl", r[0]):
+		return string(unicode.ToUpper(r[0])) + string(r[1]) + capitaliseName(string(r[2:]))
+	case len(r) > 2 && strings.HasPrefix(p, "mc"):
+		return "Mc" + capitaliseName(string(r[2:]))
+	case len(r) > 5 && strings.HasPrefix(p, "mac") && !macExceptions[p]:
+		return "Mac" + capitaliseName(string(r[3:]))
+	case len(r) > 0:
+		return string(unicode.ToTitle(r[0])) + string(r[1:])
+	}
+	return p
+}
+
+// ProperBike gives the bikewords in a bike description their proper case
+func (n *Normaliser) ProperBike(x string) string {
+
+	n.mu.Lock()
+	res, ok := n.bikes[x]
+	n.mu.Unlock()
+	if ok {
+		return res
+	}
+	res = n.properBike(x)
+	n.mu.Lock()
+	n.bikes[x] = res
+	n.mu.Unlock()
+	return res
+}
+
+func (n *Normaliser) properBike(x string) string {
+
+	for _, bw := range n.bikewords {
+		if res := bw.alone.FindStringSubmatch(x); res != nil {
+			x = res[1] + bw.word + res[3]
+		} else if res := bw.afterSize.FindStringSubmatch(x); res != nil {
+			x = res[1] + "0" + bw.word + res[3]
+		}
+	}
+	return x
+}
+
+// ProperMake2 fixes two word Makes such as 'Royal Enfield' and 'Moto Guzzi'
+// by replacing the intervening space with an underscore, replaced later in
+// processing
+func (n *Normaliser) ProperMake2(x string) string {
+
+	var xwords = strings.Fields(x)
+	if len(xwords) < 2 {
+		return x
+	}
+	var make2 = strings.Join(xwords[0:2], " ")
+	var model2 = strings.Join(xwords[2:], " ")
+
+	for _, e := range n.words.Bikewords {
+		if strings.EqualFold(strings.Replace(e, "-", " ", 1), make2) {
+			return strings.Replace(e, " ", "_", 1) + " " + model2
+		}
+	}
+	return x
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Phone numbers are stored in E.164 form, +countrycode then the national
+// number without its trunk prefix, so that exports and phone contacts work
+// wherever the entrant lives. Numbers typed without a country code are
+// taken to belong to the entrant's Country, or the UK if that's blank.
+// They're shown the way people are used to reading them.
+
+// dialPlan is what we need to know about numbering in a country
+type dialPlan struct {
+	trunk    string // Prefix dialled before national numbers, dropped in E.164
+	min, max int    // Length of the national significant number
+	first    string // Digits national significant numbers may start with, any if empty
+}
+
+// dialPlans are keyed by country calling code
+var dialPlans = map[string]dialPlan{
+	"1":   {"1", 10, 10, "23456789"}, // North America
+	"27":  {"0", 9, 9, ""},
+	"30":  {"", 10, 10, ""},
+	"31":  {"0", 9, 9, ""},
+	"32":  {"0", 8, 9, ""},
+	"33":  {"0", 9, 9, ""},
+	"34":  {"", 9, 9, ""},
+	"39":  {"", 6, 11, ""},
+	"41":  {"0", 9, 9, ""},
+	"43":  {"0", 4, 13, ""},
+	"44":  {"0", 9, 10, "1235789"},
+	"45":  {"", 8, 8, ""},
+	"46":  {"0", 7, 13, ""},
+	"47":  {"", 8, 8, ""},
+	"48":  {"", 9, 9, ""},
+	"49":  {"0", 6, 13, ""},
+	"61":  {"0", 9, 9, ""},
+	"64":  {"0", 8, 10, ""},
+	"351": {"", 9, 9, ""},
+	"352": {"", 4, 11, ""},
+	"353": {"0", 7, 9, ""},
+	"358": {"0", 5, 12, ""},
+	"420": {"", 9, 9, ""},
+}
+
+// countryCodes gives the calling code for the country names people use
+var countryCodes = map[string]string{
+	"": "44", "united kingdom": "44", "uk": "44", "gb": "44", "great britain": "44", "britain": "44",
+	"england": "44", "scotland": "44", "wales": "44", "northern ireland": "44",
+	"isle of man": "44", "jersey": "44", "guernsey": "44",
+	"ireland": "353", "republic of ireland": "353", "eire": "353",
+	"france": "33", "germany": "49", "deutschland": "49", "netherlands": "31", "the netherlands": "31",
+	"holland": "31", "belgium": "32", "luxembourg": "352", "spain": "34", "portugal": "351",
+	"italy": "39", "switzerland": "41", "austria": "43", "denmark": "45", "sweden": "46",
+	"norway": "47", "finland": "358", "poland": "48", "czech republic": "420", "czechia": "420",
+	"greece": "30", "united states": "1", "united states of america": "1", "usa": "1", "us": "1",
+	"canada": "1", "australia": "61", "new zealand": "64", "south africa": "27",
+}
+
+// PhoneNumber is a number as entered and, if it can be valid, in E.164 form
+type PhoneNumber struct {
+	Entered string
+	E164    string
+	Problem string // Why there's no E164
+}
+
+// ParsePhone makes sense of a number typed by an entrant living in country
+func ParsePhone(entered, country string) PhoneNumber {
+
+	p := PhoneNumber{Entered: strings.TrimSpace(entered)}
+	if p.Entered == "" {
+		return p
+	}
+	x := strings.ReplaceAll(p.Entered, "(0)", "") // +44 (0)7700 ...
+	if i := strings.IndexAny(strings.ToLower(x), "xe#"); i > 0 {
+		x = x[:i] // Extensions aren't dialled
+	}
+	var digits strings.Builder
+	for i, r := range x {
+		switch {
+		case unicode.IsDigit(r):
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			digits.WriteRune(r)
+		case strings.ContainsRune(" -./()\t", r):
+		default:
+			p.Problem = "isn't a phone number"
+			return p
+		}
+	}
+	num := digits.String()
+
+	home, known := countryCodes[strings.ToLower(strings.TrimSpace(country))]
+	switch {
+	case strings.HasPrefix(num, "+"):
+		num = num[1:]
+	case strings.HasPrefix(num, "00"):
+		num = num[2:]
+	case home == "1" && strings.HasPrefix(num, "011"):
+		num = num[3:]
+	case !known:
+		p.Problem = "has no country code and " + country + " isn't a country I know"
+		return p
+	default:
+		plan := dialPlans[home]
+		nsn := strings.TrimPrefix(num, plan.trunk)
+		if nsn == num && strings.HasPrefix(num, home) && validNSN(num[len(home):], plan) {
+			nsn = num[len(home):] // Country code typed without the +
+		}
+		num = home + nsn
+	}
+
+	for n := 1; n <= 3 && n < len(num); n++ {
+		cc := num[:n]
+		plan, ok := dialPlans[cc]
+		if !ok {
+			continue
+		}
+		nsn := num[n:]
+		switch {
+		case len(nsn) < plan.min:
+			p.Problem = "is too short"
+		case len(nsn) > plan.max:
+			p.Problem = "is too long"
+		case !validNSN(nsn, plan):
+			p.Problem = "can't be right"
+		default:
+			p.E164 = "+" + num
+		}
+		return p
+	}
+	if len(num) < 8 || len(num) > 15 { // Somewhere else, do what we can
+		p.Problem = "is the wrong length"
+		return p
+	}
+	p.E164 = "+" + num
+	return p
+}
+
+func validNSN(nsn string, plan dialPlan) bool {
+
+	if len(nsn) < plan.min || len(nsn) > plan.max {
+		return false
+	}
+	return plan.first == "" || strings.ContainsRune(plan.first, rune(nsn[0]))
+}
+
+// Value is the E.164 form if there is one, for comparing numbers and for
+// address books and other software
+func (p PhoneNumber) Value() string {
+
+	if p.E164 != "" {
+		return p.E164
+	}
+	return p.Entered
+}
+
+// String gives the number as people expect to read it: UK numbers in the
+// national form grouped as the numbering plan has it, others in
+// international form
+func (p PhoneNumber) String() string {
+
+	if p.E164 == "" {
+		if len(p.Entered) > words.MaxPhone && words.MaxPhone > 0 {
+			return p.Entered[:words.MaxPhone]
+		}
+		return p.Entered
+	}
+	if nsn, ok := strings.CutPrefix(p.E164, "+44"); ok {
+		switch {
+		case nsn[0] == '2': // 020 7946 0018
+			return groupDigits("0"+nsn, 3, 4)
+		case nsn[0] == '3' || nsn[0] == '8' || nsn[0] == '9': // 0300 123 4567
+			return groupDigits("0"+nsn, 4, 3)
+		case nsn[0] == '1' && (nsn[1] == '1' || nsn[2] == '1'): // 0113 496 0000, 0161 496 0000
+			return groupDigits("0"+nsn, 4, 3)
+		}
+		return groupDigits("0"+nsn, 5) // 01904 123456, 07700 900123
+	}
+	for n := 1; n <= 3; n++ {
+		if _, ok := dialPlans[p.E164[1:1+n]]; ok {
+			return p.E164[:1+n] + " " + groupDigits(p.E164[1+n:], 3, 3)
+		}
+	}
+	return p.E164
+}
+
+// groupDigits splits s into groups of the given sizes, the last group
+// taking whatever's left
+func groupDigits(s string, sizes ...int) string {
+
+	var res []string
+	for _, n := range sizes {
+		if len(s) <= n {
+			break
+		}
+		res = append(res, s[:n])
+		s = s[n:]
+	}
+	return strings.Join(append(res, s), " ")
+}
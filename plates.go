@@ -0,0 +1,154 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Registration plates are checked at scrutineering against the Registration
+// tab so they're shown the way they appear on the bike: stray spaces and
+// punctuation are removed and, where the entrant's country has a format we
+// know, the plate is checked against it and spaced properly. Two entrants
+// riding the same registration are reported.
+
+// plateFormat is one way of writing a country's plates
+type plateFormat struct {
+	name   string
+	re     *regexp.Regexp
+	layout string // Replacement giving the plate as it's written
+	spaced bool   // Matched with its separators, as single spaces, rather than none
+}
+
+// plateFormats are keyed, like dialPlans, by country calling code. They're
+// tried in order, the first match wins.
+var plateFormats = map[string][]plateFormat{
+	"44": {
+		{"current", regexp.MustCompile(`^([A-Z]{2}[0-9]{2})([A-Z]{3})$`), "$1 $2", false},
+		{"prefix", regexp.MustCompile(`^([A-Z][0-9]{1,3})([A-Z]{3})$`), "$1 $2", false},
+		{"suffix", regexp.MustCompile(`^([A-Z]{3})([0-9]{1,3}[A-Z])$`), "$1 $2", false},
+		{"dateless", regexp.MustCompile(`^([A-Z]{1,3})([0-9]{1,4})$`), "$1 $2", false}, // Includes Northern Ireland
+		{"dateless", regexp.MustCompile(`^([0-9]{1,4})([A-Z]{1,3})$`), "$1 $2", false},
+	},
+	"353": {
+		{"Irish", regexp.MustCompile(`^([0-9]{2,3})([A-Z]{1,2})([0-9]{1,6})$`), "$1-$2-$3", false},
+	},
+	"33": {
+		{"French", regexp.MustCompile(`^([A-Z]{2})([0-9]{3})([A-Z]{2})$`), "$1-$2-$3", false},
+		{"French (old)", regexp.MustCompile(`^([0-9]{1,4})([A-Z]{1,3})([0-9]{2}|2A|2B)$`), "$1 $2 $3", false},
+	},
+	"34": {
+		{"Spanish", regexp.MustCompile(`^([0-9]{4})([B-DF-HJ-NP-TV-Z]{3})$`), "$1 $2", false},
+	},
+	"49": {
+		{"German", regexp.MustCompile(`^([A-ZÄÖÜ]{1,3}) ([A-Z]{1,2}) ?([0-9]{1,4}[EH]?)$`), "$1-$2 $3", true},
+	},
+}
+
+// Plate is a registration as entered and as it should be written
+type Plate struct {
+	Entered    string
+	Normalised string
+	Format     string // Which of the country's formats it matches, if we know them
+	Problem    string // Why it can't be right
+	Pending    bool   // Not known yet, TBC and the like
+}
+
+// ParsePlate tidies a registration entered by someone living in country
+func ParsePlate(entered, country string) Plate {
+
+	p := Plate{Entered: strings.TrimSpace(entered)}
+	if p.Entered == "" {
+		return p
+	}
+	if textNormaliser().IsDefault(p.Entered) {
+		p.Normalised = strings.ToUpper(p.Entered)
+		p.Pending = true
+		return p
+	}
+
+	var spaced strings.Builder // Letters and digits, runs of anything else as one space
+	gap := false
+	for _, r := range strings.ToUpper(p.Entered) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if gap && spaced.Len() > 0 {
+				spaced.WriteRune(' ')
+			}
+			spaced.WriteRune(r)
+			gap = false
+		} else {
+			gap = true
+		}
+	}
+	p.Normalised = spaced.String()
+	squashed := strings.ReplaceAll(p.Normalised, " ", "")
+
+	formats, known := plateFormats[countryCodes[strings.ToLower(strings.TrimSpace(country))]]
+	if !known {
+		if n := len([]rune(squashed)); n < 2 || n > 10 {
+			p.Problem = "is the wrong length"
+		}
+		return p
+	}
+	for _, f := range formats {
+		s := squashed
+		if f.spaced {
+			s = p.Normalised
+		}
+		if f.re.MatchString(s) {
+			p.Normalised = f.re.ReplaceAllString(s, f.layout)
+			p.Format = f.name
+			return p
+		}
+	}
+	p.Normalised = squashed
+	p.Problem = "doesn't match any known format"
+	return p
+}
+
+// Key is the same for any way of writing the same registration
+func (p Plate) Key() string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, p.Normalised)
+}
+
+// PlateUse records which entrant rides a bike and where it's listed
+type PlateUse struct {
+	Reg     string
+	Entrant string
+	Rider   string
+	Row     int
+}
+
+// reportDuplicatePlates warns of registrations entered by more than one
+// entrant and highlights them on the Registration tab
+func reportDuplicatePlates() {
+
+	var regs []string
+	for key, uses := range tot.Plates {
+		if len(uses) > 1 {
+			regs = append(regs, key)
+		}
+	}
+	sort.Strings(regs)
+	for _, key := range regs {
+		uses := tot.Plates[key]
+		var riders []string
+		for _, u := range uses {
+			riders = append(riders, u.Rider+" ("+u.Entrant+")")
+		}
+		for _, u := range uses {
+			warnEntrant("duplicate-reg", u.Entrant, "BikeReg", "Registration %v is entered by %v", uses[0].Reg, strings.Join(riders, ", "))
+			if !*summaryOnly {
+				rx := strconv.Itoa(u.Row)
+				xl.SetCellStyle(regsheet, "H"+rx, "H"+rx, styleW)
+			}
+		}
+	}
+}
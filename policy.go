@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// What happens to an entrant depends on Wufoo's PaymentStatus. The
+// cancellation section of the configuration maps each status to a state
+// and says, for each state, whether the entrant keeps the T-shirts, patches
+// and camping they asked for, what becomes of any money paid and whether
+// they're counted in the totals, exports and checklists. Anything left out
+// is as reglist has always treated it, field by field, and states of the
+// configuration's own invention start out treated as pending.
+
+// StatePolicy is how entrants in one state are treated
+type StatePolicy struct {
+	Merchandise bool   // Keeps T-shirts, patches and camping, and pays for them
+	Money       string // What becomes of money paid, one of moneyHandling
+	Counted     bool   // Included in the totals, exports and checklists
+}
+
+// StateSettings is a state as configured, nil or blank where left out
+type StateSettings struct {
+	Merchandise *bool  `yaml:"merchandise"`
+	Money       string `yaml:"money"`
+	Counted     *bool  `yaml:"counted"`
+}
+
+// What can become of money paid
+const (
+	moneyFees     = "fees"     // Set against the fees due
+	moneyDonation = "donation" // Anything beyond the fees due is kept as sponsorship
+	moneyRefund   = "refund"   // Given back, nothing is due
+	moneyWaived   = "waived"   // Free of charge, nothing is due
+)
+
+var moneyHandling = []string{moneyFees, moneyDonation, moneyRefund, moneyWaived}
+
+// Policy is the cancellation section of the configuration
+type Policy struct {
+	Statuses map[string]string        `yaml:"statuses"` // PaymentStatus to state
+	Settings map[string]StateSettings `yaml:"states"`
+	States   map[string]StatePolicy   `yaml:"-"` // Settings completed from the default
+}
+
+// The states every policy has
+const (
+	statePaid      = "paid"
+	stateFOC       = "foc"
+	stateCancelled = "cancelled"
+	stateRefunded  = "refunded"
+	statePending   = "pending"
+)
+
+// defaultPolicy is reglist's traditional treatment. Wufoo shows entries
+// made free of charge as Refunded, their payment having been given back.
+var defaultPolicy = Policy{
+	Statuses: map[string]string{
+		"Completed": statePaid,
+		"Paid":      statePaid,
+		"Refunded":  stateFOC,
+		"Cancelled": stateCancelled,
+		"Unpaid":    statePending,
+	},
+	States: map[string]StatePolicy{
+		statePaid:      {Merchandise: true, Money: moneyFees, Counted: true},
+		stateFOC:       {Merchandise: true, Money: moneyWaived, Counted: true},
+		stateCancelled: {Merchandise: true, Money: moneyFees, Counted: false},
+		stateRefunded:  {Merchandise: false, Money: moneyRefund, Counted: false},
+		statePending:   {Merchandise: true, Money: moneyFees, Counted: true},
+	},
+}
+
+// completePolicy fills in whatever the configuration leaves out from the
+// default and makes sure the rest makes sense
+func completePolicy(p *Policy) error {
+
+	if p.Statuses == nil {
+		p.Statuses = make(map[string]string)
+	}
+	for status, state := range defaultPolicy.Statuses {
+		if _, ok := p.Statuses[status]; !ok {
+			p.Statuses[status] = state
+		}
+	}
+	p.States = make(map[string]StatePolicy)
+	for state, sp := range defaultPolicy.States {
+		p.States[state] = sp
+	}
+	for state, ss := range p.Settings {
+		sp, ok := p.States[state]
+		if !ok {
+			sp = defaultPolicy.States[statePending]
+		}
+		if ss.Merchandise != nil {
+			sp.Merchandise = *ss.Merchandise
+		}
+		if ss.Money != "" {
+			sp.Money = ss.Money
+		}
+		if ss.Counted != nil {
+			sp.Counted = *ss.Counted
+		}
+		if !slices.Contains(moneyHandling, sp.Money) {
+			return fmt.Errorf("cancellation: state %v money %q should be one of %v", state, sp.Money, strings.Join(moneyHandling, ", "))
+		}
+		p.States[state] = sp
+	}
+	statuses := make([]string, 0, len(p.Statuses))
+	for status := range p.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		if _, ok := p.States[p.Statuses[status]]; !ok {
+			return fmt.Errorf("cancellation: status %v has state %q which isn't one of the states", status, p.Statuses[status])
+		}
+	}
+	return nil
+}
+
+// paymentState gives the state of an entrant with the given PaymentStatus
+// and how they're treated. Statuses not listed are pending.
+func paymentState(status string) (string, StatePolicy) {
+
+	state, ok := cfg.Cancellation.Statuses[status]
+	if !ok {
+		state = statePending
+	}
+	sp, ok := cfg.Cancellation.States[state]
+	if !ok { // Only if the policy wasn't completed
+		sp = defaultPolicy.States[state]
+	}
+	return state, sp
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fees aren't always the same for everyone: there are early-bird prices,
+// discounts for IBA members and novices and deals on several shirts. The
+// pricing section of the configuration lists rules for each item, tried in
+// order; the first whose conditions are all met sets the price, otherwise
+// it's riderfee, pillionfee, tshirtcost or patchcost as always. The rules
+// applied are shown on the Money tab.
+
+// PriceRule is one of the pricing rules in the configuration
+type PriceRule struct {
+	Name     string `yaml:"name"`
+	Item     string `yaml:"item"`     // rider, pillion, tshirt or patch
+	From     string `yaml:"from"`     // Entered on or after, YYYY-MM-DD
+	Before   string `yaml:"before"`   // Entered before, YYYY-MM-DD
+	Member   *bool  `yaml:"member"`   // Is, or isn't, an IBA member
+	Novice   *bool  `yaml:"novice"`   // Is, or isn't, a novice
+	Quantity int    `yaml:"quantity"` // At least this many bought
+	Price    Money  `yaml:"price"`    // Each
+}
+
+// Purchase is what's being bought, by whom, to be priced
+type Purchase struct {
+	Item     string
+	Entered  string // Date_Created
+	Member   bool
+	Novice   bool
+	Quantity int
+}
+
+// priceItems are the things that can be priced
+var priceItems = []string{"rider", "pillion", "tshirt", "patch"}
+
+// standardPrice is the price of an item when no rule applies
+func standardPrice(item string) Money {
+
+	switch item {
+	case "rider":
+		return cfg.Riderfee
+	case "pillion":
+		return cfg.Pillionfee
+	case "tshirt":
+		return cfg.Tshirtcost
+	case "patch":
+		return cfg.Patchcost
+	}
+	return 0
+}
+
+// applies says whether all the rule's conditions are met
+func (r *PriceRule) applies(p Purchase) bool {
+
+	entered := p.Entered
+	if len(entered) > 10 {
+		entered = entered[:10] // Dates and times are ISO so compare as text
+	}
+	switch {
+	case r.Item != p.Item:
+	case r.From != "" && (entered == "" || entered < r.From):
+	case r.Before != "" && (entered == "" || entered >= r.Before):
+	case r.Member != nil && *r.Member != p.Member:
+	case r.Novice != nil && *r.Novice != p.Novice:
+	case r.Quantity > 0 && p.Quantity < r.Quantity:
+	default:
+		return true
+	}
+	return false
+}
+
+// isNovice says whether the answer to the novice question says so. Nobody
+// is a novice for pricing if the configuration doesn't say how to tell.
+func isNovice(answer string) bool {
+	return cfg.Novice != "" && strings.Contains(answer, cfg.Novice)
+}
+
+// priceOf gives the price of each item of a purchase and the name of the
+// rule setting it, blank for the standard price
+func priceOf(p Purchase) (Money, string) {
+
+	for i := range cfg.Pricing {
+		if r := &cfg.Pricing[i]; r.applies(p) {
+			return r.Price, r.Name
+		}
+	}
+	return standardPrice(p.Item), ""
+}
+
+// checkPricing makes sure the pricing rules make sense
+func checkPricing(rules []PriceRule) error {
+
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			return fmt.Errorf("pricing rule %v has no name", i+1)
+		}
+		if !slices.Contains(priceItems, r.Item) {
+			return fmt.Errorf("pricing rule %q item %q should be one of %v", name, r.Item, strings.Join(priceItems, ", "))
+		}
+		for _, d := range []string{r.From, r.Before} {
+			if _, err := time.Parse(time.DateOnly, d); d != "" && err != nil {
+				return fmt.Errorf("pricing rule %q date %q should be YYYY-MM-DD", name, d)
+			}
+		}
+		if r.Price < 0 || r.Quantity < 0 {
+			return fmt.Errorf("pricing rule %q can't have a negative price or quantity", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/xuri/excelize/v2"
+)
+
+// Each entrant is given a QR code identifying the rally, year and entrant
+// number, with a checksum that catches misreads and mistyping. It's no
+// protection against forgery, anyone can make a code that checks. The
+// encoded form is IBAUK:rally:year:entrant:checksum
+
+const qrPrefix = "IBAUK"
+
+var ErrQRFormat = errors.New("not an entrant QR code")
+var ErrQRChecksum = errors.New("entrant QR code checksum is wrong")
+
+// QRTicket is the information carried by an entrant's QR code
+type QRTicket struct {
+	Rally     string
+	Year      string
+	EntrantID int
+}
+
+func qrChecksum(rally, year string, entrant int) string {
+
+	x := strings.ToLower(rally) + ":" + year + ":" + strconv.Itoa(entrant)
+	return fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(x)))
+}
+
+// EntrantQRPayload returns the text encoded in the QR code for an entrant
+func EntrantQRPayload(rally, year string, entrant int) string {
+
+	return strings.Join([]string{qrPrefix, strings.ToLower(rally), year, strconv.Itoa(entrant), qrChecksum(rally, year, entrant)}, ":")
+}
+
+// DecodeEntrantQR checks and decodes the text scanned from an entrant's QR code
+func DecodeEntrantQR(payload string) (QRTicket, error) {
+
+	var t QRTicket
+	f := strings.Split(strings.TrimSpace(payload), ":")
+	if len(f) != 5 || f[0] != qrPrefix {
+		return t, ErrQRFormat
+	}
+	n, err := strconv.Atoi(f[3])
+	if err != nil || n < 1 {
+		return t, ErrQRFormat
+	}
+	if !strings.EqualFold(f[4], qrChecksum(f[1], f[2], n)) {
+		return t, ErrQRChecksum
+	}
+	t.Rally = f[1]
+	t.Year = f[2]
+	t.EntrantID = n
+	return t, nil
+}
+
+// Matches reports whether the ticket belongs to the given rally
+func (t QRTicket) Matches(rally, year string) bool {
+
+	return strings.EqualFold(t.Rally, rally) && t.Year == year
+}
+
+// entrantQRPNG returns a PNG image of the QR code for an entrant of the current rally
+func entrantQRPNG(entrantid string, size int) ([]byte, error) {
+
+	n, err := strconv.Atoi(entrantid)
+	if err != nil {
+		return nil, err
+	}
+	return qrcode.Encode(EntrantQRPayload(cfg.Rally, cfg.Year, n), qrcode.Medium, size)
+}
+
+// addCarparkQR embeds the entrant's QR code in the Carpark tab
+func addCarparkQR(entrantid string, cell string) {
+
+	png, err := entrantQRPNG(entrantid, 80)
+	if err != nil {
+		return
+	}
+	err = xl.AddPictureFromBytes(chksheet, cell, &excelize.Picture{
+		Extension: ".png",
+		File:      png,
+		Format:    &excelize.GraphicOptions{OffsetX: 4, OffsetY: 0, LockAspectRatio: true},
+	})
+	if err != nil {
+		slog.Warn("QR code not added", "entrant", entrantid, "err", err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 )
@@ -23,7 +25,7 @@ type Person = struct {
 	Country      string
 }
 
-type Money = struct {
+type RBLRFunds = struct {
 	EntryDonation string
 	SquiresCheque string
 	SquiresCash   string
@@ -48,7 +50,7 @@ type EntrantRBLR = struct {
 	OdoCounts            string
 	StartTime            string
 	FinishTime           string
-	FundsRaised          Money
+	FundsRaised          RBLRFunds
 	FreeCamping          string
 	CertificateAvailable string
 	CertificateDelivered string
@@ -58,14 +60,55 @@ type EntrantRBLR = struct {
 	EditMode             string
 }
 
+// RBLRStatuses are the EntrantStatus values reglist reads and writes in the
+// RBLR database. The RBLR database doesn't define them so reglist has its
+// own, which rblrstatus: in the configuration can change to suit a database
+// that uses others.
+type RBLRStatuses struct {
+	DNS          int `yaml:"dns"` // Did not start, the initial state
+	Registered   int `yaml:"registered"`
+	CheckedOut   int `yaml:"checkedout"`
+	DNF          int `yaml:"dnf"`
+	CheckedIn    int `yaml:"checkedin"`
+	Finisher     int `yaml:"finisher"`
+	LateFinisher int `yaml:"latefinisher"`
+}
+
+var defaultRBLRStatuses = RBLRStatuses{DNS: 0, Registered: 1, CheckedOut: 2, DNF: 3, CheckedIn: 4, Finisher: 8, LateFinisher: 9}
+
+// rblrStatus is the statuses in use, set by loadConfig
+var rblrStatus = defaultRBLRStatuses
+
+// checkRBLRStatuses makes sure no two statuses share a value
+func checkRBLRStatuses(s RBLRStatuses) error {
+
+	seen := make(map[int]string)
+	for _, st := range []struct {
+		name  string
+		value int
+	}{{"dns", s.DNS}, {"registered", s.Registered}, {"checkedout", s.CheckedOut}, {"dnf", s.DNF},
+		{"checkedin", s.CheckedIn}, {"finisher", s.Finisher}, {"latefinisher", s.LateFinisher}} {
+		if other, ok := seen[st.value]; ok {
+			return fmt.Errorf("rblrstatus: %v and %v are both %v", other, st.name, st.value)
+		}
+		seen[st.value] = st.name
+	}
+	return nil
+}
+
+// rblrRouteCodes gives the short code stored in the RBLR database for each route letter
+var rblrRouteCodes = map[byte]string{'A': "NCW", 'B': "NAC", 'C': "SCW", 'D': "SAC", 'E': "5CW", 'F': "5AC"}
+
+// rblrRouteNames gives the full description of each route letter
+var rblrRouteNames = map[byte]string{'A': "North clockwise", 'B': "North anti-clockwise", 'C': "South clockwise",
+	'D': "South anti-clockwise", 'E': "500 clockwise", 'F': "500 anti-clockwise"}
+
 func BuildRBLR(e Entrant) EntrantRBLR {
 
-	const DNS = 0
-	var Routes = map[byte]string{'A': "NCW", 'B': "NAC", 'C': "SCW", 'D': "SAC", 'E': "5CW", 'F': "5AC"}
 	var E EntrantRBLR
 
 	E.EntrantID, _ = strconv.Atoi(e.Entrantid)
-	E.EntrantStatus = DNS
+	E.EntrantStatus = rblrStatus.DNS
 	E.Rider.First = e.RiderFirst
 	E.Rider.Last = e.RiderLast
 	E.Rider.IBA = e.RiderIBA
@@ -101,13 +144,16 @@ func BuildRBLR(e Entrant) EntrantRBLR {
 	E.Bike = fmt.Sprintf("%v %v", e.BikeMake, e.BikeModel)
 	E.BikeReg = e.BikeReg
 
-	E.Route = fmt.Sprintf("%v-%v", string(e.RouteClass[0]), Routes[e.RouteClass[0]])
+	E.Route = fmt.Sprintf("%v-%v", string(e.RouteClass[0]), rblrRouteCodes[e.RouteClass[0]])
 	E.FundsRaised.EntryDonation = e.Sponsorship
 
 	E.OdoCounts = e.OdoKms
 
 	E.FreeCamping = e.Camping
 	E.CertificateAvailable = "Y"
+	if cfg.Certificate != nil {
+		E.CertificateAvailable = "N" // Until one has been produced by -certs
+	}
 	E.CertificateDelivered = "N"
 	E.Tshirt1 = e.Tshirt1
 	E.Tshirt2 = e.Tshirt2
@@ -127,46 +173,90 @@ func rblrPersonFieldNames(P string, Flds []string) string {
 	return strings.Join(res, ",")
 }
 
-func q(x string) string {
-	return `'` + strings.TrimSpace(strings.ReplaceAll(x, `'`, `''`)) + `'`
+// rblrWritten holds the entrants written to the RBLR database by this build
+var rblrWritten = make(map[int]bool)
+
+// rblrCheckedIn picks out RBLR database rows holding anything recorded in
+// the carpark, status beyond Registered or a check-out, which a rebuild
+// mustn't lose
+func rblrCheckedIn() string {
+	return fmt.Sprintf(`(ifnull(EntrantStatus,%[1]d) NOT IN (%[1]d,%[2]d) OR ifnull(OdoStart,'')<>'' OR ifnull(StartTime,'')<>'')`,
+		rblrStatus.DNS, rblrStatus.Registered)
 }
-func writeRBLR(e *EntrantRBLR) {
 
-	if rblrdb == nil {
-		return
+// writeRBLR records an entrant in the RBLR database. An entrant already
+// there has their registration details updated, leaving the check-in and
+// check-out readings, status and certificate as they are. Nothing is
+// written without a transaction.
+func writeRBLR(tx *sql.Tx, e *EntrantRBLR) error {
+
+	if tx == nil {
+		return nil
 	}
 	var PersonFields = []string{`First`, `Last`, `Address1`, `Address2`, `Town`, `County`, `Postcode`, `Country`, `IBA`, `RBL`, `Phone`, `Email`}
-	var Fieldnames = `EntrantID,Bike,BikeReg,` + rblrPersonFieldNames("Rider", PersonFields) + `,` + rblrPersonFieldNames("Pillion", PersonFields)
-	Fieldnames += `,NokName,NokRelation,NokPhone,Route,OdoCounts,EntryDonation,FreeCamping,CertificateAvailable,Tshirt1,Tshirt2,Patches`
-
-	sqlx := "INSERT INTO entrants(" + Fieldnames + ") VALUES("
-	sqlx += strconv.Itoa(e.EntrantID)
-	sqlx += `,` + q(e.Bike) + `,` + q(e.BikeReg)
-	sqlx += `,` + q(e.Rider.First) + `,` + q(e.Rider.Last)
-	sqlx += `,` + q(e.Rider.Address1) + `,` + q(e.Rider.Address2)
-	sqlx += `,` + q(e.Rider.Town) + `,` + q(e.Rider.County)
-	sqlx += `,` + q(e.Rider.Postcode) + `,` + q(e.Rider.Country)
-	sqlx += `,` + q(e.Rider.IBA) + `,` + q(e.Rider.RBL)
-	sqlx += `,` + q(e.Rider.Phone) + `,` + q(e.Rider.Email)
-	sqlx += `,` + q(e.Pillion.First) + `,` + q(e.Pillion.Last)
-	sqlx += `,` + q(e.Pillion.Address1) + `,` + q(e.Pillion.Address2)
-	sqlx += `,` + q(e.Pillion.Town) + `,` + q(e.Pillion.County)
-	sqlx += `,` + q(e.Pillion.Postcode) + `,` + q(e.Pillion.Country)
-	sqlx += `,` + q(e.Pillion.IBA) + `,` + q(e.Pillion.RBL)
-	sqlx += `,` + q(e.Pillion.Phone) + `,` + q(e.Rider.Email)
-
-	sqlx += `,` + q(e.NokName) + `,` + q(e.NokRelation) + `,` + q(e.NokPhone)
-	sqlx += `,` + q(e.Route)
-	sqlx += `,` + q(e.OdoCounts)
-	sqlx += `,` + q(e.FundsRaised.EntryDonation)
-	sqlx += `,` + q(e.FreeCamping) + `,` + q(e.CertificateAvailable)
-	sqlx += `,` + q(e.Tshirt1) + `,` + q(e.Tshirt2) + `,` + q(strconv.Itoa(e.Patches))
-	sqlx += `)
-	`
-
-	//	fmt.Println(sqlx)
-
-	_, err := rblrdb.Exec(sqlx)
-	checkerr(err)
+	var Fieldnames = `Bike,BikeReg,` + rblrPersonFieldNames("Rider", PersonFields) + `,` + rblrPersonFieldNames("Pillion", PersonFields)
+	Fieldnames += `,NokName,NokRelation,NokPhone,Route,OdoCounts,EntryDonation,FreeCamping,Tshirt1,Tshirt2,Patches`
 
+	vals := []any{e.Bike, e.BikeReg,
+		e.Rider.First, e.Rider.Last, e.Rider.Address1, e.Rider.Address2, e.Rider.Town, e.Rider.County,
+		e.Rider.Postcode, e.Rider.Country, e.Rider.IBA, e.Rider.RBL, e.Rider.Phone, e.Rider.Email,
+		e.Pillion.First, e.Pillion.Last, e.Pillion.Address1, e.Pillion.Address2, e.Pillion.Town, e.Pillion.County,
+		e.Pillion.Postcode, e.Pillion.Country, e.Pillion.IBA, e.Pillion.RBL, e.Pillion.Phone, e.Rider.Email,
+		e.NokName, e.NokRelation, e.NokPhone, e.Route, e.OdoCounts, e.FundsRaised.EntryDonation, e.FreeCamping,
+		e.Tshirt1, e.Tshirt2, strconv.Itoa(e.Patches)}
+	for i, v := range vals {
+		vals[i] = strings.TrimSpace(v.(string))
+	}
+	rblrWritten[e.EntrantID] = true
+
+	res, err := tx.Exec("UPDATE entrants SET "+strings.ReplaceAll(Fieldnames, ",", "=?,")+"=? WHERE EntrantID=?", append(vals, e.EntrantID)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	vals = append(vals, e.EntrantID, e.CertificateAvailable)
+	_, err = tx.Exec("INSERT INTO entrants("+Fieldnames+",EntrantID,CertificateAvailable) VALUES(?"+strings.Repeat(",?", len(vals)-1)+")", vals...)
+	return err
+}
+
+// pruneRBLR removes from the RBLR database anyone no longer entered, unless
+// they've been through the carpark
+func pruneRBLR(tx *sql.Tx) error {
+
+	if tx == nil {
+		return nil
+	}
+	rows, err := tx.Query("SELECT EntrantID," + rblrCheckedIn() + " FROM entrants")
+	if err != nil {
+		return failWith(ExitDatabase, err)
+	}
+	var gone []int
+	for rows.Next() {
+		var id int
+		var checkedin bool
+		if err := rows.Scan(&id, &checkedin); err != nil {
+			rows.Close()
+			return failWith(ExitDatabase, err)
+		}
+		if rblrWritten[id] {
+			continue
+		}
+		if checkedin {
+			slog.Warn("No longer entered but has been through the carpark, kept in the RBLR database", "entrant", id)
+			continue
+		}
+		gone = append(gone, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return failWith(ExitDatabase, err)
+	}
+	for _, id := range gone {
+		if _, err := tx.Exec("DELETE FROM entrants WHERE EntrantID=?", id); err != nil {
+			return failWith(ExitDatabase, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What Wufoo says was paid is checked against the merchant's own record.
+// The transactions downloaded from PayPal, or any other merchant giving
+// much the same columns, are matched to entrants by Payment_Confirmation,
+// which holds the transaction ID, or failing that by email and amount.
+// Refunds are matched through the transaction they refund. The results,
+// with the fees the merchant kept, are shown on the Reconciliation tab.
+
+// Transaction is one line of a merchant's transaction download
+type Transaction struct {
+	ID       string
+	RefID    string // The transaction a refund refunds
+	Date     string
+	Name     string
+	Email    string
+	Type     string
+	Currency string
+	Gross    Money
+	Fee      Money // Negative, as the merchant shows it
+	Net      Money
+	Row      int
+}
+
+// Refund says whether the transaction gives money back
+func (t *Transaction) Refund() bool {
+	return t.Gross < 0 || strings.Contains(strings.ToLower(t.Type), "refund")
+}
+
+// transactionColumns are the headings, in lower case, each part of a
+// Transaction might have
+var transactionColumns = map[string][]string{
+	"id":       {"transaction id", "transactionid", "transaction", "id"},
+	"refid":    {"reference txn id", "reference transaction id", "reference"},
+	"date":     {"date", "created", "date created"},
+	"name":     {"name", "customer name", "payer name"},
+	"email":    {"from email address", "email", "customer email", "payer email"},
+	"type":     {"type", "description"},
+	"currency": {"currency"},
+	"gross":    {"gross", "amount"},
+	"fee":      {"fee", "fees"},
+	"net":      {"net"},
+}
+
+// ignoredTransactions are types of line that aren't payments at all
+var ignoredTransactions = []string{"currency conversion", "withdrawal", "transfer to bank", "hold"}
+
+// LoadTransactions reads a merchant's transaction CSV
+func LoadTransactions(path string) ([]Transaction, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if bom, _, err := br.ReadRune(); err != nil || bom != '\ufeff' { // Excel's byte order mark
+		br.UnreadRune()
+	}
+	r := csv.NewReader(br)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	hdr, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	cols := make(map[string]int)
+	for i, h := range hdr {
+		h = strings.ToLower(strings.TrimSpace(h))
+		for k, names := range transactionColumns {
+			if _, ok := cols[k]; !ok && slices.Contains(names, h) {
+				cols[k] = i
+			}
+		}
+	}
+	for _, k := range []string{"id", "gross"} {
+		if _, ok := cols[k]; !ok {
+			return nil, fmt.Errorf("%v has no %v column", path, transactionColumns[k][0])
+		}
+	}
+
+	var res []Transaction
+	row := 1
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %w", path, row, err)
+		}
+		get := func(k string) string {
+			if i, ok := cols[k]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		t := Transaction{ID: get("id"), RefID: get("refid"), Date: get("date"), Name: get("name"),
+			Email: get("email"), Type: get("type"), Currency: currencyCode(get("currency")), Row: row}
+		if t.ID == "" || ignoredTransaction(t.Type) {
+			continue
+		}
+		if t.Gross, err = ParseMoney(get("gross")); err != nil {
+			return nil, fmt.Errorf("%v line %v: gross %w", path, row, err)
+		}
+		if fee := get("fee"); fee != "" {
+			if t.Fee, err = ParseMoney(fee); err != nil {
+				return nil, fmt.Errorf("%v line %v: fee %w", path, row, err)
+			}
+		}
+		t.Net = t.Gross + t.Fee
+		if net := get("net"); net != "" {
+			if t.Net, err = ParseMoney(net); err != nil {
+				return nil, fmt.Errorf("%v line %v: net %w", path, row, err)
+			}
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// ignoredTransaction says whether a type of transaction isn't a payment
+func ignoredTransaction(typ string) bool {
+
+	typ = strings.ToLower(typ)
+	for _, x := range ignoredTransactions {
+		if strings.Contains(typ, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// Payment is what Wufoo says an entrant paid
+type Payment struct {
+	Entrant      string
+	Rider        string
+	Email        string
+	Status       string
+	Merchant     string
+	Confirmation string
+	Currency     string
+	Amount       Money
+}
+
+// States of reconciliation, in the order they're listed
+const (
+	reconMatched   = "Matched"
+	reconDiffers   = "Amount differs"
+	reconRefund    = "Refund"
+	reconUnmatched = "No entrant"
+	reconMissing   = "No transaction"
+)
+
+var reconOrder = []string{reconMatched, reconDiffers, reconRefund, reconUnmatched, reconMissing}
+
+// Reconciled is a transaction and the payment it was matched to. Either
+// may be missing.
+type Reconciled struct {
+	Transaction *Transaction
+	Payment     *Payment
+	How         string // What matched
+	State       string
+}
+
+// reconcile matches transactions to the payments of entrants using
+// merchant, who may have paid by other means
+func reconcile(txns []Transaction, pays []Payment, merchant string) []Reconciled {
+
+	byConf := make(map[string]int)
+	for i, p := range pays {
+		if p.Confirmation != "" {
+			byConf[strings.ToUpper(p.Confirmation)] = i
+		}
+	}
+	used := make(map[int]bool)    // Payments matched
+	byTxn := make(map[string]int) // Payment matched by transaction ID
+	res := make([]Reconciled, len(txns))
+
+	// Confirmations first so that email matching can't take them
+	for i := range txns {
+		t := &txns[i]
+		res[i] = Reconciled{Transaction: t, State: reconUnmatched}
+		if t.Refund() {
+			continue
+		}
+		if j, ok := byConf[strings.ToUpper(t.ID)]; ok && !used[j] {
+			res[i].Payment, res[i].How = &pays[j], "confirmation"
+			used[j], byTxn[t.ID] = true, j
+		}
+	}
+	for i := range txns {
+		t := &txns[i]
+		if res[i].Payment != nil || t.Refund() || t.Email == "" {
+			continue
+		}
+		var found []int
+		for j, p := range pays {
+			if !used[j] && strings.EqualFold(p.Email, t.Email) &&
+				(p.Merchant == "" || strings.EqualFold(p.Merchant, merchant)) {
+				found = append(found, j)
+			}
+		}
+		pick := -1
+		for _, j := range found {
+			if pays[j].Amount == t.Gross && pays[j].Currency == t.Currency {
+				pick, res[i].How = j, "email and amount"
+				break
+			}
+		}
+		if pick < 0 && len(found) == 1 {
+			pick, res[i].How = found[0], "email"
+		}
+		if pick >= 0 {
+			res[i].Payment = &pays[pick]
+			used[pick], byTxn[t.ID] = true, pick
+		}
+	}
+	for i := range txns {
+		t := &txns[i]
+		switch {
+		case t.Refund():
+			res[i].State = reconRefund
+			if j, ok := byTxn[t.RefID]; ok {
+				res[i].Payment, res[i].How = &pays[j], "refunded transaction"
+			} else if j, ok := byConf[strings.ToUpper(t.RefID)]; ok && t.RefID != "" {
+				res[i].Payment, res[i].How = &pays[j], "confirmation"
+			} else {
+				for j, p := range pays {
+					if t.Email != "" && strings.EqualFold(p.Email, t.Email) {
+						res[i].Payment, res[i].How = &pays[j], "email"
+						break
+					}
+				}
+			}
+		case res[i].Payment == nil:
+		case res[i].Payment.Amount != t.Gross || res[i].Payment.Currency != t.Currency:
+			res[i].State = reconDiffers
+		default:
+			res[i].State = reconMatched
+		}
+	}
+
+	for j, p := range pays {
+		if state, _ := paymentState(p.Status); !used[j] && p.Amount > 0 && state == statePaid &&
+			(p.Merchant == "" || strings.EqualFold(p.Merchant, merchant)) {
+			res = append(res, Reconciled{Payment: &pays[j], State: reconMissing})
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		return slices.Index(reconOrder, res[a].State) < slices.Index(reconOrder, res[b].State)
+	})
+	return res
+}
+
+// paymentsClaimed loads what every entrant who hasn't withdrawn says they
+// paid, whether or not they're included in the spreadsheet
+func paymentsClaimed() ([]Payment, error) {
+
+	rows, err := db.Query(`SELECT FinalRiderNumber,ifnull(RiderName,''),ifnull(RiderLast,''),ifnull(Email,''),ifnull(PaymentStatus,''),
+ifnull(Payment_Merchant,''),ifnull(Payment_Confirmation,''),ifnull(Payment_Currency,''),ifnull(PaymentTotal,'')
+FROM entrants WHERE Withdrawn IS NULL ORDER BY FinalRiderNumber`)
+	if err != nil {
+		return nil, failWith(ExitDatabase, err)
+	}
+	defer rows.Close()
+	var res []Payment
+	for rows.Next() {
+		var p Payment
+		var first, last, amount string
+		if err := rows.Scan(&p.Entrant, &first, &last, &p.Email, &p.Status, &p.Merchant, &p.Confirmation, &p.Currency, &amount); err != nil {
+			return nil, failWith(ExitDatabase, err)
+		}
+		p.Rider = properName(first) + " " + properName(last)
+		p.Email = strings.TrimSpace(p.Email)
+		p.Currency = currencyCode(p.Currency)
+		p.Amount = moneyval(amount)
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+// reportReconciliation matches the transactions given by -paypal to the
+// entrants and warns of any that don't tally
+func reportReconciliation() ([]Reconciled, error) {
+
+	if *paypalCSV == "" {
+		return nil, nil
+	}
+	txns, err := LoadTransactions(*paypalCSV)
+	if err != nil {
+		return nil, failWith(ExitInput, err)
+	}
+	pays, err := paymentsClaimed()
+	if err != nil {
+		return nil, err
+	}
+	recs := reconcile(txns, pays, cfg.Merchant)
+	counts := make(map[string]int)
+	for _, r := range recs {
+		counts[r.State]++
+		t, p := r.Transaction, r.Payment
+		switch r.State {
+		case reconDiffers:
+			warnEntrant("payment-differs", p.Entrant, "PaymentTotal", "%v paid %v %v but %v transaction %v is for %v %v",
+				p.Rider, p.Amount, p.Currency, cfg.Merchant, t.ID, t.Gross, t.Currency)
+		case reconUnmatched:
+			warnEntrant("payment-unmatched", "", "Payment_Confirmation", "%v transaction %v from %v (%v) for %v %v matches no entrant",
+				cfg.Merchant, t.ID, t.Name, t.Email, t.Gross, t.Currency)
+		case reconMissing:
+			warnEntrant("payment-missing", p.Entrant, "Payment_Confirmation", "%v says they paid %v %v but there's no %v transaction %v",
+				p.Rider, p.Amount, p.Currency, cfg.Merchant, p.Confirmation)
+		}
+	}
+	slog.Info("Transactions reconciled", "path", *paypalCSV, "transactions", len(txns),
+		"matched", counts[reconMatched], "differ", counts[reconDiffers], "refunds", counts[reconRefund],
+		"unmatched", counts[reconUnmatched], "missing", counts[reconMissing])
+	return recs, nil
+}
+
+// writeReconciliationSheet lists every transaction with the entrant it was
+// matched to, then the entrants with no transaction, then the totals for
+// each currency
+func writeReconciliationSheet(recs []Reconciled) {
+
+	if len(recs) == 0 {
+		return
+	}
+	xl.NewSheet(reconsheet)
+	formatSheet(reconsheet, false)
+	xl.SetCellStyle(reconsheet, "A1", "M1", styleH2)
+	xl.SetRowHeight(reconsheet, 1, 30)
+	for i, h := range []string{"Transaction", "Date", "Name", "Email", "Currency", "Gross", "Fee", "Net", "Entrant", "Rider", "Wufoo says", "Matched by", "Status"} {
+		xl.SetCellValue(reconsheet, string(rune('A'+i))+"1", h)
+	}
+	xl.SetColWidth(reconsheet, "A", "A", 20)
+	xl.SetColWidth(reconsheet, "B", "B", 12)
+	xl.SetColWidth(reconsheet, "C", "D", 24)
+	xl.SetColWidth(reconsheet, "E", "I", 10)
+	xl.SetColWidth(reconsheet, "J", "J", 24)
+	xl.SetColWidth(reconsheet, "K", "L", 16)
+	xl.SetColWidth(reconsheet, "M", "M", 16)
+
+	type sums struct{ gross, fee, net Money }
+	totals := make(map[string]*sums)
+	var currencies []string
+	row := 2
+	for _, r := range recs {
+		rx := strconv.Itoa(row)
+		if t := r.Transaction; t != nil {
+			xl.SetCellValue(reconsheet, "A"+rx, t.ID)
+			xl.SetCellValue(reconsheet, "B"+rx, t.Date)
+			xl.SetCellValue(reconsheet, "C"+rx, t.Name)
+			xl.SetCellValue(reconsheet, "D"+rx, t.Email)
+			xl.SetCellValue(reconsheet, "E"+rx, t.Currency)
+			setMoneyCell(reconsheet, "F"+rx, t.Gross)
+			setMoneyCell(reconsheet, "G"+rx, t.Fee)
+			setMoneyCell(reconsheet, "H"+rx, t.Net)
+			s := totals[t.Currency]
+			if s == nil {
+				s = &sums{}
+				totals[t.Currency] = s
+				currencies = append(currencies, t.Currency)
+			}
+			s.gross += t.Gross
+			s.fee += t.Fee
+			s.net += t.Net
+		}
+		if p := r.Payment; p != nil {
+			xl.SetCellInt(reconsheet, "I"+rx, intval(p.Entrant))
+			xl.SetCellValue(reconsheet, "J"+rx, p.Rider)
+			xl.SetCellValue(reconsheet, "K"+rx, p.Amount.String()+" "+p.Currency)
+		}
+		xl.SetCellValue(reconsheet, "L"+rx, r.How)
+		xl.SetCellValue(reconsheet, "M"+rx, r.State)
+		xl.SetCellStyle(reconsheet, "A"+rx, "M"+rx, styleV2L)
+		if r.State != reconMatched && r.State != reconRefund {
+			xl.SetCellStyle(reconsheet, "M"+rx, "M"+rx, styleW)
+		}
+		row++
+	}
+
+	sort.Strings(currencies)
+	row++
+	for _, c := range currencies {
+		rx := strconv.Itoa(row)
+		xl.SetCellValue(reconsheet, "D"+rx, "Total")
+		xl.SetCellValue(reconsheet, "E"+rx, c)
+		setMoneyCell(reconsheet, "F"+rx, totals[c].gross)
+		setMoneyCell(reconsheet, "G"+rx, totals[c].fee)
+		setMoneyCell(reconsheet, "H"+rx, totals[c].net)
+		xl.SetCellStyle(reconsheet, "D"+rx, "H"+rx, styleT)
+		row++
+	}
+	setPagePane(reconsheet)
+}
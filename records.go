@@ -2,9 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -41,13 +40,19 @@ type Totals struct {
 	NumMiles2Squires   int
 	LoMiles2Squires    int
 	HiMiles2Squires    int
-	TotMoneyOnDay      int // Sponsor money received on day
-	TotMoneySponsor    int // Sponsor money paid up front
-	TotMoneyMainPaypal int // Original Paypal payment
-	TotMoneyCashPaypal int // Subsequent Paypal payments
+	TotMoneyOnDay      Money // Sponsor money received on day
+	TotMoneySponsor    Money // Sponsor money paid up front
+	TotMoneyMainPaypal Money // Original Paypal payment
+	TotMoneyCashPaypal Money // Subsequent Paypal payments
+	TotMoneyEntries    Money // Fees due, as priced
+	TotMoneyPillions   Money
+	TotMoneyTshirts    Money
+	TotMoneyPatches    Money
 	Bikes              []Bikemake
 	EntriesByPeriod    []Entrystats
 	CancelledRows      []int
+	Plates             map[string][]PlateUse // Keyed by Plate.Key, to find duplicates
+	Currencies         map[string]*CurrencyTotal
 	NumWithdrawn       int
 }
 
@@ -60,6 +65,8 @@ func NewTotals(numRoutes, numSizes, numBikes int) *Totals {
 	t.EntriesByPeriod = make([]Entrystats, 0)
 	t.LoMiles2Squires = 9999
 	t.CancelledRows = make([]int, 0)
+	t.Plates = make(map[string][]PlateUse)
+	t.Currencies = make(map[string]*CurrencyTotal)
 	return &t
 }
 
@@ -115,6 +122,10 @@ type Entrant struct {
 	PPostcode        string
 	PCountry         string
 	Sponsorship      string
+
+	// The numbers shown as Phone and NokPhone, for the contact exports
+	phoneNumber    PhoneNumber
+	nokPhoneNumber PhoneNumber
 }
 
 func EntrantHeaders() []string {
@@ -123,7 +134,9 @@ func EntrantHeaders() []string {
 	te := reflect.TypeOf(e)
 	var res []string
 	for i := 0; i < te.NumField(); i++ {
-		res = append(res, te.Field(i).Name)
+		if te.Field(i).IsExported() {
+			res = append(res, te.Field(i).Name)
+		}
 	}
 	return res
 }
@@ -134,19 +147,6 @@ func EntrantHeadersEmail() []string {
 	return res
 }
 
-func EntrantHeadersGmail() []string {
-
-	res := []string{"Name", "Given Name", "Additional Name", "Family Name",
-		"Yomi Name", "Given Name Yomi", "Additional Name Yomi", "Family Name Yomi",
-		"Name Prefix", "Name Suffix", "Initials", "Nickname", "Short Name", "Maiden Name",
-		"Birthday", "Gender", "Location", "Billing Information",
-		"Directory Server", "Mileage", "Occupation", "Hobby", "Sensitivity", "Priority",
-		"Subject", "Notes", "Language", "Photo", "Group Membership",
-		"E-mail 1 - Type", "E-mail 1 - Value", "E-mail 2 - Type", "E-mail 2 - Value", "Website 1 - Type", "Website 1 - Value"}
-
-	return res
-}
-
 func Entrant2Email(e Entrant) []string {
 
 	var res []string
@@ -156,32 +156,15 @@ func Entrant2Email(e Entrant) []string {
 	res = append(res, e.Phone)
 	return res
 }
-func Entrant2Gmail(e Entrant) []string {
-
-	var res []string
-	res = append(res, e.RiderFirst+" "+e.RiderLast)
-	res = append(res, e.RiderFirst)
-	res = append(res, "")
-	res = append(res, e.RiderLast)
-	for i := 0; i < 24; i++ {
-		res = append(res, "")
-	}
-	res = append(res, cfg.Rally+cfg.Year) // Group membership
-	res = append(res, "*")                // Email type
-	res = append(res, e.Email)
-	for i := 0; i < 4; i++ {
-		res = append(res, "")
-	}
-	return res
-
-}
 
 func Entrant2Strings(e Entrant) []string {
 
 	te := reflect.ValueOf(e)
 	var res []string
 	for i := 0; i < te.NumField(); i++ {
-		res = append(res, te.Field(i).String())
+		if te.Type().Field(i).IsExported() {
+			res = append(res, te.Field(i).String())
+		}
 	}
 	return res
 
@@ -206,7 +189,9 @@ func lookupIBA(first, last string) (string, string) {
 	//fmt.Printf("%v\n", sqlx)
 	rows, err := db.Query(sqlx)
 	if err != nil {
-		log.Fatal(err)
+		*noLookup = true
+		slog.Error("Can't access rides database", "err", err)
+		return "", ""
 	}
 	defer rows.Close()
 	if rows.Next() {
@@ -231,7 +216,7 @@ func lookupIBAWeb(first, last string) (string, string) {
 	resp, err := client.Get(url)
 	if err != nil {
 		*noLookup = true
-		fmt.Printf("*** can't access online members database\n*** %v\n", err)
+		slog.Error("Can't access online members database", "err", err)
 		return "", ""
 	}
 	defer resp.Body.Close()
@@ -240,7 +225,7 @@ func lookupIBAWeb(first, last string) (string, string) {
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err != nil {
 			*noLookup = true
-			fmt.Printf("*** can't access online members database\n*** %v\n", err)
+			slog.Error("Can't access online members database", "err", err)
 			return "", ""
 		}
 		//bodyString := string(bodyBytes)
@@ -258,7 +243,9 @@ func lookupIBAMember(iba string) (string, string) {
 	//fmt.Printf("%v\n", sqlx)
 	rows, err := db.Query(sqlx)
 	if err != nil {
-		log.Fatal(err)
+		*noLookup = true
+		slog.Error("Can't access rides database", "err", err)
+		return "", ""
 	}
 	defer rows.Close()
 	if rows.Next() {
@@ -299,7 +286,7 @@ func lookupIBAMemberWeb(iba string) (string, string) {
 	resp, err := client.Get(url)
 	if err != nil {
 		*noLookup = true
-		fmt.Printf("*** can't access online members database\n*** %v\n", err)
+		slog.Error("Can't access online members database", "err", err)
 		return "", ""
 	}
 	defer resp.Body.Close()
@@ -308,20 +295,20 @@ func lookupIBAMemberWeb(iba string) (string, string) {
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err != nil {
 			*noLookup = true
-			fmt.Printf("*** Can't access online members database %v\n", err)
+			slog.Error("Can't access online members database", "err", err)
 			return "", ""
 		}
 		//bodyString := string(bodyBytes)
 		json.Unmarshal(bodyBytes, &lresp)
 		//fmt.Printf("%v\n", bodyString)
 	} else {
-		fmt.Printf("*** member lookup returned HTTP %v [%v]\n", resp.Status, resp.StatusCode)
+		slog.Warn("Member lookup failed", "status", resp.Status)
 	}
 	return lresp.Sname, lresp.Email
 
 }
 
-func validateIBAnumber(viba *string, vlabel, vfirst, vlast, vemail string) {
+func validateIBAnumber(entrantid string, viba *string, vlabel, vfirst, vlast, vemail string) {
 
 	var sname, remail, riba string
 
@@ -335,7 +322,7 @@ func validateIBAnumber(viba *string, vlabel, vfirst, vlast, vemail string) {
 		if sname != "" { // a record was found with that proffered number
 			w := strings.Split(vlast, " ") // Same split as lookup.php
 			if !strings.EqualFold(sname, w[len(w)-1]) {
-				fmt.Printf("*** %v %v %v, IBA %v doesn't match %v %v\n", vlabel, vfirst, vlast, *viba, sname, remail)
+				warnEntrant("iba-mismatch", entrantid, vlabel+"IBA", "%v %v %v, IBA %v doesn't match %v %v", vlabel, vfirst, vlast, *viba, sname, remail)
 			}
 			return
 		}
@@ -349,23 +336,21 @@ func validateIBAnumber(viba *string, vlabel, vfirst, vlast, vemail string) {
 		riba, remail = lookupIBA(vfirst, vlast)
 	}
 	if riba != "" && riba != "0" { // Found an IBA number
-		if *verbose {
-			fmt.Printf("*** %v %v %v %v %v is IBA %v %v\n", vlabel, vfirst, vlast, *viba, vemail, riba, remail)
-		}
+		slog.Debug("IBA member identified", "entrant", entrantid, "name", vfirst+" "+vlast, "was", *viba, "email", vemail, "iba", riba, "ibaemail", remail)
 		*viba = riba
 		return
 	}
 	if *viba != "" {
-		fmt.Printf("*** %v %v %v is not IBA %v\n", vlabel, vfirst, vlast, *viba)
+		warnEntrant("iba-not-member", entrantid, vlabel+"IBA", "%v %v %v is not IBA %v", vlabel, vfirst, vlast, *viba)
 	}
 
 }
 
 func LookupIBANumbers(e *Entrant) {
 
-	validateIBAnumber(&e.RiderIBA, "Rider", e.RiderFirst, e.RiderLast, e.Email)
+	validateIBAnumber(e.Entrantid, &e.RiderIBA, "Rider", e.RiderFirst, e.RiderLast, e.Email)
 	if e.PillionFirst != "" && e.PillionLast != "" {
-		validateIBAnumber(&e.PillionIBA, "Pillion", e.PillionFirst, e.PillionLast, "")
+		validateIBAnumber(e.Entrantid, &e.PillionIBA, "Pillion", e.PillionFirst, e.PillionLast, "")
 	}
 
 }
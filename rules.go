@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Data-quality rules are declared in the rally configuration. Each is
+// checked against every entrant and anything found is reported on the
+// console, in the run report and on the Data issues tab. The built-in
+// rules below do what reglist has always done and may be overridden, or
+// switched off, by a rule with the same code.
+
+// Rule severities, most severe first
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+	SeverityOff     = "off"
+)
+
+// Rule is a single check of one field of each entrant. Apart from required,
+// rules only apply to fields with something in them.
+type Rule struct {
+	Code     string   `yaml:"code"`
+	Field    string   `yaml:"field"`
+	Severity string   `yaml:"severity"` // error, warning (the default), info or off
+	Message  string   `yaml:"message"`  // May refer to any field as {Field}
+	Required bool     `yaml:"required"`
+	Pattern  string   `yaml:"pattern"` // Regular expression the field must match
+	Allowed  []string `yaml:"allowed"` // Values the field may have, ignoring case
+	Op       string   `yaml:"op"`      // eq, ne, lt, le, gt or ge comparing the field with ...
+	With     string   `yaml:"with"`    // ... another field, or
+	Value    string   `yaml:"value"`   // ... a fixed value
+
+	re *regexp.Regexp
+}
+
+// builtinRules replicate the checks reglist has always made. Those without
+// a field are made elsewhere, against the whole database, and are listed so
+// that their severity can be configured.
+var builtinRules = []Rule{
+	{Code: "nok-is-rider", Field: "NokName", Op: "ne", With: "RiderName",
+		Message: "Rider {RiderName} is the emergency contact ({NokRelation})"},
+	{Code: "nok-is-pillion", Field: "NokName", Op: "ne", With: "PillionName",
+		Message: "Pillion {PillionName} is the emergency contact ({NokRelation})"},
+	{Code: "nok-same-phone", Field: "NokPhone", Op: "ne", With: "Phone",
+		Message: "Rider {RiderName} has the same mobile as emergency contact {Phone}"},
+	{Code: "duplicate-rider"},
+	{Code: "possible-duplicate"},
+	{Code: "phone-invalid"},
+	{Code: "bike-unknown", Severity: SeverityInfo},
+	{Code: "bike-guessed", Severity: SeverityInfo},
+	{Code: "reg-invalid"},
+	{Code: "duplicate-reg"},
+	{Code: "address-incomplete"},
+	{Code: "postcode-missing"},
+	{Code: "postcode-invalid"},
+	{Code: "postcode-moved", Severity: SeverityInfo},
+	{Code: "unpaid"},
+	{Code: "currency-unknown", Severity: SeverityError},
+	{Code: "payment-differs"},
+	{Code: "payment-unmatched"},
+	{Code: "payment-missing"},
+	{Code: "iba-mismatch"},
+	{Code: "iba-not-member"},
+}
+
+// virtualFields are those made up from the fields of Entrant
+var virtualFields = map[string]func(e *Entrant) string{
+	"ridername": func(e *Entrant) string { return strings.TrimSpace(e.RiderFirst + " " + e.RiderLast) },
+	"pillionname": func(e *Entrant) string {
+		return strings.TrimSpace(e.PillionFirst + " " + e.PillionLast)
+	},
+}
+
+// entrantField returns the named field of an entrant, ignoring case
+func entrantField(e *Entrant, name string) (string, bool) {
+
+	if f, ok := virtualFields[strings.ToLower(name)]; ok {
+		return f(e), true
+	}
+	v := reflect.ValueOf(e).Elem().FieldByNameFunc(func(s string) bool { return strings.EqualFold(s, name) })
+	if !v.IsValid() || !v.CanInterface() {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// RuleSet is the built-in rules as amended by the configuration
+type RuleSet struct {
+	rules []Rule
+}
+
+// NewRuleSet checks the configured rules and merges them with the built-ins
+func NewRuleSet(configured []Rule) (*RuleSet, error) {
+
+	rs := &RuleSet{rules: append([]Rule{}, builtinRules...)}
+	var none Entrant
+	for _, r := range configured {
+		if r.Code == "" {
+			return nil, fmt.Errorf("rule for %q has no code", r.Field)
+		}
+		if r.Severity == "" {
+			r.Severity = SeverityWarning
+		}
+		switch r.Severity {
+		case SeverityError, SeverityWarning, SeverityInfo, SeverityOff:
+		default:
+			return nil, fmt.Errorf("rule %v severity %q should be error, warning, info or off", r.Code, r.Severity)
+		}
+		if i := rs.find(r.Code); i >= 0 {
+			builtin := rs.rules[i]
+			if r.Field == "" && builtin.Field != "" { // Just changing severity or message
+				builtin.Severity = r.Severity
+				if r.Message != "" {
+					builtin.Message = r.Message
+				}
+				r = builtin
+			}
+			rs.rules = append(rs.rules[:i], rs.rules[i+1:]...)
+		} else if r.Field == "" {
+			return nil, fmt.Errorf("rule %v has no field", r.Code)
+		}
+		for _, f := range []string{r.Field, r.With} {
+			if _, ok := entrantField(&none, f); f != "" && !ok {
+				return nil, fmt.Errorf("rule %v refers to unknown field %q", r.Code, f)
+			}
+		}
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v pattern: %w", r.Code, err)
+			}
+			r.re = re
+		}
+		switch r.Op {
+		case "", "eq", "ne", "lt", "le", "gt", "ge":
+		default:
+			return nil, fmt.Errorf("rule %v op %q should be eq, ne, lt, le, gt or ge", r.Code, r.Op)
+		}
+		if r.Op != "" && r.With == "" && r.Value == "" {
+			return nil, fmt.Errorf("rule %v op %v needs either with or value", r.Code, r.Op)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+func (rs *RuleSet) find(code string) int {
+
+	for i := range rs.rules {
+		if rs.rules[i].Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// Severity returns the configured severity of a rule, warning if it isn't known
+func (rs *RuleSet) Severity(code string) string {
+
+	if rs != nil {
+		if i := rs.find(code); i >= 0 && rs.rules[i].Severity != "" {
+			return rs.rules[i].Severity
+		}
+	}
+	return SeverityWarning
+}
+
+// Check applies every rule to an entrant, returning the codes of those broken
+func (rs *RuleSet) Check(e *Entrant) []string {
+
+	var broken []string
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.Field == "" || rs.Severity(r.Code) == SeverityOff || r.passes(e) {
+			continue
+		}
+		broken = append(broken, r.Code)
+		msg := r.Message
+		if msg == "" {
+			msg = r.Code + " {" + r.Field + "}"
+		}
+		warnEntrant(r.Code, e.Entrantid, r.Field, "%v", expandFields(msg, e))
+	}
+	return broken
+}
+
+// passes says whether an entrant satisfies the rule
+func (r *Rule) passes(e *Entrant) bool {
+
+	val, _ := entrantField(e, r.Field)
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return !r.Required
+	}
+	if r.re != nil && !r.re.MatchString(val) {
+		return false
+	}
+	if len(r.Allowed) > 0 && !containsFold(r.Allowed, val) {
+		return false
+	}
+	if r.Op == "" {
+		return true
+	}
+	other := r.Value
+	if r.With != "" {
+		other, _ = entrantField(e, r.With)
+	}
+	return compareValues(val, r.Op, strings.TrimSpace(other))
+}
+
+func containsFold(list []string, s string) bool {
+
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares numerically if both are numbers, otherwise as text
+// ignoring case and spaces
+func compareValues(a, op, b string) bool {
+
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	c := 0
+	if errx == nil && erry == nil {
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	} else {
+		squash := func(s string) string { return strings.ToLower(strings.Join(strings.Fields(s), "")) }
+		c = strings.Compare(squash(a), squash(b))
+	}
+	switch op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	}
+	return true
+}
+
+var fieldRef = regexp.MustCompile(`\{(\w+)\}`)
+
+// expandFields replaces each {Field} in msg with the entrant's value
+func expandFields(msg string, e *Entrant) string {
+
+	return fieldRef.ReplaceAllStringFunc(msg, func(ref string) string {
+		if v, ok := entrantField(e, ref[1:len(ref)-1]); ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// severityLevel is the logging level for issues of each severity
+func severityLevel(severity string) slog.Level {
+
+	switch severity {
+	case SeverityError:
+		return slog.LevelError
+	case SeverityInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
+
+// summariseIssues shows how many of each kind of issue were found
+func summariseIssues() {
+
+	counts := make(map[string]int)
+	for _, w := range runReport.Warnings {
+		counts[w.Severity+" "+w.Code]++
+	}
+	if len(counts) == 0 {
+		slog.Info("No data issues found")
+		return
+	}
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { // Most severe first
+		si, ci, _ := strings.Cut(keys[i], " ")
+		sj, cj, _ := strings.Cut(keys[j], " ")
+		if si != sj {
+			return severityLevel(si) > severityLevel(sj)
+		}
+		return ci < cj
+	})
+	for _, k := range keys {
+		severity, code, _ := strings.Cut(k, " ")
+		slog.Info("Data issues", "severity", severity, "code", code, "count", counts[k])
+	}
+}
+
+// countIssues returns the number of issues of the given severity
+func countIssues(severity string) int {
+
+	n := 0
+	for _, w := range runReport.Warnings {
+		if w.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// writeIssuesSheet lists every issue found on the Data issues tab
+func writeIssuesSheet() {
+
+	if len(runReport.Warnings) == 0 {
+		return
+	}
+	xl.NewSheet(issuesheet)
+	formatSheet(issuesheet, false)
+	xl.SetCellStyle(issuesheet, "A1", "E1", styleH2)
+	xl.SetRowHeight(issuesheet, 1, 30)
+	xl.SetCellValue(issuesheet, "A1", "Entrant")
+	xl.SetCellValue(issuesheet, "B1", "Severity")
+	xl.SetCellValue(issuesheet, "C1", "Issue")
+	xl.SetCellValue(issuesheet, "D1", "Field")
+	xl.SetCellValue(issuesheet, "E1", "Details")
+	xl.SetColWidth(issuesheet, "A", "B", 10)
+	xl.SetColWidth(issuesheet, "C", "D", 18)
+	xl.SetColWidth(issuesheet, "E", "E", 70)
+
+	issues := append([]EntrantWarning{}, runReport.Warnings...)
+	sort.SliceStable(issues, func(i, j int) bool {
+		return severityLevel(issues[i].Severity) > severityLevel(issues[j].Severity)
+	})
+	for i, w := range issues {
+		row := strconv.Itoa(i + 2)
+		if n := intval(w.Entrant); n > 0 {
+			xl.SetCellInt(issuesheet, "A"+row, n)
+		}
+		xl.SetCellValue(issuesheet, "B"+row, w.Severity)
+		xl.SetCellValue(issuesheet, "C"+row, w.Code)
+		xl.SetCellValue(issuesheet, "D"+row, w.Field)
+		xl.SetCellValue(issuesheet, "E"+row, w.Message)
+		xl.SetCellStyle(issuesheet, "A"+row, "E"+row, styleV2L)
+		if w.Severity == SeverityError {
+			xl.SetCellStyle(issuesheet, "B"+row, "B"+row, styleW)
+		}
+	}
+	setPagePane(issuesheet)
+}
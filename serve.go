@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The check-in/check-out server lets stewards record odometer readings and
+// times straight into the RBLR database from any browser on the local
+// network instead of transcribing the Carpark tab afterwards.
+
+const htmlTimeFormat = "2006-01-02T15:04"
+
+// carparkEntrant is a single row from the RBLR database as shown by the server
+type carparkEntrant struct {
+	EntrantID  int
+	Status     int
+	Rider      string
+	Pillion    string
+	Bike       string
+	BikeReg    string
+	Route      string
+	OdoCounts  string
+	OdoStart   string
+	OdoFinish  string
+	StartTime  string
+	FinishTime string
+}
+
+func (e carparkEntrant) StatusText() string {
+
+	switch e.Status {
+	case rblrStatus.DNS:
+		return "DNS"
+	case rblrStatus.Registered:
+		return "Registered"
+	case rblrStatus.CheckedOut:
+		return "Out riding"
+	case rblrStatus.DNF:
+		return "DNF"
+	case rblrStatus.CheckedIn:
+		return "Checked in"
+	case rblrStatus.Finisher:
+		return "Finisher"
+	case rblrStatus.LateFinisher:
+		return "Late finisher"
+	}
+	return strconv.Itoa(e.Status)
+}
+
+// Only entrants who haven't started can be checked out and only those out
+// riding checked in, so a stray scan can't overwrite a result
+func checkoutFrom() []int {
+	return []int{rblrStatus.DNS, rblrStatus.Registered}
+}
+
+func checkinFrom() []int {
+	return []int{rblrStatus.CheckedOut}
+}
+
+func (e carparkEntrant) CanCheckOut() bool {
+	return slices.Contains(checkoutFrom(), e.Status)
+}
+
+func (e carparkEntrant) CanCheckIn() bool {
+	return slices.Contains(checkinFrom(), e.Status)
+}
+
+const carparkFields = `EntrantID,EntrantStatus,ifnull(RiderFirst,'')||' '||ifnull(RiderLast,''),
+ifnull(PillionFirst,'')||' '||ifnull(PillionLast,''),ifnull(Bike,''),ifnull(BikeReg,''),ifnull(Route,''),
+ifnull(OdoCounts,''),ifnull(OdoStart,''),ifnull(OdoFinish,''),ifnull(StartTime,''),ifnull(FinishTime,'')`
+
+func queryCarpark(rdb *sql.DB, where string, args ...any) ([]carparkEntrant, error) {
+
+	rows, err := rdb.Query("SELECT "+carparkFields+" FROM entrants WHERE "+where+" ORDER BY EntrantID", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []carparkEntrant
+	for rows.Next() {
+		var e carparkEntrant
+		var status sql.NullInt64
+		err = rows.Scan(&e.EntrantID, &status, &e.Rider, &e.Pillion, &e.Bike, &e.BikeReg, &e.Route,
+			&e.OdoCounts, &e.OdoStart, &e.OdoFinish, &e.StartTime, &e.FinishTime)
+		if err != nil {
+			return nil, err
+		}
+		e.Status = rblrStatus.DNS
+		if status.Valid {
+			e.Status = int(status.Int64)
+		}
+		e.Rider = strings.TrimSpace(e.Rider)
+		e.Pillion = strings.TrimSpace(e.Pillion)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+var carparkPage = template.Must(template.New("carpark").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Refresh}}<meta http-equiv="refresh" content="30">{{end}}
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; } td, th { padding: .3em .6em; border-bottom: 1px solid #ccc; text-align: left; }
+input, select, button { font-size: 1.2em; margin: .2em; }
+.msg { background: #ffff88; padding: .5em; } .err { background: #ff9999; padding: .5em; }
+</style></head><body>
+<h1>{{.Title}}</h1>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+{{if .Error}}<p class="err">{{.Error}}</p>{{end}}
+<form action="/" method="get">
+<input name="q" value="{{.Query}}" placeholder="Name, number or scan QR" autofocus>
+<button>Find</button>
+</form>
+{{with .Entrant}}
+<h2>#{{.EntrantID}} {{.Rider}}{{if .Pillion}} &amp; {{.Pillion}}{{end}}</h2>
+<p>{{.Bike}} {{.BikeReg}} &middot; Route {{.Route}} &middot; Odo counts {{.OdoCounts}} &middot; <b>{{.StatusText}}</b></p>
+<p>Out: {{.OdoStart}} @ {{.StartTime}} &nbsp; In: {{.OdoFinish}} @ {{.FinishTime}}</p>
+{{if .CanCheckOut}}<form action="/checkout" method="post">
+<input type="hidden" name="id" value="{{.EntrantID}}">
+<b>Check-out</b> odo <input name="odo" inputmode="numeric" value="{{.OdoStart}}" size="8">
+time <input type="datetime-local" name="time" value="{{$.Now}}">
+<button>Check out</button>
+</form>{{end}}
+{{if .CanCheckIn}}<form action="/checkin" method="post">
+<input type="hidden" name="id" value="{{.EntrantID}}">
+<b>Check-in</b> odo <input name="odo" inputmode="numeric" value="{{.OdoFinish}}" size="8">
+time <input type="datetime-local" name="time" value="{{$.Now}}">
+<select name="status"><option value="{{$.Finisher}}">Finisher</option><option value="{{$.LateFinisher}}">Late finisher</option><option value="{{$.DNF}}">DNF</option></select>
+<button>Check in</button>
+</form>{{end}}
+{{end}}
+{{if .Found}}<h2>Found</h2><table>
+{{range .Found}}<tr><td><a href="/?id={{.EntrantID}}">{{.EntrantID}}</a></td><td>{{.Rider}}</td><td>{{.Pillion}}</td><td>{{.Route}}</td><td>{{.StatusText}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Still out ({{len .StillOut}})</h2><table>
+<tr><th>#</th><th>Rider</th><th>Route</th><th>Out since</th></tr>
+{{range .StillOut}}<tr><td><a href="/?id={{.EntrantID}}">{{.EntrantID}}</a></td><td>{{.Rider}}</td><td>{{.Route}}</td><td>{{.StartTime}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+type carparkView struct {
+	Title        string
+	Query        string
+	Message      string
+	Error        string
+	Now          string
+	Refresh      bool
+	Entrant      *carparkEntrant
+	Found        []carparkEntrant
+	StillOut     []carparkEntrant
+	Finisher     int
+	LateFinisher int
+	DNF          int
+}
+
+// carparkServer serves the check-in/check-out pages from an RBLR database
+type carparkServer struct {
+	db *sql.DB
+}
+
+func (cs *carparkServer) render(w http.ResponseWriter, r *http.Request, v carparkView) {
+
+	v.Title = strings.ToUpper(cfg.Rally) + " " + cfg.Year + " carpark"
+	v.Now = time.Now().Format(htmlTimeFormat)
+	v.Finisher = rblrStatus.Finisher
+	v.LateFinisher = rblrStatus.LateFinisher
+	v.DNF = rblrStatus.DNF
+	if v.Message == "" {
+		v.Message = r.URL.Query().Get("msg")
+	}
+	var err error
+	v.StillOut, err = queryCarpark(cs.db, "EntrantStatus=?", rblrStatus.CheckedOut)
+	if err != nil && v.Error == "" {
+		v.Error = err.Error()
+	}
+	v.Refresh = v.Entrant == nil && v.Query == ""
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := carparkPage.Execute(w, v); err != nil {
+		slog.Error("Carpark page", "err", err)
+	}
+}
+
+// lookup finds entrants by number, scanned QR code or part of a name
+func (cs *carparkServer) lookup(q string) ([]carparkEntrant, error) {
+
+	q = strings.TrimSpace(q)
+	if t, err := DecodeEntrantQR(q); err == nil {
+		if !t.Matches(cfg.Rally, cfg.Year) {
+			return nil, fmt.Errorf("that QR code is for %v %v", t.Rally, t.Year)
+		}
+		return queryCarpark(cs.db, "EntrantID=?", t.EntrantID)
+	} else if err == ErrQRChecksum {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(q); err == nil {
+		return queryCarpark(cs.db, "EntrantID=?", n)
+	}
+	like := "%" + q + "%"
+	return queryCarpark(cs.db, "(RiderFirst||' '||RiderLast LIKE ? OR PillionFirst||' '||PillionLast LIKE ? OR BikeReg LIKE ?)", like, like, like)
+}
+
+func (cs *carparkServer) handleHome(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var v carparkView
+	var found []carparkEntrant
+	var err error
+	if id := r.URL.Query().Get("id"); id != "" {
+		found, err = queryCarpark(cs.db, "EntrantID=?", intval(id))
+	} else if v.Query = r.URL.Query().Get("q"); v.Query != "" {
+		found, err = cs.lookup(v.Query)
+	}
+	if err != nil {
+		v.Error = err.Error()
+	} else if len(found) == 1 {
+		v.Entrant = &found[0]
+	} else if len(found) > 1 {
+		v.Found = found
+	} else if v.Query != "" {
+		v.Error = "No entrant matches " + v.Query
+	}
+	cs.render(w, r, v)
+}
+
+// readingFromForm validates the odometer reading and time posted by a steward
+func readingFromForm(r *http.Request) (int, string, string, error) {
+
+	id := intval(r.FormValue("id"))
+	odo := strings.TrimSpace(r.FormValue("odo"))
+	if _, err := strconv.Atoi(odo); err != nil {
+		return id, "", "", fmt.Errorf("odometer reading %q must be a whole number", odo)
+	}
+	tm := strings.TrimSpace(r.FormValue("time"))
+	if _, err := time.Parse(htmlTimeFormat, tm); err != nil {
+		return id, "", "", fmt.Errorf("time %q is not valid", tm)
+	}
+	return id, odo, tm, nil
+}
+
+func (cs *carparkServer) handleCheckout(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	id, odo, tm, err := readingFromForm(r)
+	if err == nil {
+		err = cs.update(id, "out", checkoutFrom(), "OdoStart=?,StartTime=?,EntrantStatus=?", odo, tm, rblrStatus.CheckedOut)
+	}
+	if err != nil {
+		cs.render(w, r, carparkView{Error: err.Error()})
+		return
+	}
+	slog.Info("Checked out", "entrant", id, "odo", odo, "time", tm)
+	http.Redirect(w, r, "/?msg="+url.QueryEscape(fmt.Sprintf("#%v checked out", id)), http.StatusSeeOther)
+}
+
+func (cs *carparkServer) handleCheckin(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	id, odo, tm, err := readingFromForm(r)
+	status := intval(r.FormValue("status"))
+	if err == nil && status != rblrStatus.Finisher && status != rblrStatus.LateFinisher && status != rblrStatus.DNF {
+		err = fmt.Errorf("finish status %v is not valid", status)
+	}
+	if err == nil {
+		var start string
+		err = cs.db.QueryRow("SELECT ifnull(OdoStart,'') FROM entrants WHERE EntrantID=?", id).Scan(&start)
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("entrant %v not found", id)
+		} else if err == nil && start != "" && intval(odo) < intval(start) {
+			err = fmt.Errorf("odometer reading %v is less than the check-out reading %v", odo, start)
+		}
+	}
+	if err == nil {
+		err = cs.update(id, "in", checkinFrom(), "OdoFinish=?,FinishTime=?,EntrantStatus=?", odo, tm, status)
+	}
+	if err != nil {
+		cs.render(w, r, carparkView{Error: err.Error()})
+		return
+	}
+	slog.Info("Checked in", "entrant", id, "odo", odo, "time", tm, "status", status)
+	http.Redirect(w, r, "/?msg="+url.QueryEscape(fmt.Sprintf("#%v checked in", id)), http.StatusSeeOther)
+}
+
+// update records a check-out or check-in, provided the entrant's status
+// is one of those it can be checked out or in from
+func (cs *carparkServer) update(id int, action string, from []int, set string, args ...any) error {
+
+	args = append(args, id, rblrStatus.DNS)
+	for _, s := range from {
+		args = append(args, s)
+	}
+	in := strings.TrimSuffix(strings.Repeat("?,", len(from)), ",")
+	res, err := cs.db.Exec("UPDATE entrants SET "+set+" WHERE EntrantID=? AND ifnull(EntrantStatus,?) IN ("+in+")", args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+	found, err := queryCarpark(cs.db, "EntrantID=?", id)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("entrant %v not found", id)
+	}
+	return fmt.Errorf("entrant %v can't be checked %v, their status is %v", id, action, found[0].StatusText())
+}
+
+// runServer starts the check-in/check-out server and only returns on failure
+func runServer(addr string) error {
+
+	if rblrdb == nil {
+		return fmt.Errorf("no RBLR database (rblrdb) is configured")
+	}
+	cs := &carparkServer{db: rblrdb}
+
+	slog.Info("Check-in/check-out server listening", "addr", addr)
+	return http.ListenAndServe(addr, cs.routes())
+}
+
+// routes maps the server's pages to their handlers
+func (cs *carparkServer) routes() *http.ServeMux {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", cs.handleHome)
+	mux.HandleFunc("/checkout", cs.handleCheckout)
+	mux.HandleFunc("/checkin", cs.handleCheckin)
+	return mux
+}
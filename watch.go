@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Watch mode keeps polling the Wufoo report and only rebuilds the
+// spreadsheet and exports when the downloaded content actually changes.
+
+// watchedEntry is what we remember about each entry between polls
+type watchedEntry struct {
+	Name      string
+	Status    string
+	Withdrawn string
+}
+
+// snapshotEntries reads the entries just loaded, keyed by Wufoo EntryId
+func snapshotEntries() map[string]watchedEntry {
+
+	res := make(map[string]watchedEntry)
+	rows, err := db.Query("SELECT EntryId,ifnull(RiderName,''),ifnull(RiderLast,''),ifnull(PaymentStatus,''),ifnull(Withdrawn,'') FROM entrants")
+	if err != nil {
+		slog.Error("Can't summarise changes", "err", err)
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, first, last string
+		var e watchedEntry
+		rows.Scan(&id, &first, &last, &e.Status, &e.Withdrawn)
+		e.Name = strings.TrimSpace(properName(first) + " " + properName(last))
+		res[id] = e
+	}
+	return res
+}
+
+// summariseChanges describes the differences between two snapshots
+func summariseChanges(was, now map[string]watchedEntry) []string {
+
+	var res []string
+	for id, e := range now {
+		old, ok := was[id]
+		switch {
+		case !ok:
+			res = append(res, "New entry "+e.Name)
+		case e.Withdrawn != "" && old.Withdrawn == "":
+			res = append(res, "Withdrawn "+e.Name)
+		case e.Status != old.Status:
+			res = append(res, fmt.Sprintf("%v payment %q now %q", e.Name, old.Status, e.Status))
+		case e != old:
+			res = append(res, "Amended "+e.Name)
+		}
+	}
+	for id, e := range was {
+		if _, ok := now[id]; !ok {
+			res = append(res, "Removed "+e.Name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// runWatch polls cfg.CsvUrl every interval and never returns. Download
+// failures are reported and retried at the next poll.
+func runWatch(interval time.Duration) {
+
+	var lastHash [sha256.Size]byte
+	var last map[string]watchedEntry
+
+	slog.Info("Watching", "url", cfg.CsvUrl, "every", interval)
+	for ; ; time.Sleep(interval) {
+		data, err := fetchCSV(cfg.CsvUrl)
+		if err != nil {
+			slog.Error("Download failed, will try again", "err", err)
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if last != nil && hash == lastHash {
+			slog.Debug("No change")
+			continue
+		}
+		if err = importCSV(bytes.NewReader(data)); err != nil {
+			slog.Error("Download not usable, will try again", "err", err)
+			continue
+		}
+		if err = fixRiderNumbers(); err != nil {
+			slog.Error("Entries not renumbered, will try again", "err", err)
+			continue
+		}
+		now := snapshotEntries()
+		if last == nil {
+			slog.Info("Initial download", "entries", len(now))
+		} else {
+			changes := summariseChanges(last, now)
+			slog.Info("Changes downloaded", "count", len(changes))
+			for _, c := range changes {
+				slog.Info(c)
+			}
+		}
+		if err = buildOutputs(); err != nil {
+			slog.Error("Rebuild failed, will try again", "err", err)
+			continue
+		}
+		lastHash = hash
+		last = now
+	}
+}